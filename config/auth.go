@@ -0,0 +1,44 @@
+package config
+
+//==================================================
+// Remote authentication and verification
+//==================================================
+
+// Credential providers, in the order they are tried when none are configured
+var DefaultProviders = []string{"agent", "key", "token", "helper"}
+
+// How hearth authenticates with remotes. Secrets never live in the config,
+// tokens are read from an environment variable or a file outside the repo.
+type Auth struct {
+	Providers []string `yaml:"providers,omitempty"`  // agent, key, token and/or helper, tried in order
+	SshKeys   []string `yaml:"ssh_keys,omitempty"`   // private keys for the key provider
+	Username  string   `yaml:"username,omitempty"`   // for https, when the url has none
+	TokenEnv  string   `yaml:"token_env,omitempty"`  // environment variable holding an https token
+	TokenFile string   `yaml:"token_file,omitempty"` // file holding an https token
+}
+
+// Get the providers to try, in order
+func (a Auth) ProviderNames() []string {
+	if len(a.Providers) == 0 {
+		return DefaultProviders
+	}
+	return a.Providers
+}
+
+// Known hosts files checked when none are configured
+var DefaultKnownHosts = []string{"~/.ssh/known_hosts"}
+
+// How hearth makes sure it is talking to the right server
+type Verify struct {
+	KnownHosts []string            `yaml:"known_hosts,omitempty"` // ssh host keys, defaults to ~/.ssh/known_hosts
+	CABundle   string              `yaml:"ca_bundle,omitempty"`   // PEM certificates trusted instead of the system's
+	Pins       map[string][]string `yaml:"pins,omitempty"`        // remote name to the only fingerprints it may present
+}
+
+// Get the known hosts files to check
+func (v Verify) KnownHostsFiles() []string {
+	if len(v.KnownHosts) == 0 {
+		return DefaultKnownHosts
+	}
+	return v.KnownHosts
+}
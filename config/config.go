@@ -5,7 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -16,23 +17,42 @@ func Path() string {
 	return path.Join(os.Getenv("HOME"), Name)
 }
 
-// Opens the ~/.hearthrc file. This fille cannot change nor be moved
-// so this function is really a convenience function
+// Opens the ~/.hearthrc file merged with this host's and the user's overrides
+// (see Layers). This fille cannot change nor be moved so this function is
+// really a convenience function
 func Open() (Config, error) {
-	var config Config
-	default_file := Path()
-	if strings.HasPrefix(default_file, "~/") {
-		default_file = path.Join(os.Getenv("HOME"), default_file[2:])
+	conf, _, err := OpenWithOrigins()
+	return conf, err
+}
+
+// Opens the merged config along with where each of its values came from
+func OpenWithOrigins() (Config, []Origin, error) {
+	layers, err := Layers()
+	if err != nil {
+		return Config{}, nil, err
 	}
 
+	return Merge(layers)
+}
+
+// Opens the ~/.hearthrc file alone, without the overrides on top. This is the
+// config to change and write back, so overrides do not leak into it.
+func OpenBase() (Config, error) {
+	default_file := pkg.ExpandHome(Path())
+
 	// try to read the default
 	config_bytes, err := ioutil.ReadFile(default_file)
 	if err != nil {
 		return Config{}, err
 	}
 
-	// make a config out of it
-	if err = yaml.Unmarshal(config_bytes, &config); err != nil {
+	return Parse(config_bytes)
+}
+
+// Make a config out of the contents of a hearthrc
+func Parse(contents []byte) (Config, error) {
+	var config Config
+	if err := yaml.Unmarshal(contents, &config); err != nil {
 		return config, fmt.Errorf("failed to parse hearthrc: %s", err.Error())
 	}
 
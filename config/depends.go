@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+//==================================================
+// Package dependencies
+//==================================================
+
+const (
+	unvisited = iota
+	visiting
+	visited
+)
+
+// Resolve the given packages and all of their transitive dependencies into an
+// install order where every package comes after everything it depends on.
+// Packages without an ordering between them keep the order they were given in.
+// Unknown packages, missing dependencies and cycles are errors.
+func (c PackageMap) Resolve(names []string) ([]string, error) {
+	unknown := make([]string, 0)
+	for _, n := range names {
+		if _, exists := c[n]; exists == false {
+			unknown = append(unknown, n)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown packages: %s", strings.Join(unknown, ", "))
+	}
+
+	order := make([]string, 0, len(names))
+	marks := make(map[string]int)
+	missing := make([]string, 0)
+
+	var visit func(name string, stack []string) error
+	visit = func(name string, stack []string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, s := range stack {
+				if s == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(stack[start:], name)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		marks[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range c[name].Depends {
+			if _, exists := c[dep]; exists == false {
+				missing = append(missing, fmt.Sprintf("%s (needed by %s)", dep, name))
+				continue
+			}
+
+			if err := visit(dep, stack); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+
+		order = append(order, name)
+		return nil
+	}
+
+	for _, n := range names {
+		if err := visit(n, make([]string, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing dependencies: %s", strings.Join(missing, ", "))
+	}
+
+	return order, nil
+}
+
+// Order the given packages so each comes after any of the others it depends
+// on, directly or not, without adding any packages to the list.
+func (c PackageMap) Sort(names []string) ([]string, error) {
+	resolved, err := c.Resolve(names)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, n := range names {
+		wanted[n] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for _, n := range resolved {
+		if wanted[n] {
+			sorted = append(sorted, n)
+		}
+	}
+
+	return sorted, nil
+}
+
+// Check the whole map for missing dependencies and cycles
+func (c PackageMap) Validate() error {
+	_, err := c.Resolve(c.Names())
+	return err
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+)
+
+func dependency_map() PackageMap {
+	return PackageMap{
+		"base": {Name: "base"},
+		"vim":  {Name: "vim", Depends: []string{"base"}},
+		"zsh":  {Name: "zsh", Depends: []string{"base"}},
+		"work": {Name: "work", Depends: []string{"zsh", "vim"}},
+	}
+}
+
+func TestPackageMap_Resolve_Transitive(t *testing.T) {
+	order, err := dependency_map().Resolve([]string{"work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, order, "base", "zsh", "vim", "work")
+}
+
+func TestPackageMap_Resolve_NoDuplicates(t *testing.T) {
+	order, err := dependency_map().Resolve([]string{"vim", "zsh", "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, order, "base", "vim", "zsh")
+}
+
+func TestPackageMap_Resolve_Cycle(t *testing.T) {
+	conf := PackageMap{
+		"a": {Name: "a", Depends: []string{"b"}},
+		"b": {Name: "b", Depends: []string{"c"}},
+		"c": {Name: "c", Depends: []string{"a"}},
+	}
+
+	_, err := conf.Resolve([]string{"a"})
+	if err == nil {
+		t.Fatal("expected a cycle to be detected")
+	}
+
+	if err.Error() != "dependency cycle: a -> b -> c -> a" {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestPackageMap_Resolve_Missing(t *testing.T) {
+	conf := PackageMap{
+		"vim": {Name: "vim", Depends: []string{"base", "fonts"}},
+	}
+
+	_, err := conf.Resolve([]string{"vim"})
+	if err == nil {
+		t.Fatal("expected missing dependencies to be reported")
+	}
+
+	if strings.Contains(err.Error(), "base (needed by vim)") == false ||
+		strings.Contains(err.Error(), "fonts (needed by vim)") == false {
+		t.Errorf("did not report every missing dependency: %s", err.Error())
+	}
+}
+
+func TestPackageMap_Sort(t *testing.T) {
+	sorted, err := dependency_map().Sort([]string{"work", "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, sorted, "base", "work")
+}
+
+func TestPackageMap_Validate(t *testing.T) {
+	if err := dependency_map().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := dependency_map()
+	broken["base"] = pkg.Info{Name: "base", Depends: []string{"work"}}
+	if err := broken.Validate(); err == nil {
+		t.Fatal("expected the cycle through base to be found")
+	}
+}
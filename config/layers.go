@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//==================================================
+// Layered config
+//==================================================
+
+// Directory in the repository holding the overrides of each machine, named
+// <hostname>.yml
+const HostsDirectory = "hosts"
+
+// Untracked overrides of the user, next to ~/.hearthrc
+const LocalName = ".hearthrc.local"
+
+func LocalPath() string {
+	return path.Join(os.Getenv("HOME"), LocalName)
+}
+
+// Get the path, relative to the repository, of this machine's overrides. The
+// hostname is taken up to its first dot.
+func HostPath() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not get hostname: %s", err.Error())
+	}
+
+	if dot := strings.Index(host, "."); dot > 0 {
+		host = host[:dot]
+	}
+	return path.Join(HostsDirectory, host+".yml"), nil
+}
+
+// One source of config values, merged over the layers before it
+type Layer struct {
+	Name     string // where the values came from, shown as their origin
+	Contents []byte // yaml, any part of a config
+}
+
+// Read a layer from the file. False when there is no such file.
+func ReadLayer(name, file_path string) (Layer, bool, error) {
+	contents, err := ioutil.ReadFile(file_path)
+	if os.IsNotExist(err) {
+		return Layer{}, false, nil
+	} else if err != nil {
+		return Layer{}, false, fmt.Errorf("could not read %s: %s", name, err.Error())
+	}
+
+	return Layer{name, contents}, true, nil
+}
+
+// Get the layers of this machine's config: ~/.hearthrc (the repository's
+// .hearthrc), then the repository's overrides for this host and the user's
+// local overrides. Both overrides are optional. The host's overrides are
+// looked for in the directory of the local overrides when they set one, as
+// a repository cloned elsewhere than committed does.
+func Layers() ([]Layer, error) {
+	base, exists, err := ReadLayer(Name, Path())
+	if err != nil {
+		return nil, err
+	} else if exists == false {
+		return nil, fmt.Errorf("no config at %s", Path())
+	}
+
+	conf, err := Parse(base.Contents)
+	if err != nil {
+		return nil, err
+	}
+
+	local, has_local, err := ReadLayer(LocalName, LocalPath())
+	if err != nil {
+		return nil, err
+	} else if has_local {
+		local_conf, err := Parse(local.Contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", LocalName, err.Error())
+		} else if len(local_conf.BaseDirectory) > 0 {
+			conf.BaseDirectory = local_conf.BaseDirectory
+		}
+	}
+
+	host_path, err := HostPath()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []Layer{base}
+	host, exists, err := ReadLayer(host_path, path.Join(pkg.ExpandHome(conf.BaseDirectory), host_path))
+	if err != nil {
+		return nil, err
+	} else if exists {
+		layers = append(layers, host)
+	}
+
+	if has_local {
+		layers = append(layers, local)
+	}
+	return layers, nil
+}
+
+// Set a top-level value in the user's local overrides, keeping whatever else
+// they hold. The file is created when missing.
+func SetLocal(key string, value interface{}) error {
+	values := make(map[interface{}]interface{})
+
+	layer, exists, err := ReadLayer(LocalName, LocalPath())
+	if err != nil {
+		return err
+	} else if exists {
+		if err := yaml.Unmarshal(layer.Contents, &values); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", LocalName, err.Error())
+		}
+		if values == nil {
+			values = make(map[interface{}]interface{})
+		}
+	}
+	values[key] = value
+
+	contents, err := yaml.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s: %s", LocalName, err.Error())
+	}
+
+	if err := ioutil.WriteFile(LocalPath(), contents, 0644); err != nil {
+		return fmt.Errorf("could not write %s: %s", LocalName, err.Error())
+	}
+	return nil
+}
+
+// A single value of a merged config and the layer it came from
+type Origin struct {
+	Key   string // dotted path to the value, e.g. packages.vim.target
+	Value string
+	Layer string
+}
+
+// Deep-merge the layers, each over the ones before it, into a config. Maps,
+// packages among them, are merged key by key; any other value, lists included,
+// replaces the one below. Gives where each value came from, sorted by key.
+func Merge(layers []Layer) (Config, []Origin, error) {
+	merged := make(map[interface{}]interface{})
+	from := make(map[string]string)
+
+	for _, l := range layers {
+		var values map[interface{}]interface{}
+		if err := yaml.Unmarshal(l.Contents, &values); err != nil {
+			return Config{}, nil, fmt.Errorf("failed to parse %s: %s", l.Name, err.Error())
+		}
+
+		mergeValues(merged, values, "", l.Name, from)
+	}
+
+	contents, err := yaml.Marshal(merged)
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("could not marshal merged config: %s", err.Error())
+	}
+
+	conf, err := Parse(contents)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	origins := make([]Origin, 0, len(from))
+	flattenValues(merged, "", func(key string, value interface{}) {
+		origins = append(origins, Origin{key, fmt.Sprint(value), from[key]})
+	})
+	sort.Sort(byKey(origins))
+
+	return conf, origins, nil
+}
+
+type byKey []Origin
+
+func (o byKey) Len() int           { return len(o) }
+func (o byKey) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o byKey) Less(i, j int) bool { return o[i].Key < o[j].Key }
+
+// Merge the values of src into dst, noting the layer each leaf was set by
+func mergeValues(dst, src map[interface{}]interface{}, prefix, layer string, from map[string]string) {
+	for k, v := range src {
+		key := joinKey(prefix, k)
+
+		inner, is_map := v.(map[interface{}]interface{})
+		below, was_map := dst[k].(map[interface{}]interface{})
+		if is_map && was_map {
+			mergeValues(below, inner, key, layer, from)
+			continue
+		}
+
+		// whatever was below is replaced whole
+		for old := range from {
+			if old == key || strings.HasPrefix(old, key+".") {
+				delete(from, old)
+			}
+		}
+
+		dst[k] = v
+		flattenValues(v, key, func(leaf string, _ interface{}) {
+			from[leaf] = layer
+		})
+	}
+}
+
+// Call fn with the dotted key of every value that is not a map
+func flattenValues(v interface{}, key string, fn func(string, interface{})) {
+	values, is_map := v.(map[interface{}]interface{})
+	if is_map == false {
+		fn(key, v)
+		return
+	}
+
+	for k, inner := range values {
+		flattenValues(inner, joinKey(key, k), fn)
+	}
+}
+
+func joinKey(prefix string, k interface{}) string {
+	if len(prefix) == 0 {
+		return fmt.Sprint(k)
+	}
+	return prefix + "." + fmt.Sprint(k)
+}
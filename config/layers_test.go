@@ -0,0 +1,165 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+//==================================================
+// Layered config
+//==================================================
+
+func TestMerge_PackagesDeepMerged(t *testing.T) {
+	base := `
+directory: ~/.hearth
+packages:
+    vim:
+        target: ~
+        depends: [git]
+    git:
+        target: ~
+`
+	host := `
+packages:
+    vim:
+        install: make install
+        depends: [curl]
+    tmux:
+        target: ~/.config
+`
+	local := `
+pull:
+    rebase: true
+packages:
+    vim:
+        target: ~/vim
+`
+
+	conf, origins, err := Merge([]Layer{{".hearthrc", []byte(base)}, {"hosts/laptop.yml", []byte(host)}, {".hearthrc.local", []byte(local)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vim := conf.Packages["vim"]
+	if vim.Name != "vim" || vim.Target != "~/vim" || vim.InstallCmd.Cmd != "make install" {
+		t.Errorf("vim was not merged: %+v", vim)
+	}
+	if len(vim.Depends) != 1 || vim.Depends[0] != "curl" {
+		t.Errorf("expected lists to be replaced, got %v", vim.Depends)
+	}
+	if _, exists := conf.Packages["git"]; exists == false {
+		t.Errorf("expected git to be kept from the base")
+	}
+	if _, exists := conf.Packages["tmux"]; exists == false {
+		t.Errorf("expected tmux to be added by the host")
+	}
+	if conf.Pull.Rebase == false || conf.BaseDirectory != "~/.hearth" {
+		t.Errorf("wrong top level values: %+v", conf)
+	}
+
+	expected := map[string]string{
+		"directory":            ".hearthrc",
+		"packages.git.target":  ".hearthrc",
+		"packages.vim.depends": "hosts/laptop.yml",
+		"packages.vim.install": "hosts/laptop.yml",
+		"packages.vim.target":  ".hearthrc.local",
+		"packages.tmux.target": "hosts/laptop.yml",
+		"pull.rebase":          ".hearthrc.local",
+	}
+	if len(origins) != len(expected) {
+		t.Errorf("expected %d values, got %+v", len(expected), origins)
+	}
+	for i, o := range origins {
+		if i > 0 && origins[i-1].Key > o.Key {
+			t.Errorf("origins are not sorted: %s before %s", origins[i-1].Key, o.Key)
+		}
+		if expected[o.Key] != o.Layer {
+			t.Errorf("expected %s from %s, got %s", o.Key, expected[o.Key], o.Layer)
+		}
+	}
+}
+
+func TestMerge_ReplacedMapDropsOrigins(t *testing.T) {
+	base := `
+packages:
+    vim:
+        install:
+            cmd: make
+            pre: ./configure
+`
+	host := `
+packages:
+    vim:
+        install: apt-get install vim
+`
+
+	conf, origins, err := Merge([]Layer{{".hearthrc", []byte(base)}, {"hosts/laptop.yml", []byte(host)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vim := conf.Packages["vim"]; vim.InstallCmd.Cmd != "apt-get install vim" || len(vim.InstallCmd.PreCmd) > 0 {
+		t.Errorf("expected the install to be replaced whole: %+v", vim.InstallCmd)
+	}
+	if len(origins) != 1 || origins[0].Key != "packages.vim.install" || origins[0].Layer != "hosts/laptop.yml" {
+		t.Errorf("wrong origins: %+v", origins)
+	}
+}
+
+func TestMerge_BadLayer(t *testing.T) {
+	_, _, err := Merge([]Layer{{".hearthrc", []byte("directory: ~/.hearth\n")}, {".hearthrc.local", []byte("packages: [")}})
+	if err == nil {
+		t.Errorf("expected the broken layer to be reported")
+	}
+}
+
+func TestLayers_LocalDirectory(t *testing.T) {
+	home, err := ioutil.TempDir("", "hearth-layers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	old_home := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", old_home)
+
+	// cloned somewhere else than the committed directory
+	repo_path := path.Join(home, "dotfiles")
+	host_path, err := HostPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(repo_path, HostsDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(repo_path, host_path), []byte("pull:\n    rebase: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(Path(), []byte("directory: ~/.hearth\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(LocalPath(), []byte("vars:\n    email: me@home\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetLocal("directory", repo_path); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.BaseDirectory != repo_path {
+		t.Errorf("expected the local directory, got %s", conf.BaseDirectory)
+	}
+	if conf.Pull.Rebase == false {
+		t.Errorf("expected the host's overrides to be read from the local directory")
+	}
+	if conf.Vars["email"] != "me@home" {
+		t.Errorf("expected the other local values to be kept, got %v", conf.Vars)
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+	"github.com/zmarcantel/hearth/secret"
+)
+
+//==================================================
+// Secrets
+//==================================================
+
+// How secrets are sealed, and which files must never be committed in plaintext.
+// Files ending in .secret hold sealed secrets, see 'hearth secret add'.
+type Secrets struct {
+	Keyfile    string   `yaml:"keyfile,omitempty"`    // defaults to ~/.hearth.key
+	Passphrase bool     `yaml:"passphrase,omitempty"` // derive the key from a passphrase asked for instead
+	Patterns   []string `yaml:"patterns,omitempty"`   // globs of files in the repository, on the base name when without a /
+}
+
+// Get the keyfile path, with a leading ~/ expanded
+func (s Secrets) KeyfilePath() string {
+	if len(s.Keyfile) == 0 {
+		return secret.DefaultKeyfile()
+	}
+	return pkg.ExpandHome(s.Keyfile)
+}
+
+// Get the paths, relative to the repository in dir, that are secrets in
+// plaintext: named as sealed, or matched by a pattern of the config or by the
+// secrets of their package, without the contents of a sealed file. A pattern
+// matching a directory covers everything inside it. Paths no longer there are
+// not secrets.
+func (c Config) UnsealedSecrets(dir string, paths []string) []string {
+	unsealed := make([]string, 0)
+	for _, p := range paths {
+		p = filepath.ToSlash(p)
+		if secret.IsSecret(p) == false && c.isSecret(p) == false {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(dir, p))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil || secret.IsSealed(contents) == false {
+			unsealed = append(unsealed, p)
+		}
+	}
+
+	return unsealed
+}
+
+func (c Config) isSecret(p string) bool {
+	for _, pattern := range c.Secrets.Patterns {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+
+	// package secrets are relative to the package directory
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) < 2 {
+		return false
+	}
+
+	for _, pattern := range c.Packages[parts[0]].Secrets {
+		if matchPath(pattern, parts[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Truthy function on whether the glob matches the path or a directory above it.
+// Without a / the glob is matched against base names alone.
+func matchPath(pattern, p string) bool {
+	for ; p != "." && p != "/"; p = path.Dir(p) {
+		candidate := p
+		if strings.Contains(pattern, "/") == false {
+			candidate = path.Base(p)
+		}
+
+		if ok, _ := path.Match(pattern, candidate); ok {
+			return true
+		}
+	}
+
+	return false
+}
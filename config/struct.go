@@ -1,6 +1,13 @@
 package config
 
-import "github.com/zmarcantel/hearth/repository/pkg"
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+)
 
 //==================================================
 // Package management
@@ -23,11 +30,87 @@ func (c *PackageMap) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// Get the sorted names of every package in the map
+func (c PackageMap) Names() []string {
+	names := make([]string, 0, len(c))
+	for k := range c {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Resolve a package selection into a list of package names. Positional names
+// come first in the order given, followed by every package (if all is set) or
+// those matching the filter regular expression (go syntax), in sorted order.
+// Duplicates are dropped. Every unknown name is reported in a single error.
+func (c PackageMap) Select(names []string, all bool, filter string) ([]string, error) {
+	var re *regexp.Regexp
+	if len(filter) > 0 {
+		var err error
+		re, err = regexp.Compile(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package filter: %s", err.Error())
+		}
+	}
+
+	selected := make([]string, 0)
+	seen := make(map[string]bool)
+	unknown := make([]string, 0)
+
+	for _, n := range names {
+		if _, exists := c[n]; exists == false {
+			unknown = append(unknown, n)
+			continue
+		}
+
+		if seen[n] == false {
+			seen[n] = true
+			selected = append(selected, n)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown packages: %s", strings.Join(unknown, ", "))
+	}
+
+	if all || re != nil {
+		for _, n := range c.Names() {
+			if seen[n] || (re != nil && re.MatchString(n) == false) {
+				continue
+			}
+
+			seen[n] = true
+			selected = append(selected, n)
+		}
+	}
+
+	if len(selected) == 0 {
+		if re != nil {
+			return nil, fmt.Errorf("no packages match filter: %s", filter)
+		}
+		return nil, fmt.Errorf("no package name given")
+	}
+
+	return selected, nil
+}
+
 //==================================================
 // Base structure
 //==================================================
 
+// How pull brings in changes from the upstream
+type Pull struct {
+	Rebase bool `yaml:"rebase,omitempty"` // rebase local commits instead of merging
+}
+
 type Config struct {
-	BaseDirectory string `yaml:"directory"`
+	BaseDirectory string   `yaml:"directory"`
+	Auth          Auth     `yaml:"auth,omitempty"`
+	Verify        Verify   `yaml:"verify,omitempty"`
+	Pull          Pull     `yaml:"pull,omitempty"`
+	Vars          pkg.Vars `yaml:"vars,omitempty"` // for templates, see pkg.Render
+	Secrets       Secrets  `yaml:"secrets,omitempty"`
 	Packages      PackageMap
 }
@@ -43,3 +43,74 @@ third:
 		}
 	}
 }
+
+func selection_map() PackageMap {
+	return PackageMap{
+		"vim":      {Name: "vim"},
+		"zsh":      {Name: "zsh"},
+		"base":     {Name: "base"},
+		"work_vpn": {Name: "work_vpn"},
+	}
+}
+
+func expect_selection(t *testing.T, got []string, expect ...string) {
+	if len(got) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, got)
+	}
+
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestPackageMap_Select_Names(t *testing.T) {
+	selected, err := selection_map().Select([]string{"zsh", "vim", "zsh"}, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, selected, "zsh", "vim")
+}
+
+func TestPackageMap_Select_All(t *testing.T) {
+	selected, err := selection_map().Select([]string{"zsh"}, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, selected, "zsh", "base", "vim", "work_vpn")
+}
+
+func TestPackageMap_Select_Filter(t *testing.T) {
+	selected, err := selection_map().Select([]string{}, false, "^(v|w)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_selection(t, selected, "vim", "work_vpn")
+}
+
+func TestPackageMap_Select_Unknown(t *testing.T) {
+	_, err := selection_map().Select([]string{"vim", "emacs", "nano"}, false, "")
+	if err == nil {
+		t.Fatal("expected an error for unknown packages")
+	}
+
+	if err.Error() != "unknown packages: emacs, nano" {
+		t.Errorf("did not report all unknown packages: %s", err.Error())
+	}
+}
+
+func TestPackageMap_Select_BadFilter(t *testing.T) {
+	if _, err := selection_map().Select([]string{}, false, "(("); err == nil {
+		t.Fatal("expected an error for an invalid filter")
+	}
+}
+
+func TestPackageMap_Select_Empty(t *testing.T) {
+	if _, err := selection_map().Select([]string{}, false, ""); err == nil {
+		t.Fatal("expected an error when nothing is selected")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/zmarcantel/hearth/repository"
+)
+
+//==================================================
+// pull conflict helpers
+//==================================================
+
+// Resolve the conflicts a pull stopped on until the merge is committed or the
+// rebase is done. Dies with a hint on how to carry on when files are left in
+// conflict. Errors other than conflicts are handed back.
+func settle_conflicts(repo *repository.Repository, err error) error {
+	for {
+		conflicts, ok := err.(*repository.ConflictError)
+		if ok == false {
+			return err
+		}
+
+		if resolve_conflicts(repo, conflicts.Paths) == false {
+			log.Fatal(pull_hint(repo))
+		}
+
+		if repo.Rebasing() {
+			err = repo.ContinueRebase()
+		} else if _, err = repo.FinishMerge(conflicts.Paths); err == nil {
+			fmt.Println("merge committed")
+		}
+	}
+}
+
+// Tell how to go on with a pull left part way
+func pull_hint(repo *repository.Repository) string {
+	hint := "merge left in progress: run 'hearth resolve' to finish it or 'hearth resolve --abort' to undo the pull"
+	if repo.Rebasing() {
+		hint = "rebase left in progress: run 'hearth rebase continue' once resolved, 'hearth rebase skip' to drop the commit or 'hearth rebase abort' to undo the pull"
+	}
+
+	if repo.Stashed() {
+		hint += " (local changes stay stashed until then)"
+	}
+	return hint
+}
+
+// Walk through the conflicted paths package by package, asking how to resolve
+// each. Returns false when files were skipped (or stdin ran out), leaving them
+// in conflict.
+func resolve_conflicts(repo *repository.Repository, paths []string) bool {
+	grouped := make(map[string][]string)
+	for _, p := range paths {
+		name := repository.PackageOf(p)
+		grouped[name] = append(grouped[name], p)
+	}
+
+	names := make([]string, 0, len(grouped))
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if state, err := repo.RebaseInProgress(); err != nil {
+		log.Fatal(err)
+	} else if state != nil {
+		fmt.Printf("replaying %s onto %s, ours is %s and theirs is the local commit\n", state.StoppedAt(), state.Upstream, state.Upstream)
+	}
+
+	fmt.Printf("conflicts in %d file(s):\n", len(paths))
+	for _, name := range names {
+		if len(name) == 0 {
+			fmt.Println("    (repository)")
+		} else {
+			fmt.Printf("    %s\n", name)
+		}
+
+		for _, p := range grouped[name] {
+			fmt.Printf("        %s\n", p)
+		}
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	for _, name := range names {
+		for _, p := range grouped[name] {
+			if resolve_file(repo, in, p) == false {
+				return false
+			}
+		}
+	}
+
+	remaining, err := repo.Conflicts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return len(remaining) == 0
+}
+
+// Ask how to resolve one path until it is resolved or skipped. Returns false
+// when there is no more input.
+func resolve_file(repo *repository.Repository, in *bufio.Reader, p string) bool {
+	for {
+		fmt.Printf("%s: [o]urs, [t]heirs, [e]dit, [s]kip, [a]bort? ", p)
+		line, err := in.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			fmt.Println()
+			return false
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "o", "ours":
+			err = repo.TakeOurs(p)
+		case "t", "theirs":
+			err = repo.TakeTheirs(p)
+		case "e", "edit":
+			if err = run_editor(path.Join(repo.Path, p)); err == nil {
+				err = repo.MarkResolved(p)
+			}
+		case "s", "skip":
+			return true
+		case "a", "abort":
+			abort_pull(repo)
+			log.Fatal("pull aborted, the repository is back where it was before it")
+		default:
+			continue
+		}
+
+		if err != nil {
+			fmt.Printf("    %s\n", err.Error())
+			continue
+		}
+		return true
+	}
+}
+
+// Undo the merge or rebase in progress
+func abort_pull(repo *repository.Repository) {
+	abort := repo.AbortMerge
+	if repo.Rebasing() {
+		abort = repo.AbortRebase
+	}
+
+	if err := abort(); err != nil {
+		log.Fatal(err)
+	}
+	restore_stash(repo)
+}
+
+// Put uncommitted changes aside for a pull, or throw them away
+func stash_changes(repo *repository.Repository, discard bool) {
+	if discard {
+		if err := repo.DiscardChanges(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	stashed, err := repo.Stash()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stashed {
+		fmt.Println("local changes stashed")
+	}
+}
+
+// Reapply changes stashed for a pull, once the pull is done, reporting the
+// files they conflict in
+func restore_stash(repo *repository.Repository) {
+	if repo.Merging() || repo.Rebasing() {
+		return
+	}
+
+	conflicts, stash_id, err := repo.Unstash()
+	if err != nil {
+		log.Fatalf("could not reapply local changes, they are in %s: %s", repository.StashRef, err.Error())
+	} else if stash_id == nil {
+		return
+	}
+
+	if len(conflicts) == 0 {
+		fmt.Println("local changes reapplied")
+		return
+	}
+
+	fmt.Println("local changes conflict with the pull, fix the conflict markers in:")
+	for _, p := range conflicts {
+		fmt.Printf("    %s\n", p)
+	}
+	fmt.Printf("the changes as they were are in commit %s\n", stash_id.String())
+}
+
+// Print the packages a finished pull added and modified, which were not
+// installed or updated as the pull stopped part way
+func print_pulled_packages(repo *repository.Repository) {
+	old_id, err := repo.OrigHead()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the config from before the pull, the one read mid-pull may have had its changes
+	old_config, err := repo.ConfigAt(old_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	added, modified := changed_packages(repo, old_config, old_id)
+	if len(added) > 0 {
+		fmt.Printf("packages added by the pull: %s (see 'hearth install')\n", strings.Join(added, " "))
+	}
+	if len(modified) > 0 {
+		fmt.Printf("packages modified by the pull: %s (see 'hearth update')\n", strings.Join(modified, " "))
+	}
+}
+
+// Open the file in $EDITOR and wait for it to exit
+func run_editor(file_path string) error {
+	editor := os.ExpandEnv("$EDITOR")
+	if len(editor) == 0 {
+		return fmt.Errorf("no default editor in environment")
+	}
+
+	editor_path, err := exec.LookPath(editor)
+	if err != nil {
+		return fmt.Errorf("could not find %s: %s", editor, err.Error())
+	}
+
+	cmd := exec.Command(editor_path, file_path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error while running %s: %s", editor_path, err.Error())
+	}
+
+	return nil
+}
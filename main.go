@@ -4,9 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/zmarcantel/hearth/config"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/codegangsta/cli"
 	git "gopkg.in/libgit2/git2go.v23"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func main() {
@@ -28,47 +30,131 @@ func main() {
 // default action
 //==================================================
 
-// TODO: what should this be?
+// Report where the repository stands against origin, what has changed in it,
+// and how each package is installed on this machine
 func action_default(ctx *cli.Context) {
 	repo, err := repository.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Free()
 
-	index, err := repo.Index()
+	// where the current environment stands against origin
+	branch, err := repo.CurrentBranch()
 	if err != nil {
-		log.Fatalf("could not get index: %s", err.Error())
+		fmt.Printf("environment: unknown (%s)\n", err.Error())
+	} else if ahead, behind, err := repo.CompareUpstream(branch); err != nil {
+		fmt.Printf("environment: %s (%s)\n", branch, err.Error())
+	} else {
+		up, _ := repo.UpstreamOf(branch)
+		fmt.Printf("environment: %s (%d ahead, %d behind %s)\n", branch, ahead, behind, up)
+	}
+
+	// a pull stopped on conflicts
+	if rebase, err := repo.RebaseInProgress(); err != nil {
+		log.Fatal(err)
+	} else if rebase != nil {
+		conflicts, err := repo.Conflicts()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("rebase onto %s in progress, stopped at %s with %d commit(s) left (see 'hearth rebase'):\n",
+			rebase.Upstream, rebase.StoppedAt(), len(rebase.Todo))
+		for _, p := range conflicts {
+			fmt.Printf("    %s\n", p)
+		}
+	} else if repo.Merging() {
+		conflicts, err := repo.Conflicts()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("merge in progress, %d file(s) in conflict (see 'hearth resolve'):\n", len(conflicts))
+		for _, p := range conflicts {
+			fmt.Printf("    %s\n", p)
+		}
 	}
-	defer index.Free()
 
-	diff_opts := git.DiffOptions{
-		Flags:            git.DiffNormal,
-		IgnoreSubmodules: git.SubmoduleIgnoreAll,
-		Pathspec:         []string{repo.Path},
-		ContextLines:     4,
+	if repo.Stashed() {
+		fmt.Printf("local changes stashed in %s, reapplied once the pull is done\n", repository.StashRef)
 	}
 
-	diff, err := repo.DiffIndexToWorkdir(index, &diff_opts)
+	// changes in the repo, grouped by package
+	changes, err := repo.Changes()
 	if err != nil {
-		log.Fatalf("could not diff index to workdir: %s", err.Error())
+		log.Fatal(err)
+	}
+	print_changes(changes)
+
+	// how each package is installed on this machine
+	ledger := open_state()
+	fmt.Println("\npackages:")
+	for _, name := range repo.Config.Packages.Names() {
+		pack := repo.Config.Packages[name]
+		known, installed := ledger.Get(name)
+
+		if applies, reason := pack.When.Check(); applies == false && installed == false {
+			fmt.Printf("    [ skipped ] %s (%s)\n", name, reason)
+			continue
+		}
+
+		pack.Facts = package_facts(repo)
+		pack.Facts.Unlock = nil // never ask for a passphrase just to check
+		health, links, err := pack.Check(path.Join(repo.Path, name), known.Links)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// nothing on disk to check for command based packages, trust the ledger
+		if health == pkg.HealthUnknown {
+			health = pkg.HealthMissing
+			if installed {
+				health = pkg.HealthInstalled
+			}
+		}
+
+		fmt.Printf("    [ %s ] %s\n", health, name)
+		if health == pkg.HealthPartial || health == pkg.HealthBroken || health == pkg.HealthDrifted {
+			for _, l := range links {
+				if l.State != pkg.LinkOk {
+					fmt.Printf("        %-8s  %s\n", l.State, l.Target)
+				}
+			}
+		}
+	}
+}
+
+// Print changes in the repository grouped by the package they belong to
+func print_changes(changes []repository.Change) {
+	if len(changes) == 0 {
+		fmt.Println("\nno changes")
+		return
+	}
+
+	grouped := make(map[string][]repository.Change)
+	for _, c := range changes {
+		name := repository.PackageOf(c.Path)
+		grouped[name] = append(grouped[name], c)
 	}
-	defer diff.Free()
 
-	err = diff.ForEach(func(delta git.DiffDelta, idk float64) (git.DiffForEachHunkCallback, error) {
-		// TODO: is the float percentage changed?
+	names := make([]string, 0, len(grouped))
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		// if rename
-		if delta.OldFile.Path != delta.NewFile.Path {
-			// TODO: colored output based on delta.Similarity
-			fmt.Printf("[ renamed ] %s  -->  %s\n", delta.OldFile.Path, delta.NewFile.Path)
+	fmt.Println("\nchanges:")
+	for _, name := range names {
+		if len(name) == 0 {
+			fmt.Println("    (repository)")
 		} else {
-			fmt.Printf("[ changed ] %s", delta.NewFile.Path)
+			fmt.Printf("    %s\n", name)
 		}
 
-		return nil, nil
-	}, git.DiffDetailFiles)
-	if err != nil {
-		log.Fatalf("could not iterate diffs: %s", err.Error())
+		for _, c := range grouped[name] {
+			fmt.Printf("        [ %-9s ] %-10s  %s\n", c.Kind, c.Status, c.Path)
+		}
 	}
 }
 
@@ -99,11 +185,117 @@ func action_init(ctx *cli.Context) {
 	}
 }
 
+//==================================================
+// clone action
+//==================================================
+
+// Set up this machine from an existing repository: clone it, link its config
+// into the home directory, switch to the environment asked for and install
+// every package when asked to
+func action_clone(ctx *cli.Context) {
+	if len(ctx.Args()) < 1 {
+		log.Fatalf("no repository url given")
+	} else if len(ctx.Args()) > 1 {
+		log.Fatalf("too many repository urls given")
+	}
+	url := ctx.Args()[0]
+
+	repo_path := repository.DefaultPath()
+	if ctx.IsSet("repo") {
+		repo_path = opts.RepoPath
+	}
+	repo_path, err := filepath.Abs(repo_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config_final_path := config.Path()
+	if _, err := os.Lstat(config_final_path); err == nil {
+		log.Fatalf("%s already exists, move it aside before cloning", config_final_path)
+	}
+	if _, err := os.Stat(repo_path); err == nil {
+		log.Fatalf("%s already exists", repo_path)
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		fmt.Printf("[ plan ] clone %s into %s\n", url, repo_path)
+		fmt.Printf("[ plan ] link %s to %s\n", config_final_path, path.Join(repo_path, config.Name))
+		if ctx.IsSet("repo") {
+			fmt.Printf("[ plan ] set directory to %s in %s, unless the config already has it there\n", repo_path, config.LocalPath())
+		}
+		if len(opts.CloneEnvironment) > 0 {
+			fmt.Printf("[ plan ] switch to %s\n", opts.CloneEnvironment)
+		}
+		if opts.InstallAllPackages {
+			fmt.Println("[ plan ] install every package")
+		}
+		return
+	}
+
+	repo, err := repository.Clone(repo_path, url)
+	if err != nil {
+		os.RemoveAll(repo_path)
+		log.Fatalf("could not clone repository: %s", err.Error())
+	}
+	defer repo.Free()
+
+	// the config is kept as committed, so a repo cloned elsewhere is pointed
+	// at by this machine's local overrides
+	if configured := pkg.ExpandHome(repo.Config.BaseDirectory); filepath.Clean(configured) != repo_path {
+		if err := config.SetLocal("directory", repo_path); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("the repository's config expects it in %s, %s now says %s\n", configured, config.LocalPath(), repo_path)
+	}
+
+	// symlink {REPO_DIR}/.hearthrc --> $HOME/.hearthrc
+	config_src_path := path.Join(repo.Path, config.Name)
+	if err := os.Symlink(config_src_path, config_final_path); err != nil {
+		log.Fatalf("could not link hearth config into home directory: %s", err.Error())
+	}
+
+	if len(opts.CloneEnvironment) > 0 {
+		branch, _ := find_environment(ctx, &repo, opts.CloneEnvironment)
+		defer branch.Free()
+
+		if err := repo.CheckoutBranch(branch); err != nil {
+			log.Fatalf("could not checkout branch: %s", err.Error())
+		}
+	}
+
+	// now linked, with this host's overrides
+	if err := repo.ReloadConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.InstallAllPackages == false {
+		return
+	}
+
+	run := new_batch(ctx, repo)
+	run.keep_going = true
+	for _, name := range sort_packages(repo.Config, repo.Config.Packages.Names()) {
+		run.install(name)
+	}
+
+	if failed := run.finish(); failed > 0 {
+		log.Fatalf("%d package(s) failed to install", failed)
+	}
+}
+
 //==================================================
 // env action
 //==================================================
 
+// Switch to the environment (git branch), creating it when it does not exist,
+// and bring the installed packages in line with it: packages it does not have
+// are uninstalled, new ones installed and changed ones updated
 func action_env(ctx *cli.Context) {
+	if ctx.Bool("list") {
+		list_environments(ctx)
+		return
+	}
+
 	if len(ctx.Args()) < 1 {
 		log.Fatalf("no branch name given")
 	} else if len(ctx.Args()) > 1 {
@@ -114,24 +306,216 @@ func action_env(ctx *cli.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// TODO: pull first to get new branches
+	defer repo.Free()
 
 	branch_name := ctx.Args()[0]
-	branch, err := repo.LookupBranch(branch_name, git.BranchLocal)
-	if err != nil && ctx.Bool("no-create") == false {
-		// no branch so make one
-		branch, err = repo.NewBranch(branch_name)
-		if err != nil {
+	branch, target := find_environment(ctx, &repo, branch_name)
+	if branch != nil {
+		defer branch.Free()
+	}
+
+	// what the switch does to packages, worked out before touching anything
+	old_head, err := repo.HeadCommit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer old_head.Free()
+
+	new_config, err := repo.ConfigAt(target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ledger := open_state()
+	removed := make([]string, 0)
+	for _, name := range repo.Config.Packages.Names() {
+		_, kept := new_config.Packages[name]
+		if _, installed := ledger.Get(name); kept == false && installed {
+			removed = append(removed, name)
+		}
+	}
+	removed = reverse(sort_packages(repo.Config, removed)) // dependents first
+
+	added, modified := package_changes(&repo, repo.Config, new_config, old_head.Id(), target)
+	modified = installed_only(ledger, modified)
+
+	if ctx.GlobalBool("dry-run") {
+		fmt.Printf("[ plan ] switch to %s\n", branch_name)
+		for _, name := range removed {
+			fmt.Printf("[ plan ] uninstall %s\n", name)
+		}
+		for _, name := range added {
+			fmt.Printf("[ plan ] install %s\n", name)
+		}
+		for _, name := range modified {
+			fmt.Printf("[ plan ] update %s\n", name)
+		}
+		return
+	}
+
+	// nothing is uninstalled for a switch that cannot happen
+	err = repo.CanCheckout(branch, ctx.Bool("discard"))
+	if _, dirty := err.(*repository.LocalChangesError); dirty {
+		log.Fatalf("%s\nsave them with 'hearth save' or throw them away with --discard", err.Error())
+	} else if err != nil {
+		log.Fatalf("cannot checkout branch: %s", err.Error())
+	}
+
+	if ctx.Bool("discard") {
+		if err := repo.DiscardChanges(); err != nil {
 			log.Fatal(err)
 		}
 	}
-	defer branch.Free()
+
+	// packages going away are uninstalled while their files are checked out
+	run := new_batch(ctx, repo)
+	for _, name := range removed {
+		run.uninstall(name)
+	}
 
 	err = repo.CheckoutBranch(branch)
 	if err != nil {
+		// still on the old environment, put back what was uninstalled
+		run.keep_going = true
+		for i := len(removed) - 1; i >= 0; i -= 1 {
+			run.install(removed[i])
+		}
+		run.finish()
+	}
+	if _, dirty := err.(*repository.LocalChangesError); dirty {
+		log.Fatalf("%s\nsave them with 'hearth save' or throw them away with --discard", err.Error())
+	} else if err != nil {
 		log.Fatalf("could not checkout branch: %s", err.Error())
 	}
+
+	if err := repo.ReloadConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	run = new_batch(ctx, repo)
+	run.keep_going = true
+	for _, name := range added {
+		run.install(name)
+	}
+	for _, name := range modified {
+		run.update(name)
+	}
+
+	if failed := run.finish(); failed > 0 {
+		log.Fatalf("%d package(s) failed to install or update", failed)
+	}
+}
+
+// Find the environment's branch, tracking it from origin when it is only there
+// and creating it from HEAD otherwise (unless --no-create). Gives the commit
+// the branch is at; on a dry run nothing is fetched or created and the branch
+// is nil.
+func find_environment(ctx *cli.Context, repo *repository.Repository, name string) (*git.Branch, *git.Oid) {
+	if branch, err := repo.LookupBranch(name, git.BranchLocal); err == nil {
+		return branch, branch.Target()
+	}
+
+	dry_run := ctx.GlobalBool("dry-run")
+	if dry_run == false {
+		if err := repo.FetchEnvironments(); err != nil {
+			log.Printf("WARN: could not fetch environments from origin: %s", err.Error())
+		}
+	}
+
+	envs, err := repo.Environments()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, env := range envs {
+		if env.Name != name || env.Remote == nil {
+			continue
+		}
+
+		if dry_run {
+			fmt.Printf("[ plan ] track origin/%s as %s\n", name, name)
+			return nil, env.Remote
+		}
+
+		branch, err := repo.TrackEnvironment(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("tracking origin/%s as %s\n", name, name)
+		return branch, branch.Target()
+	}
+
+	if ctx.Bool("no-create") {
+		log.Fatalf("no environment %s, locally or on origin", name)
+	}
+
+	if dry_run {
+		head, err := repo.HeadCommit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer head.Free()
+
+		fmt.Printf("[ plan ] create %s from HEAD\n", name)
+		return nil, head.Id()
+	}
+
+	branch, err := repo.NewBranch(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return branch, branch.Target()
+}
+
+// Print the local environments and those only on origin, with the commit each
+// is at and how it stands against origin
+func list_environments(ctx *cli.Context) {
+	if len(ctx.Args()) > 0 {
+		log.Fatalf("no branch name is taken with --list")
+	}
+
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	if ctx.GlobalBool("dry-run") == false {
+		if err := repo.FetchEnvironments(); err != nil {
+			log.Printf("WARN: could not fetch environments from origin, listing as last fetched: %s", err.Error())
+		}
+	}
+
+	envs, err := repo.Environments()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	width := 0
+	for _, env := range envs {
+		if len(env.Name) > width {
+			width = len(env.Name)
+		}
+	}
+
+	for _, env := range envs {
+		marker := " "
+		if env.Current {
+			marker = "*"
+		}
+
+		tip := env.Local
+		status := "up to date"
+		if env.Local == nil {
+			tip = env.Remote
+			status = "only on origin"
+		} else if env.Remote == nil {
+			status = "not on origin"
+		} else if env.Ahead > 0 || env.Behind > 0 {
+			status = fmt.Sprintf("%d ahead, %d behind", env.Ahead, env.Behind)
+		}
+
+		fmt.Printf("%s %-*s  %s  %-22s %s\n", marker, width, env.Name, tip.String()[:7], "("+status+")", env.Summary)
+	}
 }
 
 //==================================================
@@ -155,10 +539,7 @@ func action_create_package(ctx *cli.Context) {
 
 	// check the package does not already exist
 	package_name := ctx.Args()[0]
-	package_path := path.Join(repo.Path, package_name)
-	if strings.HasPrefix(package_path, "~/") {
-		package_path = path.Join(os.Getenv("HOME"), package_path[2:])
-	}
+	package_path := pkg.ExpandHome(path.Join(repo.Path, package_name))
 
 	if _, err := os.Stat(package_name); err == nil {
 
@@ -200,10 +581,17 @@ func action_create_package(ctx *cli.Context) {
 		}
 	}
 
-	// add package to config's map and write it out
+	// add package to config's map and write it out, leaving overrides out of it
 	// no state to cleanup on disk if writing config fails
-	repo.Config.Packages[package_name] = new_pkg
-	if err := repo.Config.Write(path.Join(repo.Path, config.Name)); err != nil {
+	base, err := config.OpenBase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if base.Packages == nil {
+		base.Packages = make(config.PackageMap)
+	}
+	base.Packages[package_name] = new_pkg
+	if err := base.Write(path.Join(repo.Path, config.Name)); err != nil {
 		log.Fatalf("could not write config after adding package: %s", err.Error())
 	}
 
@@ -231,20 +619,9 @@ func action_create_package(ctx *cli.Context) {
 		}
 
 		if ctx.Bool("edit") {
-			editor := os.ExpandEnv("$EDITOR")
-			if len(editor) > 0 {
-				editor_path, err := exec.LookPath(editor)
-				if err != nil {
-					log.Fatalf("could not find %s: %s", editor, err.Error())
-				}
-
-				cmd := exec.Command(editor_path, file_path)
-				cmd.Stdin = os.Stdin
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				err = cmd.Run()
-				if err != nil {
-					log.Fatalf("error while running %s: %s", editor_path, err.Error())
+			if len(os.Getenv("EDITOR")) > 0 {
+				if err := run_editor(file_path); err != nil {
+					log.Fatal(err)
 				}
 			} else {
 				log.Printf("WARN: no default editor in environment -- skipping.")
@@ -257,32 +634,55 @@ func action_create_package(ctx *cli.Context) {
 // remove action
 //==================================================
 func action_remove_package(ctx *cli.Context) {
-	conf, err := config.Open()
+	repo, err := repository.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Free()
 
 	args := ctx.Args()
 	if len(args) == 0 {
 		log.Fatalf("no package name given.")
 	}
 
+	// overrides are left out of what is written back
+	base, err := config.OpenBase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	run := new_batch(ctx, repo)
+
 	for _, p := range args {
-		if _, exists := conf.Packages[p]; exists == false {
+		if _, exists := base.Packages[p]; exists == false {
 			log.Printf("pakage %s does not exist", p)
 			continue
 		}
 
-		dir := path.Join(conf.BaseDirectory, p)
+		if ctx.Bool("uninstall") {
+			run.uninstall(p)
+		}
+
+		dir := path.Join(repo.Path, p)
+		if run.dry_run {
+			fmt.Printf("[ plan ] %s: remove %s\n", p, dir)
+			fmt.Printf("[ plan ] %s: remove from %s\n", p, config.Path())
+			continue
+		}
+
 		err = os.RemoveAll(dir)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		delete(conf.Packages, p)
+		delete(base.Packages, p)
 	}
 
-	if err := conf.Write(config.Path()); err != nil {
+	if run.dry_run {
+		return
+	}
+
+	if err := base.Write(config.Path()); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -291,7 +691,7 @@ func action_remove_package(ctx *cli.Context) {
 // modify action
 //==================================================
 func action_modify_package(ctx *cli.Context) {
-	conf, err := config.Open()
+	conf, err := config.OpenBase() // overrides are left out of what is written back
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -341,37 +741,73 @@ func action_modify_package(ctx *cli.Context) {
 }
 
 //==================================================
-// install action
+// config action
 //==================================================
-func action_install(ctx *cli.Context) {
-	args := ctx.Args()
-	if len(args) == 0 {
-		log.Fatalf("no package name given.")
+
+// Print the config in use, merged from ~/.hearthrc and the overrides on top,
+// or with --origin every value along with the layer it came from
+func action_config_show(ctx *cli.Context) {
+	conf, origins, err := config.OpenWithOrigins()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if ctx.Bool("origin") == false {
+		contents, err := yaml.Marshal(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(string(contents))
+		return
+	}
+
+	key_width, value_width := 0, 0
+	for _, o := range origins {
+		if len(o.Key) > key_width {
+			key_width = len(o.Key)
+		}
+		if len(o.Value) > value_width {
+			value_width = len(o.Value)
+		}
 	}
 
+	for _, o := range origins {
+		fmt.Printf("%-*s  %-*s  (%s)\n", key_width, o.Key, value_width, o.Value, o.Layer)
+	}
+}
+
+//==================================================
+// install action
+//==================================================
+func action_install(ctx *cli.Context) {
 	repo, err := repository.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, p := range args {
-		pack, exists := repo.GetPackage(p)
-		if exists == false {
-			log.Fatalf("cannot install unknown package: %s", p)
-		}
+	selected := select_packages(ctx, repo)
+	requested := make(map[string]bool)
+	for _, p := range selected {
+		requested[p] = true
+	}
 
-		fmt.Printf("[ install ] %s  to  ", p)
-		err := pack.Install(path.Join(repo.Path, p))
-		if err != nil {
-			log.Fatal(err) // TODO: allow skipping errors
+	run := new_batch(ctx, repo)
+	for _, p := range resolve_packages(repo, selected) {
+		// dependencies pulled in implicitly are only installed once
+		if run.installed(p) && requested[p] == false {
+			fmt.Printf("[ install ] %s  already installed\n", p)
+			continue
 		}
+
+		run.install(p)
 	}
+	run.finish()
 }
 
 //==================================================
-// update action
+// uninstall action
 //==================================================
-func action_update(ctx *cli.Context) {
+func action_uninstall(ctx *cli.Context) {
 	args := ctx.Args()
 	if len(args) == 0 {
 		log.Fatalf("no package name given.")
@@ -381,20 +817,28 @@ func action_update(ctx *cli.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Free()
 
+	run := new_batch(ctx, repo)
 	for _, p := range args {
-		pack, exists := repo.GetPackage(p)
-		if exists == false {
-			log.Fatalf("cannot update unknown package: %s", p)
-		}
+		run.uninstall(p)
+	}
+}
 
-		fmt.Printf("[ update ] %s... ", p)
-		err := pack.Update(path.Join(repo.Path, p))
-		if err != nil {
-			log.Fatal(err) // TODO: allow skipping errors
-		}
-		fmt.Printf("done!\n")
+//==================================================
+// update action
+//==================================================
+func action_update(ctx *cli.Context) {
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	run := new_batch(ctx, repo)
+	for _, p := range resolve_packages(repo, select_packages(ctx, repo)) {
+		run.update(p)
 	}
+	run.finish()
 }
 
 //==================================================
@@ -407,68 +851,310 @@ func action_pull(ctx *cli.Context) {
 	}
 	defer repo.Free()
 
-	err = repo.Pull()
+	if ctx.GlobalBool("dry-run") {
+		plan, err := repo.PlanPull()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if pull_rebase(ctx, repo) && strings.HasPrefix(plan.Merge, "merge ") {
+			plan.Merge = "rebase local commits onto " + strings.TrimPrefix(plan.Merge, "merge ")
+		}
+
+		print_repo_plan(plan)
+		fmt.Println("[ plan ] packages to install/update are only known after fetching")
+		return
+	}
+
+	added, modified := pull_changes(&repo, pull_rebase(ctx, repo), ctx.Bool("discard"))
+
+	installs := make([]string, 0)
+	updates := make([]string, 0)
+	if ctx.IsSet("install") {
+		installs = added
+	}
+	if ctx.IsSet("update") {
+		updates = modified
+	}
+
+	run := new_batch(ctx, repo)
+	for _, pkg_name := range installs {
+		run.install(pkg_name)
+	}
+	for _, pkg_name := range updates {
+		run.update(pkg_name)
+	}
+	run.finish()
+}
+
+//==================================================
+// upgrade action
+//==================================================
+func action_upgrade(ctx *cli.Context) {
+	repo, err := repository.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Free()
+
+	if ctx.GlobalBool("dry-run") {
+		plan, err := repo.PlanPull()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if pull_rebase(ctx, repo) && strings.HasPrefix(plan.Merge, "merge ") {
+			plan.Merge = "rebase local commits onto " + strings.TrimPrefix(plan.Merge, "merge ")
+		}
+
+		print_repo_plan(plan)
+		fmt.Println("[ plan ] packages to install/update are only known after fetching")
+		return
+	}
+
+	added, modified := pull_changes(&repo, pull_rebase(ctx, repo), ctx.Bool("discard"))
+	modified = installed_only(open_state(), modified) // only what this machine has
+
+	run := new_batch(ctx, repo)
+	run.keep_going = true
+	for _, name := range added {
+		run.install(name)
+	}
+	for _, name := range modified {
+		run.update(name)
+	}
 
-	// get what was changed so we can run callbacks
-	changed, err := repo.ChangedInLastCommit()
+	if len(added) == 0 && len(modified) == 0 {
+		fmt.Println("no packages changed")
+	}
+
+	if failed := run.finish(); failed > 0 {
+		log.Fatalf("%d package(s) failed to upgrade", failed)
+	}
+}
+
+//==================================================
+// resolve action
+//==================================================
+func action_resolve(ctx *cli.Context) {
+	repo, err := repository.OpenConflicted()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Free()
 
-	cache := make(map[string]bool)
+	if repo.Merging() == false && repo.Rebasing() == false {
+		log.Fatal("no merge or rebase in progress")
+	}
 
-	// iterate them
-	for _, changed_path := range changed {
-		// get the relpath of the path that was changed
-		pkg_name, err := filepath.Rel(repo.Path, changed_path)
-		if err != nil {
-			continue
-		}
+	if ctx.Bool("abort") {
+		abort_pull(&repo)
+		fmt.Println("pull aborted, the repository is back where it was before it")
+		return
+	}
 
-		// this relpath may be a file or down deep in the tree
-		// but strip it down to the package name
-		pkg_name = filepath.SplitList(pkg_name)[0]
-		pkg_name = strings.TrimRight(pkg_name, "/") // TODO: get generic separator
+	conflicts, err := repo.Conflicts()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// skip if we have run the commands for this package already
-		if _, cached := cache[pkg_name]; cached {
-			continue
-		}
-		cache[pkg_name] = true
+	if len(conflicts) > 0 {
+		err = &repository.ConflictError{Paths: conflicts}
+	} else if repo.Rebasing() {
+		err = repo.ContinueRebase()
+	} else if _, err = repo.FinishMerge(nil); err == nil {
+		fmt.Println("merge committed")
+	}
 
-		// skip this if not a package
-		pack, exists := repo.GetPackage(pkg_name)
-		if exists == false {
-			continue
+	if err := settle_conflicts(&repo, err); err != nil {
+		log.Fatal(err)
+	}
+	restore_stash(&repo)
+
+	// the pull never got to install or update anything
+	print_pulled_packages(&repo)
+}
+
+//==================================================
+// rebase actions
+//==================================================
+
+// Carry on with the rebase once its conflicts are resolved, asking about any
+// still in conflict
+func action_rebase_continue(ctx *cli.Context) {
+	action_resolve(ctx)
+}
+
+// Drop the commit the rebase stopped on and carry on with the rest
+func action_rebase_skip(ctx *cli.Context) {
+	repo, err := repository.OpenConflicted()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	if err := settle_conflicts(&repo, repo.SkipRebase()); err != nil {
+		log.Fatal(err)
+	}
+	restore_stash(&repo)
+
+	print_pulled_packages(&repo)
+}
+
+// Put the branch back to where it was before the pull
+func action_rebase_abort(ctx *cli.Context) {
+	repo, err := repository.OpenConflicted()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	if repo.Rebasing() == false {
+		log.Fatal("no rebase in progress")
+	}
+
+	abort_pull(&repo)
+	fmt.Println("rebase aborted, the repository is back where it was before the pull")
+}
+
+// Pull, then get the packages the pull added and modified in dependency order.
+// Conflicts are resolved interactively before going on.
+func pull_changes(repo *repository.Repository, rebase, discard bool) (added, modified []string) {
+	old_config := repo.Config
+
+	pull := repo.Pull
+	if rebase {
+		pull = repo.PullRebase
+	}
+
+	// local changes are stashed until the pull, conflicts and all, is done
+	stash_changes(repo, discard)
+	err := pull()
+	if _, stopped := err.(*repository.ConflictError); err != nil && stopped == false {
+		restore_stash(repo)
+		log.Fatal(err)
+	}
+
+	if err := settle_conflicts(repo, err); err != nil {
+		log.Fatal(err)
+	}
+	restore_stash(repo)
+
+	old_id, err := repo.OrigHead()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return changed_packages(repo, old_config, old_id)
+}
+
+// Truthy function on whether to rebase rather than merge, from the flags or
+// the config's default
+func pull_rebase(ctx *cli.Context, repo repository.Repository) bool {
+	if ctx.Bool("merge") {
+		return false
+	}
+	return ctx.Bool("rebase") || repo.Config.Pull.Rebase
+}
+
+// Get the packages added and modified between the old commit and HEAD, in
+// dependency order. The config is reloaded from HEAD. Packages new to the
+// config are added even if their directory is not, and a changed config entry
+// is a modification.
+func changed_packages(repo *repository.Repository, old_config config.Config, old_id *git.Oid) (added, modified []string) {
+	new_head, err := repo.HeadCommit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer new_head.Free()
+
+	if err := repo.ReloadConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	return package_changes(repo, old_config, repo.Config, old_id, new_head.Id())
+}
+
+// Get the packages of the new config added and modified between the commits
+// of the old and new config, in dependency order. Nothing needs checking out.
+func package_changes(repo *repository.Repository, old_config, new_config config.Config, old_id, new_id *git.Oid) (added, modified []string) {
+	names := new_config.Packages.Names()
+	added, modified, err := repo.PackagesChanged(old_id, new_id, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range names {
+		old_pack, existed := old_config.Packages[name]
+		if existed == false && contains(added, name) == false {
+			added = append(added, name)
+			modified = remove(modified, name)
+		} else if existed && contains(added, name) == false && contains(modified, name) == false &&
+			reflect.DeepEqual(old_pack, new_config.Packages[name]) == false {
+			modified = append(modified, name)
 		}
+	}
 
-		// take either install or update action based on the created or
-		// modified status of the package in the commit
-		if repo.CreatedInLast(changed_path) && ctx.IsSet("install") {
-			err := pack.Install(path.Join(repo.Path, pkg_name))
-			if err != nil {
-				// TODO: give arg to not fatal on error
-				log.Fatal(err)
-			}
-		} else if ctx.IsSet("upgrade") {
-			err := pack.Update(path.Join(repo.Path, pkg_name))
-			if err != nil {
-				// TODO: give arg to not fatal on error
-				log.Fatal(err)
+	// the config's vars (with this host's) go into every template rendered
+	if reflect.DeepEqual(old_config.Vars, new_config.Vars) == false {
+		for _, name := range open_state().Rendered() {
+			_, existed := old_config.Packages[name]
+			_, exists := new_config.Packages[name]
+			if existed && exists && contains(added, name) == false && contains(modified, name) == false {
+				modified = append(modified, name)
 			}
 		}
 	}
 
+	added, err = new_config.Packages.Sort(added)
+	if err != nil {
+		log.Fatal(err)
+	}
+	modified, err = new_config.Packages.Sort(modified)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return
 }
 
-//==================================================
-// upgrade action
-//==================================================
-func action_upgrade(ctx *cli.Context) {
-	panic("upgrade command not currently supported. Will be included after PR: https://github.com/codegangsta/cli/pull/234")
+// Truthy function on whether the list holds the string
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the list in reverse order
+func reverse(list []string) []string {
+	reversed := make([]string, len(list))
+	for i, item := range list {
+		reversed[len(list)-1-i] = item
+	}
+	return reversed
+}
+
+// Put the packages in the order the config installs them in
+func sort_packages(conf config.Config, names []string) []string {
+	sorted, err := conf.Packages.Sort(names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sorted
+}
+
+// Get the list without any occurrence of the string
+func remove(list []string, s string) []string {
+	kept := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
 }
 
 //==================================================
@@ -481,7 +1167,30 @@ func action_save(ctx *cli.Context) {
 	}
 	defer repo.Free()
 
+	branch, err := repo.CurrentBranch()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	msg := ctx.String("message")
+	if ctx.GlobalBool("dry-run") {
+		plan, err := repo.PlanCommitAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+		print_repo_plan(plan)
+		fmt.Printf("[ plan ] commit \"%s\"\n", msg)
+
+		if ctx.IsSet("no-push") == false {
+			plan, err = repo.PlanPush(branch)
+			if err != nil {
+				log.Fatal(err)
+			}
+			print_repo_plan(plan)
+		}
+		return
+	}
+
 	c, err := repo.CommitAll(msg)
 	if err != nil {
 		log.Fatal(err)
@@ -489,16 +1198,219 @@ func action_save(ctx *cli.Context) {
 	defer c.Free()
 
 	if ctx.IsSet("no-push") == false {
-		err = repo.Push("master") // TODO: not only master
+		err = repo.Push(branch)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
+//==================================================
+// sync action
+//==================================================
+func action_sync(ctx *cli.Context) {
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	if ctx.GlobalBool("dry-run") {
+		branches, err := repo.LocalBranches()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, b := range branches {
+			up, err := repo.UpstreamOf(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("[ plan ] sync %s with %s\n", b, up)
+		}
+		return
+	}
+
+	// the current environment may be pulled into
+	stash_changes(&repo, ctx.Bool("discard"))
+	results, err := repo.SyncAll(ctx.Bool("no-push") == false)
+	restore_stash(&repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// not knowing the default only loses the marker
+	default_branch, _ := repo.DefaultBranch()
+
+	failed := 0
+	for _, res := range results {
+		name := res.Branch
+		if name == default_branch {
+			name += " (default)"
+		}
+
+		if res.Err != nil {
+			failed += 1
+			fmt.Printf("[ failed ] %s: %s\n", name, res.Err.Error())
+		} else {
+			fmt.Printf("[ ok ] %s: %s\n", name, res.Action)
+		}
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d environment(s) failed to sync", failed)
+	}
+}
+
 //==================================================
 // tag action
 //==================================================
 func action_tag(ctx *cli.Context) {
-	panic("tag command not implemented")
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	if ctx.Bool("list") {
+		tags, err := repo.ListTags()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, t := range tags {
+			fmt.Printf("%-20s %s  %s  %s\n", t.Name, t.Commit.String()[:7], t.When.Format("2006-01-02 15:04"), t.Message)
+		}
+		return
+	}
+
+	if len(ctx.Args()) != 1 {
+		log.Fatal("expected exactly one tag name")
+	}
+
+	name := ctx.Args()[0]
+	msg := ctx.String("message")
+	if len(msg) == 0 {
+		msg = name
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		head, err := repo.HeadCommit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer head.Free()
+
+		fmt.Printf("[ plan ] tag %s at %s \"%s\"\n", name, head.Id().String()[:7], msg)
+		return
+	}
+
+	if _, err := repo.CreateTag(name, msg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//==================================================
+// rollback action
+//==================================================
+func action_rollback(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		log.Fatal("expected exactly one tag or commit to roll back to")
+	}
+	spec := ctx.Args()[0]
+
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	old_config := repo.Config
+	old_head, err := repo.HeadCommit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer old_head.Free()
+
+	snapshot, err := repo.ResolveCommit(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer snapshot.Free()
+
+	new_config, err := repo.ConfigAt(snapshot.Id())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// installed packages the snapshot does not have are uninstalled
+	ledger := open_state()
+	removed := make([]string, 0)
+	for _, name := range repo.Config.Packages.Names() {
+		_, kept := new_config.Packages[name]
+		if _, installed := ledger.Get(name); kept == false && installed {
+			removed = append(removed, name)
+		}
+	}
+	removed = reverse(sort_packages(repo.Config, removed)) // dependents first
+
+	// nothing is uninstalled for a rollback that cannot happen
+	if err := repo.CanRollback(spec); err != nil {
+		log.Fatal(err)
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		added, modified := package_changes(&repo, repo.Config, new_config, old_head.Id(), snapshot.Id())
+
+		fmt.Printf("[ plan ] commit restoring the files of %s (%s)\n", spec, snapshot.Id().String()[:7])
+		for _, name := range removed {
+			fmt.Printf("[ plan ] uninstall %s\n", name)
+		}
+		for _, name := range added {
+			fmt.Printf("[ plan ] install %s\n", name)
+		}
+		for _, name := range installed_only(ledger, modified) {
+			fmt.Printf("[ plan ] update %s\n", name)
+		}
+		return
+	}
+
+	// while their files are still checked out
+	run := new_batch(ctx, repo)
+	for _, name := range removed {
+		run.uninstall(name)
+	}
+
+	commit, err := repo.Rollback(spec)
+	if err != nil {
+		// nothing rolled back, put back what was uninstalled
+		run.keep_going = true
+		for i := len(removed) - 1; i >= 0; i -= 1 {
+			run.install(removed[i])
+		}
+		run.finish()
+		log.Fatal(err)
+	}
+	defer commit.Free()
+
+	// new packages are installed, installed ones whose files differ updated
+	added, modified := changed_packages(&repo, old_config, old_head.Id())
+	modified = installed_only(ledger, modified)
+
+	run = new_batch(ctx, repo)
+	run.keep_going = true
+	for _, name := range added {
+		run.install(name)
+	}
+	for _, name := range modified {
+		run.update(name)
+	}
+
+	if len(added) == 0 && len(modified) == 0 && len(removed) == 0 {
+		fmt.Println("no packages changed")
+	}
+
+	if failed := run.finish(); failed > 0 {
+		log.Fatalf("%d package(s) failed to install or update", failed)
+	}
 }
@@ -20,9 +20,18 @@ type Options struct {
 	// working environment
 	RepoPath   string
 	RepoOrigin string
+	DryRun     bool
+
+	// clone options
+	CloneEnvironment   string
+	InstallAllPackages bool
 
 	// env/branch vars
-	BranchNoCreate bool
+	BranchNoCreate   bool
+	ListEnvironments bool
+
+	// local changes
+	DiscardChanges bool
 
 	// package creation
 	StartWithEditor        bool
@@ -33,6 +42,9 @@ type Options struct {
 	InitPackageInstallCmd  string
 	InitPackageInstallPost string
 
+	// package removal
+	UninstallOnRemove bool
+
 	// package selection
 	AllPackages     bool
 	AllEnvironments bool
@@ -40,13 +52,25 @@ type Options struct {
 	PackageList     []string
 	PackageRegex    string
 
+	// config options
+	ShowOrigins bool
+
+	// install options
+	ConflictPolicy string
+
 	// pull actions
 	InstallNewPackages bool
 	UpdateAfterPull    bool
+	RebaseOnPull       bool
+	MergeOnPull        bool
 
 	// save options
 	SkipPush      bool
 	CommitMessage string
+
+	// tag options
+	ListTags   bool
+	TagMessage string
 }
 
 var opts Options
@@ -64,7 +88,25 @@ func init_flags() *cli.App {
 		{Name: "Zach Marcantel", Email: "zmarcantel@gmail.com"},
 	}
 
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "print what would be done without touching the filesystem or the repository",
+			Destination: &opts.DryRun,
+		},
+	}
+
 	app.Commands = []cli.Command{
+		//==================================================
+		// status
+		//==================================================
+		{
+			Name:        "status",
+			Usage:       "show changes in the repository and the install state of every package (default)",
+			Description: "show changes in the repository and the install state of every package (default)",
+			Action:      action_default,
+		},
+
 		//==================================================
 		// init
 		//==================================================
@@ -89,6 +131,40 @@ func init_flags() *cli.App {
 			Action: action_init,
 		},
 
+		//==================================================
+		// clone
+		//==================================================
+		{
+			Name:        "clone",
+			Usage:       "set up this machine from an existing hearth repository",
+			Description: "clone an existing hearth repository, keeping its config as committed, link the config into the home directory, and optionally switch environment and install every package",
+			ArgsUsage:   "url",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "r, repo",
+					Usage:       "use a directory other than $HOME/.hearth to contain the repo, noted in ~/.hearthrc.local when the config expects it elsewhere",
+					Value:       path.Join(os.Getenv("HOME"), ".hearth"),
+					Destination: &opts.RepoPath,
+				},
+				cli.StringFlag{
+					Name:        "e, env",
+					Usage:       "switch to the given environment (git branch) after cloning",
+					Destination: &opts.CloneEnvironment,
+				},
+				cli.BoolFlag{
+					Name:        "install-all",
+					Usage:       "install every package in the config, dependencies first",
+					Destination: &opts.InstallAllPackages,
+				},
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do when a link target exists: fail, skip, backup, overwrite or adopt (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
+			},
+			Action: action_clone,
+		},
+
 		//==================================================
 		// create
 		//==================================================
@@ -148,8 +224,14 @@ func init_flags() *cli.App {
 			Usage:       "remove a package",
 			Description: "remove a package",
 			ArgsUsage:   "package [package...]",
-			Flags:       []cli.Flag{},
 			Action:      action_remove_package,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "u, uninstall",
+					Usage:       "uninstall the package before removing it from the repository",
+					Destination: &opts.UninstallOnRemove,
+				},
+			},
 		},
 
 		//==================================================
@@ -185,20 +267,53 @@ func init_flags() *cli.App {
 			},
 		},
 
+		//==================================================
+		// config
+		//==================================================
+		{
+			Name:        "config",
+			Usage:       "inspect the config in use",
+			Description: "inspect the config in use: the repo's .hearthrc, with hosts/<hostname>.yml and ~/.hearthrc.local merged on top",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "print the merged config",
+					Action: action_config_show,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:        "origin",
+							Usage:       "print every value with the layer it came from",
+							Destination: &opts.ShowOrigins,
+						},
+					},
+				},
+			},
+		},
+
 		//==================================================
 		// env
 		//==================================================
 		{
 			Name:        "env",
 			Usage:       "change the dotfile environment (git branch) and create if it does not exist",
-			Description: "change the dotfile environment (git branch) and create if it does not exist",
+			Description: "change the dotfile environment (git branch), tracking it from origin or creating it if it does not exist locally, then uninstall packages it does not have, install new ones and update changed ones",
 			ArgsUsage:   "branch_name",
 			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "l, list",
+					Usage:       "list local and origin's environments with where they stand against origin",
+					Destination: &opts.ListEnvironments,
+				},
 				cli.BoolFlag{
 					Name:        "n, no-create",
 					Usage:       "do not create the branch if it does not exist",
 					Destination: &opts.BranchNoCreate,
 				},
+				cli.BoolFlag{
+					Name:        "discard",
+					Usage:       "throw away uncommitted changes instead of stashing and reapplying them",
+					Destination: &opts.DiscardChanges,
+				},
 			},
 			Action: action_env,
 		},
@@ -210,7 +325,7 @@ func init_flags() *cli.App {
 			Name:        "install",
 			Usage:       "install one or many packages",
 			Description: "install one or many packages",
-			ArgsUsage:   "package [package...]",
+			ArgsUsage:   "[package...]",
 			Action:      action_install,
 			Flags: []cli.Flag{
 				cli.BoolFlag{
@@ -233,9 +348,25 @@ func init_flags() *cli.App {
 					Usage:       "regular expression (go syntax) for packages to install",
 					Destination: &opts.PackageRegex,
 				},
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do when a link target exists: fail, skip, backup, overwrite or adopt (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
 			},
 		},
 
+		//==================================================
+		// uninstall
+		//==================================================
+		{
+			Name:        "uninstall",
+			Usage:       "uninstall one or many packages",
+			Description: "remove links created by install (or run uninstall commands) for one or many packages",
+			ArgsUsage:   "package [package...]",
+			Action:      action_uninstall,
+		},
+
 		//==================================================
 		// update
 		//==================================================
@@ -243,7 +374,7 @@ func init_flags() *cli.App {
 			Name:        "update",
 			Usage:       "update one or many packages",
 			Description: "update one or many packages",
-			ArgsUsage:   "package [package...]",
+			ArgsUsage:   "[package...]",
 			Action:      action_update,
 			Flags: []cli.Flag{
 				cli.BoolFlag{
@@ -266,6 +397,11 @@ func init_flags() *cli.App {
 					Usage:       "regular expression (go syntax) for packages to update",
 					Destination: &opts.PackageRegex,
 				},
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do with a written file edited at its target: fail, skip, backup or overwrite (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
 			},
 		},
 
@@ -288,6 +424,26 @@ func init_flags() *cli.App {
 					Usage:       "update all packages after pulling",
 					Destination: &opts.UpdateAfterPull,
 				},
+				cli.BoolFlag{
+					Name:        "rebase",
+					Usage:       "rebase local commits onto 'origin' instead of merging (default from pull.rebase in the config)",
+					Destination: &opts.RebaseOnPull,
+				},
+				cli.BoolFlag{
+					Name:        "merge",
+					Usage:       "merge even when the config asks to rebase",
+					Destination: &opts.MergeOnPull,
+				},
+				cli.BoolFlag{
+					Name:        "discard",
+					Usage:       "throw away uncommitted changes instead of stashing and reapplying them",
+					Destination: &opts.DiscardChanges,
+				},
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do when a link target exists: fail, skip, backup, overwrite or adopt (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
 			},
 		},
 
@@ -296,9 +452,73 @@ func init_flags() *cli.App {
 		//==================================================
 		{
 			Name:        "upgrade",
-			Usage:       "alias of 'pull --install --update'",
-			Description: "alias of 'pull --install --update'",
+			Usage:       "pull, install new packages and update changed ones",
+			Description: "pull from 'origin', install packages added by the pull and update the installed packages it modified",
 			Action:      action_upgrade,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "rebase",
+					Usage:       "rebase local commits onto 'origin' instead of merging (default from pull.rebase in the config)",
+					Destination: &opts.RebaseOnPull,
+				},
+				cli.BoolFlag{
+					Name:        "merge",
+					Usage:       "merge even when the config asks to rebase",
+					Destination: &opts.MergeOnPull,
+				},
+				cli.BoolFlag{
+					Name:        "discard",
+					Usage:       "throw away uncommitted changes instead of stashing and reapplying them",
+					Destination: &opts.DiscardChanges,
+				},
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do when a link target exists: fail, skip, backup, overwrite or adopt (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
+			},
+		},
+
+		//==================================================
+		// resolve
+		//==================================================
+		{
+			Name:        "resolve",
+			Usage:       "resolve the conflicts of a pull that stopped part way",
+			Description: "pick ours, theirs or edit for each file still in conflict, then commit the merge",
+			Action:      action_resolve,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "abort",
+					Usage: "undo the merge, going back to where things were before the pull",
+				},
+			},
+		},
+
+		//==================================================
+		// rebase
+		//==================================================
+		{
+			Name:        "rebase",
+			Usage:       "carry on with a pull --rebase that stopped on conflicts",
+			Description: "continue, skip the commit stopped on, or abort a pull --rebase that stopped on conflicts",
+			Subcommands: []cli.Command{
+				{
+					Name:   "continue",
+					Usage:  "resolve what is left in conflict and replay the remaining commits",
+					Action: action_rebase_continue,
+				},
+				{
+					Name:   "skip",
+					Usage:  "drop the commit stopped on and replay the remaining commits",
+					Action: action_rebase_skip,
+				},
+				{
+					Name:   "abort",
+					Usage:  "go back to where things were before the pull",
+					Action: action_rebase_abort,
+				},
+			},
 		},
 
 		//==================================================
@@ -323,14 +543,95 @@ func init_flags() *cli.App {
 			},
 		},
 
+		//==================================================
+		// secret
+		//==================================================
+		{
+			Name:        "secret",
+			Usage:       "manage secrets, committed sealed and decrypted on install",
+			Description: "manage secrets: files ending in .secret are sealed with the key in ~/.hearth.key (or a passphrase, with secrets.passphrase in the config) and decrypted to their target, readable only by you, on install",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "seal files into <file>.secret and remove the plaintext",
+					ArgsUsage: "file [file...]",
+					Action:    action_secret_add,
+				},
+				{
+					Name:      "edit",
+					Usage:     "decrypt a secret, open it in $EDITOR and seal it again",
+					ArgsUsage: "file.secret",
+					Action:    action_secret_edit,
+				},
+				{
+					Name:   "rekey",
+					Usage:  "reseal every secret with a new key or passphrase",
+					Action: action_secret_rekey,
+				},
+			},
+		},
+
+		//==================================================
+		// sync
+		//==================================================
+		{
+			Name:        "sync",
+			Usage:       "pull and push every environment",
+			Description: "fetch every environment (git branch), fast-forward the ones behind 'origin' and push the ones ahead",
+			Action:      action_sync,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "no-push",
+					Usage:       "skip pushing to 'origin'",
+					Destination: &opts.SkipPush,
+				},
+				cli.BoolFlag{
+					Name:        "discard",
+					Usage:       "throw away uncommitted changes instead of stashing and reapplying them",
+					Destination: &opts.DiscardChanges,
+				},
+			},
+		},
+
 		//==================================================
 		// tag
 		//==================================================
 		{
 			Name:        "tag",
 			Usage:       "create a tag at the most recent commit",
-			Description: "create a tag at the most recent commit",
+			Description: "create an annotated tag at the most recent commit, pushed to 'origin' by save",
+			ArgsUsage:   "tag_name",
 			Action:      action_tag,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "l, list",
+					Usage:       "list tags with their dates and messages",
+					Destination: &opts.ListTags,
+				},
+				cli.StringFlag{
+					Name:        "m, message",
+					Usage:       "use the given message (defaults to the tag name)",
+					Destination: &opts.TagMessage,
+				},
+			},
+		},
+
+		//==================================================
+		// rollback
+		//==================================================
+		{
+			Name:        "rollback",
+			Usage:       "return the repository to a tag or commit and update what changed",
+			Description: "commit the files of a tag or commit on top of HEAD, uninstalling packages it does not have, installing new ones and updating installed ones that changed",
+			ArgsUsage:   "tag|commit",
+			Action:      action_rollback,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "conflict",
+					Usage:       "what to do when a link target exists: fail, skip, backup, overwrite or adopt (overrides the package)",
+					Destination: &opts.ConflictPolicy,
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/zmarcantel/hearth/repository"
+	"github.com/zmarcantel/hearth/repository/pkg"
+	"github.com/zmarcantel/hearth/secret"
+	"github.com/zmarcantel/hearth/state"
+
+	"github.com/codegangsta/cli"
+)
+
+//==================================================
+// install state helpers
+//==================================================
+
+// Open the install ledger or die trying
+func open_state() *state.State {
+	ledger, err := state.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ledger
+}
+
+// Persist the install ledger or die trying
+func write_state(ledger *state.State) {
+	if err := ledger.Write(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Get the packages of the list the ledger knows to be installed on this machine
+func installed_only(ledger *state.State, names []string) []string {
+	installed := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, exists := ledger.Get(name); exists {
+			installed = append(installed, name)
+		}
+	}
+	return installed
+}
+
+// Get the id of the commit at HEAD for recording in the ledger.
+// Empty if the repo has no commits yet.
+func head_id(repo repository.Repository) string {
+	commit, err := repo.HeadCommit()
+	if err != nil {
+		return ""
+	}
+	defer commit.Free()
+
+	return commit.Id().String()
+}
+
+// Get what templates are rendered and secrets decrypted with, besides the
+// package's own vars
+func package_facts(repo repository.Repository) pkg.Facts {
+	branch, _ := repo.CurrentBranch() // none while detached
+	return pkg.Facts{
+		Environment: branch,
+		Vars:        repo.Config.Vars,
+		Unlock: func() (secret.Key, error) {
+			return secret_key(repo.Config, false)
+		},
+	}
+}
+
+//==================================================
+// package selection
+//==================================================
+
+// Resolve the packages named on the command line along with --all and --filter
+func select_packages(ctx *cli.Context, repo repository.Repository) []string {
+	if ctx.Bool("environments") || ctx.Bool("apps") {
+		log.Fatalf("--environments and --apps are not supported yet")
+	}
+
+	selected, err := repo.Config.Packages.Select(ctx.Args(), ctx.Bool("all"), ctx.String("filter"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return selected
+}
+
+// Add the transitive dependencies of the selected packages and put everything
+// in the order it must be installed/updated in
+func resolve_packages(repo repository.Repository, selected []string) []string {
+	order, err := repo.Config.Packages.Resolve(selected)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return order
+}
+
+//==================================================
+// package batches
+//==================================================
+
+// What happened to a single package in a batch
+type outcome struct {
+	name   string
+	action string
+	err    error
+}
+
+// Installs, updates and uninstalls packages for a single invocation. Keeps the
+// install ledger up to date and collects conflicts for a summary at the end.
+// On a dry run nothing is touched and the plan for each package is printed.
+// Unless keep_going is set, the first package to fail stops everything.
+type batch struct {
+	repo       repository.Repository
+	ledger     *state.State
+	commit     string
+	backup_dir string
+	conflict   pkg.Conflict
+	dry_run    bool
+	keep_going bool
+	conflicts  []pkg.Resolution
+	outcomes   []outcome
+}
+
+func new_batch(ctx *cli.Context, repo repository.Repository) *batch {
+	b := &batch{
+		repo:       repo,
+		ledger:     open_state(),
+		commit:     head_id(repo),
+		backup_dir: state.BackupDir(time.Now()),
+		dry_run:    ctx.GlobalBool("dry-run"),
+		conflicts:  make([]pkg.Resolution, 0),
+		outcomes:   make([]outcome, 0),
+	}
+
+	// --conflict overrides the policy of every package
+	if policy := ctx.String("conflict"); len(policy) > 0 {
+		c, err := pkg.ParseConflict(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b.conflict = c
+	}
+
+	return b
+}
+
+// Get a package ready to run along with its directory in the repo
+func (b *batch) get(name string) (pkg.Info, string) {
+	pack, exists := b.repo.GetPackage(name)
+	if exists == false {
+		log.Fatalf("unknown package: %s", name)
+	}
+
+	if len(b.conflict) > 0 {
+		pack.Conflict = b.conflict
+	}
+	pack.BackupDir = b.backup_dir
+	pack.DryRun = b.dry_run
+	pack.Facts = package_facts(b.repo)
+	if known, exists := b.ledger.Get(name); exists {
+		pack.Recorded = known.Links
+	}
+
+	return pack, path.Join(b.repo.Path, name)
+}
+
+// Note what happened to a package, stopping everything on failure unless keep_going
+func (b *batch) done(name, action string, err error) {
+	b.outcomes = append(b.outcomes, outcome{name, action, err})
+	if err != nil && b.keep_going == false {
+		b.finish()
+		log.Fatal(err)
+	}
+}
+
+// Truthy function on whether the ledger knows the package is installed
+func (b *batch) installed(name string) bool {
+	_, exists := b.ledger.Get(name)
+	return exists
+}
+
+// Truthy function on whether the package applies to this machine. Packages
+// that do not are reported as skipped with the reason.
+func (b *batch) applies(name string, pack pkg.Info) bool {
+	ok, reason := pack.When.Check()
+	if ok {
+		return true
+	}
+
+	if b.dry_run {
+		fmt.Printf("[ plan ] %s: skip (%s)\n", name, reason)
+	} else {
+		fmt.Printf("[ skip ] %s: %s\n", name, reason)
+	}
+	b.done(name, "skipped, "+reason, nil)
+	return false
+}
+
+func (b *batch) install(name string) {
+	pack, dir := b.get(name)
+	if b.applies(name, pack) == false {
+		return
+	}
+
+	fmt.Printf("[ install ] %s  to  ", name)
+	rec, err := pack.Install(dir)
+	b.conflicts = append(b.conflicts, rec.Conflicts...)
+
+	if b.dry_run {
+		print_plan(name, "link", rec)
+	} else {
+		b.ledger.Installed(name, b.commit, rec)
+		write_state(b.ledger)
+	}
+
+	b.done(name, "installed", err)
+}
+
+func (b *batch) update(name string) {
+	pack, dir := b.get(name)
+	if b.applies(name, pack) == false {
+		return
+	}
+
+	fmt.Printf("[ update ] %s... ", name)
+	rec, err := pack.Update(dir)
+	b.conflicts = append(b.conflicts, rec.Conflicts...)
+
+	if b.dry_run {
+		fmt.Println()
+		print_plan(name, "link", rec)
+	} else {
+		b.ledger.Updated(name, b.commit, rec)
+		write_state(b.ledger)
+	}
+
+	if err == nil && b.dry_run == false {
+		fmt.Printf("done!\n")
+		print_synced(name, rec)
+	} else if err != nil {
+		fmt.Println()
+	}
+	b.done(name, "updated", err)
+}
+
+// Uninstall a package, removing links recorded in the ledger as well as those
+// the package currently defines, then forget the package in the ledger
+func (b *batch) uninstall(name string) {
+	pack, dir := b.get(name)
+
+	fmt.Printf("[ uninstall ] %s\n", name)
+	rec, err := pack.Uninstall(dir)
+	if err != nil {
+		log.Fatal(err) // TODO: allow skipping errors
+	}
+
+	if known, exists := b.ledger.Get(name); exists {
+		if err := pack.Unlink(dir, known.Links, &rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if b.dry_run {
+		print_plan(name, "unlink", rec)
+		return
+	}
+
+	b.ledger.Uninstalled(name)
+	write_state(b.ledger)
+}
+
+// Summarise how every conflicting link target was handled and, when keeping
+// going past failures, what happened to every package. Returns the number of
+// packages that failed.
+func (b *batch) finish() int {
+	if b.dry_run {
+		return 0
+	}
+
+	for _, c := range b.conflicts {
+		switch c.Policy {
+		case pkg.ConflictSkip:
+			fmt.Printf("[ conflict ] %s  skipped\n", c.Target)
+		case pkg.ConflictBackup:
+			fmt.Printf("[ conflict ] %s  backed up to %s\n", c.Target, c.Backup)
+		case pkg.ConflictOverwrite:
+			fmt.Printf("[ conflict ] %s  overwritten\n", c.Target)
+		case pkg.ConflictAdopt:
+			fmt.Printf("[ conflict ] %s  adopted into package\n", c.Target)
+		}
+	}
+
+	failed := 0
+	for _, o := range b.outcomes {
+		if o.err != nil {
+			failed += 1
+		}
+	}
+
+	if b.keep_going == false {
+		return failed
+	}
+
+	for _, o := range b.outcomes {
+		if o.err != nil {
+			fmt.Printf("[ failed ] %s: %s\n", o.name, o.err.Error())
+		} else {
+			fmt.Printf("[ %s ] %s\n", o.action, o.name)
+		}
+	}
+
+	return failed
+}
+
+//==================================================
+// dry run output
+//==================================================
+
+// Print what a dry run of a package would do. Links are described with the
+// given verb (link or unlink).
+func print_plan(name, link_verb string, rec pkg.Record) {
+	for _, c := range rec.Conflicts {
+		switch c.Policy {
+		case pkg.ConflictSkip:
+			fmt.Printf("[ plan ] %s: skip %s (already exists)\n", name, c.Target)
+		case pkg.ConflictBackup:
+			fmt.Printf("[ plan ] %s: replace %s (back up to %s)\n", name, c.Target, c.Backup)
+		default:
+			fmt.Printf("[ plan ] %s: replace %s (%s)\n", name, c.Target, c.Policy)
+		}
+	}
+
+	for _, d := range rec.Unfolded {
+		fmt.Printf("[ plan ] %s: unfold %s to share it\n", name, d)
+	}
+
+	for _, l := range rec.Links {
+		switch {
+		case l.Mode == pkg.ModeTemplate && link_verb == "unlink":
+			fmt.Printf("[ plan ] %s: remove rendered %s\n", name, l.Target)
+		case l.Mode == pkg.ModeTemplate:
+			fmt.Printf("[ plan ] %s: render %s -> %s\n", name, l.Source, l.Target)
+		case l.Mode == pkg.ModeSecret && link_verb == "unlink":
+			fmt.Printf("[ plan ] %s: remove decrypted %s\n", name, l.Target)
+		case l.Mode == pkg.ModeSecret:
+			fmt.Printf("[ plan ] %s: decrypt %s -> %s\n", name, l.Source, l.Target)
+		case (l.Mode == pkg.ModeCopy || l.Mode == pkg.ModeHardlink) && link_verb == "unlink":
+			fmt.Printf("[ plan ] %s: remove %s %s\n", name, l.Mode, l.Target)
+		case l.Mode == pkg.ModeCopy || l.Mode == pkg.ModeHardlink:
+			fmt.Printf("[ plan ] %s: %s %s -> %s\n", name, l.Mode, l.Source, l.Target)
+		default:
+			fmt.Printf("[ plan ] %s: %s %s -> %s\n", name, link_verb, l.Target, l.Source)
+		}
+	}
+
+	for _, l := range rec.CopiedBack {
+		fmt.Printf("[ plan ] %s: copy back %s -> %s\n", name, l.Target, l.Source)
+	}
+	for _, l := range rec.Diverged {
+		fmt.Printf("[ plan ] %s: leave %s (changed in the package and at the target)\n", name, l.Target)
+	}
+
+	for _, c := range rec.Commands {
+		fmt.Printf("[ plan ] %s: run `%s` in %s", name, c.Cmd, c.Dir)
+		if len(c.File) > 0 {
+			fmt.Printf(" (HEARTH_FILE=%s)", c.File)
+		}
+		fmt.Println()
+	}
+}
+
+// Print the copies an update brought back into the package, and warn about
+// those left alone as both sides changed
+func print_synced(name string, rec pkg.Record) {
+	for _, l := range rec.CopiedBack {
+		fmt.Printf("    copied %s back into the package (see 'hearth save')\n", l.Target)
+	}
+
+	for _, l := range rec.Diverged {
+		log.Printf("WARN: %s: %s and %s both changed, make them the same then run 'hearth update %s'", name, l.Source, l.Target, name)
+	}
+}
+
+// Print what a dry run of a repository operation would do
+func print_repo_plan(plan repository.Plan) {
+	for _, p := range plan.Stage {
+		fmt.Printf("[ plan ] stage %s\n", p)
+	}
+
+	for _, ref := range plan.Fetch {
+		fmt.Printf("[ plan ] fetch %s from %s\n", ref, plan.Remote)
+	}
+
+	if len(plan.Merge) > 0 {
+		fmt.Printf("[ plan ] %s\n", plan.Merge)
+	}
+
+	for _, ref := range plan.Push {
+		fmt.Printf("[ plan ] push %s to %s\n", ref, plan.Remote)
+	}
+}
@@ -0,0 +1,427 @@
+package repository
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+//==================================================
+// Branches (environments) and their upstreams
+//==================================================
+
+// Where a local branch is pulled from and pushed to
+type Upstream struct {
+	Remote string // name of the remote, e.g. origin
+	Merge  string // full ref of the branch on the remote, e.g. refs/heads/master
+}
+
+// Get the ref the upstream's branch is fetched into
+func (u Upstream) TrackingRef() string {
+	return path.Join("refs/remotes", u.Remote, strings.TrimPrefix(u.Merge, "refs/heads/"))
+}
+
+// Get the refspec fetching the upstream's branch into its tracking ref
+func (u Upstream) FetchRefspec() string {
+	return fmt.Sprintf("+%s:%s", u.Merge, u.TrackingRef())
+}
+
+// Short name of the upstream, as in origin/master
+func (u Upstream) String() string {
+	return strings.TrimPrefix(u.TrackingRef(), "refs/remotes/")
+}
+
+// Get the configured upstream of the local branch. Branches without one
+// (e.g. an environment that was never pushed) use the branch of the same name
+// on origin.
+func (r Repository) UpstreamOf(branch string) (Upstream, error) {
+	up := Upstream{Remote: "origin", Merge: path.Join("refs/heads", branch)}
+
+	cfg, err := r.Repository.Config()
+	if err != nil {
+		return up, fmt.Errorf("could not read git config: %s", err.Error())
+	}
+	defer cfg.Free()
+
+	if remote, err := cfg.LookupString(fmt.Sprintf("branch.%s.remote", branch)); err == nil && len(remote) > 0 {
+		up.Remote = remote
+	}
+	if merge, err := cfg.LookupString(fmt.Sprintf("branch.%s.merge", branch)); err == nil && len(merge) > 0 {
+		up.Merge = merge
+	}
+
+	return up, nil
+}
+
+// Record the remote and branch the local branch pulls from and pushes to
+func (r Repository) SetUpstream(branch string, up Upstream) error {
+	cfg, err := r.Repository.Config()
+	if err != nil {
+		return fmt.Errorf("could not read git config: %s", err.Error())
+	}
+	defer cfg.Free()
+
+	if err := cfg.SetString(fmt.Sprintf("branch.%s.remote", branch), up.Remote); err != nil {
+		return fmt.Errorf("could not set upstream of %s: %s", branch, err.Error())
+	}
+	if err := cfg.SetString(fmt.Sprintf("branch.%s.merge", branch), up.Merge); err != nil {
+		return fmt.Errorf("could not set upstream of %s: %s", branch, err.Error())
+	}
+
+	return nil
+}
+
+// Get the name of every local branch, sorted
+func (r Repository) LocalBranches() ([]string, error) {
+	iter, err := r.NewBranchIterator(git.BranchLocal)
+	if err != nil {
+		return nil, fmt.Errorf("could not list branches: %s", err.Error())
+	}
+	defer iter.Free()
+
+	names := make([]string, 0)
+	err = iter.ForEach(func(b *git.Branch, t git.BranchType) error {
+		name, err := b.Name()
+		if err != nil {
+			return err
+		}
+
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list branches: %s", err.Error())
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Fetch every branch on origin, so environments created on other machines can
+// be listed and checked out
+func (r Repository) FetchEnvironments() error {
+	return r.fetch("origin", []string{"+refs/heads/*:refs/remotes/origin/*"})
+}
+
+// A branch (environment), local or only on origin
+type Environment struct {
+	Name    string
+	Current bool
+	Local   *git.Oid // tip of the local branch, nil when only on origin
+	Remote  *git.Oid // tip of its upstream as last fetched, nil when never pushed
+	Ahead   int      // commits the local branch has that the upstream does not
+	Behind  int      // commits the upstream has that the local branch does not
+	Summary string   // first line of the tip's message
+}
+
+// Get every environment, local ones and those only on origin as last fetched,
+// sorted by name
+func (r Repository) Environments() ([]Environment, error) {
+	current, _ := r.CurrentBranch() // none while detached
+
+	locals, err := r.LocalBranches()
+	if err != nil {
+		return nil, err
+	}
+
+	envs := make([]Environment, 0, len(locals))
+	known := make(map[string]bool)
+	for _, name := range locals {
+		env := Environment{Name: name, Current: name == current}
+		known[name] = true
+
+		local, err := r.References.Lookup(path.Join("refs/heads", name))
+		if err != nil {
+			return nil, fmt.Errorf("could not find branch %s: %s", name, err.Error())
+		}
+		env.Local = local.Target()
+		local.Free()
+
+		up, err := r.UpstreamOf(name)
+		if err != nil {
+			return nil, err
+		}
+		if remote, err := r.References.Lookup(up.TrackingRef()); err == nil {
+			env.Remote = remote.Target()
+			remote.Free()
+
+			if env.Ahead, env.Behind, err = r.AheadBehind(env.Local, env.Remote); err != nil {
+				return nil, fmt.Errorf("could not compare %s with %s: %s", name, up, err.Error())
+			}
+		}
+
+		envs = append(envs, env)
+	}
+
+	remotes, err := r.originBranches()
+	if err != nil {
+		return nil, err
+	}
+	for name, tip := range remotes {
+		if known[name] == false {
+			envs = append(envs, Environment{Name: name, Remote: tip})
+		}
+	}
+
+	for i := range envs {
+		tip := envs[i].Local
+		if tip == nil {
+			tip = envs[i].Remote
+		}
+
+		if commit, err := r.LookupCommit(tip); err == nil {
+			envs[i].Summary = commit.Summary()
+			commit.Free()
+		}
+	}
+
+	sort.Sort(byName(envs))
+	return envs, nil
+}
+
+type byName []Environment
+
+func (e byName) Len() int           { return len(e) }
+func (e byName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+
+// Get the branches on origin, as last fetched, by name
+func (r Repository) originBranches() (map[string]*git.Oid, error) {
+	const prefix = "refs/remotes/origin/"
+
+	iter, err := r.NewReferenceIteratorGlob(prefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("could not list origin's branches: %s", err.Error())
+	}
+	defer iter.Free()
+
+	branches := make(map[string]*git.Oid)
+	for {
+		ref, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not list origin's branches: %s", err.Error())
+		}
+
+		// HEAD is symbolic, it only names the default branch
+		if name := strings.TrimPrefix(ref.Name(), prefix); name != "HEAD" && ref.Type() == git.ReferenceOid {
+			branches[name] = ref.Target()
+		}
+		ref.Free()
+	}
+
+	return branches, nil
+}
+
+// Create a local branch for an environment only on origin (as last fetched),
+// tracking it. Returns nil when origin does not have it either.
+func (r Repository) TrackEnvironment(name string) (*git.Branch, error) {
+	up := Upstream{Remote: "origin", Merge: path.Join("refs/heads", name)}
+
+	remote, err := r.References.Lookup(up.TrackingRef())
+	if err != nil {
+		return nil, nil
+	}
+	defer remote.Free()
+
+	commit, err := r.LookupCommit(remote.Target())
+	if err != nil {
+		return nil, fmt.Errorf("could not find the tip of %s: %s", up, err.Error())
+	}
+	defer commit.Free()
+
+	branch, err := r.CreateBranch(name, commit, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not create branch: %s", err.Error())
+	}
+
+	if err := r.SetUpstream(name, up); err != nil {
+		branch.Free()
+		return nil, err
+	}
+
+	return branch, nil
+}
+
+// Get the default branch of origin. Uses refs/remotes/origin/HEAD when a clone
+// (or an earlier call) set it, otherwise asks origin which branch its HEAD
+// points at and remembers the answer.
+func (r Repository) DefaultBranch() (string, error) {
+	const prefix = "refs/remotes/origin/"
+
+	if ref, err := r.References.Lookup(prefix + "HEAD"); err == nil {
+		target := ref.SymbolicTarget()
+		ref.Free()
+
+		if strings.HasPrefix(target, prefix) {
+			return strings.TrimPrefix(target, prefix), nil
+		}
+	}
+
+	origin, err := r.Remotes.Lookup("origin")
+	if err != nil {
+		return "", fmt.Errorf("remote:origin does not exist in repository")
+	}
+	defer origin.Free()
+
+	callbacks, wrap, err := r.remoteCallbacks(origin)
+	if err != nil {
+		return "", err
+	}
+	if err := origin.ConnectFetch(&callbacks); err != nil {
+		return "", fmt.Errorf("could not connect to origin: %s", wrap(err).Error())
+	}
+	defer origin.Disconnect()
+
+	heads, err := origin.Ls()
+	if err != nil {
+		return "", fmt.Errorf("could not list origin's references: %s", err.Error())
+	}
+
+	// the protocol does not say where HEAD points, only what it points at, so
+	// take the branch at the same commit (preferring master when it is a tie)
+	var head *git.Oid
+	for _, h := range heads {
+		if h.Name == "HEAD" {
+			head = h.Id
+		}
+	}
+	if head == nil {
+		return "", fmt.Errorf("origin has no HEAD")
+	}
+
+	candidates := make([]string, 0)
+	for _, h := range heads {
+		if strings.HasPrefix(h.Name, "refs/heads/") && h.Id.Equal(head) {
+			candidates = append(candidates, strings.TrimPrefix(h.Name, "refs/heads/"))
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("could not determine origin's default branch")
+	}
+	sort.Strings(candidates)
+
+	name := candidates[0]
+	for _, c := range candidates {
+		if c == "master" {
+			name = c
+		}
+	}
+
+	// only a cache, the answer is still good if it cannot be saved
+	if ref, err := r.References.CreateSymbolic(prefix+"HEAD", prefix+name, true, "hearth: origin default branch"); err == nil {
+		ref.Free()
+	}
+
+	return name, nil
+}
+
+// What syncing did to one branch (environment)
+type SyncResult struct {
+	Branch string
+	Action string
+	Err    error
+}
+
+// Sync every local branch (environment) with its upstream. The current branch
+// is pulled, other branches are fast-forwarded when behind. With push set,
+// branches with commits their upstream lacks are pushed. Other branches that
+// have diverged are reported and left alone, merging them needs a checkout.
+func (r Repository) SyncAll(push bool) ([]SyncResult, error) {
+	current, err := r.CurrentBranch()
+	if err != nil {
+		return nil, err
+	}
+
+	branches, err := r.LocalBranches()
+	if err != nil {
+		return nil, err
+	}
+
+	// one fetch per remote for all the branches tracking it
+	upstreams := make(map[string]Upstream)
+	refspecs := make(map[string][]string)
+	for _, b := range branches {
+		up, err := r.UpstreamOf(b)
+		if err != nil {
+			return nil, err
+		}
+
+		upstreams[b] = up
+		refspecs[up.Remote] = append(refspecs[up.Remote], up.FetchRefspec())
+	}
+
+	for remote, specs := range refspecs {
+		if err := r.fetch(remote, specs); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]SyncResult, 0, len(branches))
+	for _, b := range branches {
+		action, err := r.syncBranch(b, upstreams[b], b == current, push)
+		results = append(results, SyncResult{b, action, err})
+	}
+
+	return results, nil
+}
+
+// Bring one already fetched branch level with its upstream, giving what was done
+func (r Repository) syncBranch(branch string, up Upstream, current, push bool) (string, error) {
+	local, err := r.References.Lookup(path.Join("refs/heads", branch))
+	if err != nil {
+		return "", fmt.Errorf("could not find branch %s: %s", branch, err.Error())
+	}
+	defer local.Free()
+
+	remote, err := r.References.Lookup(up.TrackingRef())
+	if err != nil {
+		// never pushed
+		if push == false {
+			return "not on " + up.Remote, nil
+		}
+		if err := r.Push(branch); err != nil {
+			return "", err
+		}
+		return "pushed (new)", nil
+	}
+	defer remote.Free()
+
+	ahead, behind, err := r.AheadBehind(local.Target(), remote.Target())
+	if err != nil {
+		return "", fmt.Errorf("could not compare %s with %s: %s", branch, up, err.Error())
+	}
+
+	action := "up to date"
+	if behind > 0 {
+		if current {
+			if err := r.integrateUpstream(branch, up); err != nil {
+				return "", err
+			}
+			action = "pulled"
+		} else if ahead == 0 {
+			if _, err := local.SetTarget(remote.Target(), "hearth: fast-forward from "+up.String()); err != nil {
+				return "", fmt.Errorf("could not fast-forward %s: %s", branch, err.Error())
+			}
+			action = "fast-forwarded"
+		} else {
+			return fmt.Sprintf("diverged from %s, check it out and pull", up), nil
+		}
+	}
+
+	if ahead > 0 {
+		if push == false {
+			return fmt.Sprintf("%s, %d commit(s) to push", action, ahead), nil
+		}
+		if err := r.Push(branch); err != nil {
+			return "", err
+		}
+		action = fmt.Sprintf("%s, pushed %d commit(s)", action, ahead)
+	}
+
+	return action, nil
+}
@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUpstreamOf(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	// never pushed, falls back to the same name on origin
+	up, err := repo.UpstreamOf("work")
+	check_fatal(t, err)
+	if up.Remote != "origin" || up.Merge != "refs/heads/work" {
+		t.Errorf("wrong default upstream: %+v", up)
+	}
+	if up.TrackingRef() != "refs/remotes/origin/work" || up.String() != "origin/work" {
+		t.Errorf("wrong tracking ref: %s (%s)", up.TrackingRef(), up)
+	}
+	if up.FetchRefspec() != "+refs/heads/work:refs/remotes/origin/work" {
+		t.Errorf("wrong fetch refspec: %s", up.FetchRefspec())
+	}
+
+	check_fatal(t, repo.SetUpstream("work", Upstream{"origin", "refs/heads/office"}))
+	up, err = repo.UpstreamOf("work")
+	check_fatal(t, err)
+	if up.Merge != "refs/heads/office" {
+		t.Errorf("configured upstream not used: %+v", up)
+	}
+
+	// pushes go to the configured branch
+	plan, err := repo.PlanPush("work")
+	check_fatal(t, err)
+	if len(plan.Push) != 1 || plan.Push[0] != "refs/heads/work:refs/heads/office" {
+		t.Errorf("wrong refspecs: %v", plan.Push)
+	}
+}
+
+func TestPushCurrentBranch(t *testing.T) {
+	origin, origin_path := create_origin_repo(t)
+	repo := create_repo(origin_path, t)
+
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer origin.Free()
+	defer repo.Free()
+
+	make_file(repo.Path, t)
+	c, err := repo.CommitAndPush("first commit", "")
+	check_fatal(t, err)
+	defer c.Free()
+
+	branch, err := repo.NewBranch("work")
+	check_fatal(t, err)
+	defer branch.Free()
+	check_fatal(t, repo.CheckoutBranch(branch))
+
+	make_file(repo.Path, t)
+	work, err := repo.CommitAndPush("work commit", "")
+	check_fatal(t, err)
+	defer work.Free()
+
+	ref, err := origin.References.Lookup("refs/heads/work")
+	check_fatalf(t, err, "work was not pushed to origin: %v", err)
+	defer ref.Free()
+	if ref.Target().Equal(work.Id()) == false {
+		t.Errorf("origin's work is not at the last commit")
+	}
+
+	// the first push remembers where it went
+	up, err := repo.UpstreamOf("work")
+	check_fatal(t, err)
+	if up.Remote != "origin" || up.Merge != "refs/heads/work" {
+		t.Errorf("wrong upstream after push: %+v", up)
+	}
+
+	name, err := repo.DefaultBranch()
+	check_fatal(t, err)
+	if name != "master" {
+		t.Errorf("expected master to be the default branch, got %s", name)
+	}
+}
+
+func TestSyncAll(t *testing.T) {
+	origin, origin_path := create_origin_repo(t)
+	repo := create_repo(origin_path, t)
+	clone_path := temp_dir()
+
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone_path)
+	defer origin.Free()
+	defer repo.Free()
+
+	make_file(repo.Path, t)
+	c, err := repo.CommitAndPush("first commit", "master")
+	check_fatal(t, err)
+	defer c.Free()
+
+	clone, err := Clone(clone_path, origin_path)
+	check_fatal(t, err)
+	defer clone.Free()
+
+	// a new commit on origin and a new environment in the clone
+	make_file(repo.Path, t)
+	second, err := repo.CommitAndPush("second commit", "master")
+	check_fatal(t, err)
+	defer second.Free()
+
+	laptop, err := clone.NewBranch("laptop")
+	check_fatal(t, err)
+	defer laptop.Free()
+
+	results, err := clone.SyncAll(true)
+	check_fatal(t, err)
+
+	actions := make(map[string]string)
+	for _, res := range results {
+		check_fatal(t, res.Err)
+		actions[res.Branch] = res.Action
+	}
+
+	if actions["master"] != "pulled" {
+		t.Errorf("expected master to be pulled, got %q", actions["master"])
+	}
+	if actions["laptop"] != "pushed (new)" {
+		t.Errorf("expected laptop to be pushed, got %q", actions["laptop"])
+	}
+
+	head, err := clone.HeadCommit()
+	check_fatal(t, err)
+	defer head.Free()
+	if head.Id().Equal(second.Id()) == false {
+		t.Errorf("clone was not brought up to date")
+	}
+
+	ref, err := origin.References.Lookup("refs/heads/laptop")
+	check_fatalf(t, err, "laptop was not pushed to origin: %v", err)
+	ref.Free()
+}
+
+func TestEnvironments(t *testing.T) {
+	origin, origin_path := create_origin_repo(t)
+	repo := create_repo(origin_path, t)
+	clone_path := temp_dir()
+
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone_path)
+	defer origin.Free()
+	defer repo.Free()
+
+	make_file(repo.Path, t)
+	c, err := repo.CommitAndPush("first commit", "master")
+	check_fatal(t, err)
+	defer c.Free()
+
+	clone, err := Clone(clone_path, origin_path)
+	check_fatal(t, err)
+	defer clone.Free()
+
+	// an environment made elsewhere, and a local commit not yet pushed
+	branch, err := repo.NewBranch("laptop")
+	check_fatal(t, err)
+	branch.Free()
+	check_fatal(t, repo.Push("laptop"))
+
+	make_file(clone.Path, t)
+	local, err := clone.CommitAll("local commit")
+	check_fatal(t, err)
+	defer local.Free()
+
+	check_fatal(t, clone.FetchEnvironments())
+	envs, err := clone.Environments()
+	check_fatal(t, err)
+	if len(envs) != 2 || envs[0].Name != "laptop" || envs[1].Name != "master" {
+		t.Fatalf("wrong environments: %+v", envs)
+	}
+
+	if envs[0].Local != nil || envs[0].Remote == nil || envs[0].Remote.Equal(c.Id()) == false {
+		t.Errorf("expected laptop to be only on origin: %+v", envs[0])
+	}
+	if envs[1].Current == false || envs[1].Ahead != 1 || envs[1].Behind != 0 {
+		t.Errorf("expected master to be current and 1 ahead: %+v", envs[1])
+	}
+	if envs[1].Summary != "local commit" {
+		t.Errorf("wrong summary: %q", envs[1].Summary)
+	}
+
+	laptop, err := clone.TrackEnvironment("laptop")
+	check_fatal(t, err)
+	defer laptop.Free()
+	if laptop.Target().Equal(c.Id()) == false {
+		t.Errorf("laptop is not at origin's tip")
+	}
+
+	up, err := clone.UpstreamOf("laptop")
+	check_fatal(t, err)
+	if up.String() != "origin/laptop" {
+		t.Errorf("wrong upstream: %s", up)
+	}
+
+	missing, err := clone.TrackEnvironment("desktop")
+	check_fatal(t, err)
+	if missing != nil {
+		t.Errorf("expected no branch for an environment origin does not have")
+	}
+}
@@ -0,0 +1,292 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+//==================================================
+// Merge conflicts
+//==================================================
+
+// Returned by Pull when the merge stopped on conflicts. The merge is left in
+// progress to be resolved (or aborted).
+type ConflictError struct {
+	Paths []string // relative to the repository
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicts in %d file(s): %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
+
+// Truthy function on whether a merge is in progress
+func (r Repository) Merging() bool {
+	return r.State() == git.RepositoryStateMerge
+}
+
+// Get the sorted paths, relative to the repository, still in conflict
+func (r Repository) Conflicts() ([]string, error) {
+	idx, err := r.Index()
+	if err != nil {
+		return nil, fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	return indexConflicts(idx)
+}
+
+// Get the sorted paths in conflict in the index
+func indexConflicts(idx *git.Index) ([]string, error) {
+	paths := make([]string, 0)
+	if idx.HasConflicts() == false {
+		return paths, nil
+	}
+
+	iter, err := idx.ConflictIterator()
+	if err != nil {
+		return nil, fmt.Errorf("could not create iterator for conflicts: %s", err.Error())
+	}
+	defer iter.Free()
+
+	for {
+		conflict, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read conflicts: %s", err.Error())
+		}
+
+		// either side may be missing when it deleted the file
+		for _, entry := range []*git.IndexEntry{conflict.Our, conflict.Their, conflict.Ancestor} {
+			if entry != nil {
+				paths = append(paths, entry.Path)
+				break
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Resolve the conflict by keeping the local version of the file
+func (r Repository) TakeOurs(p string) error {
+	return r.take(p, func(c git.IndexConflict) *git.IndexEntry { return c.Our })
+}
+
+// Resolve the conflict by taking the fetched version of the file
+func (r Repository) TakeTheirs(p string) error {
+	return r.take(p, func(c git.IndexConflict) *git.IndexEntry { return c.Their })
+}
+
+// Write one side of a conflict to the working tree and stage it. A side
+// without an entry deleted the file, so it is deleted.
+func (r Repository) take(p string, side func(git.IndexConflict) *git.IndexEntry) error {
+	idx, err := r.Index()
+	if err != nil {
+		return fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	conflict, err := idx.GetConflict(p)
+	if err != nil {
+		return fmt.Errorf("%s is not in conflict: %s", p, err.Error())
+	}
+
+	full := filepath.Join(r.Path, p)
+	entry := side(conflict)
+	if entry == nil {
+		if err := os.Remove(full); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	} else {
+		blob, err := r.LookupBlob(entry.Id)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", p, err.Error())
+		}
+		defer blob.Free()
+
+		if err := writeEntry(full, entry.Mode, blob.Contents()); err != nil {
+			return err
+		}
+	}
+
+	return r.stage(idx, p, entry != nil)
+}
+
+// Write the contents of an index entry to the path with the entry's mode
+func writeEntry(p string, mode git.Filemode, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	os.Remove(p) // may be a symlink or have the wrong mode
+
+	switch mode {
+	case git.FilemodeLink:
+		return os.Symlink(string(contents), p)
+	case git.FilemodeBlobExecutable:
+		return ioutil.WriteFile(p, contents, 0755)
+	}
+	return ioutil.WriteFile(p, contents, 0644)
+}
+
+// Mark the conflict resolved with whatever is in the working tree, refusing
+// files that still hold conflict markers. A deleted file stays deleted.
+func (r Repository) MarkResolved(p string) error {
+	idx, err := r.Index()
+	if err != nil {
+		return fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	contents, err := ioutil.ReadFile(filepath.Join(r.Path, p))
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	exists := err == nil
+
+	if exists && HasConflictMarkers(contents) {
+		return fmt.Errorf("%s still has conflict markers", p)
+	}
+
+	return r.stage(idx, p, exists)
+}
+
+// Truthy function on whether the contents hold unresolved conflict markers
+func HasConflictMarkers(contents []byte) bool {
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("<<<<<<< ")) || bytes.HasPrefix(line, []byte(">>>>>>> ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the conflict for the path with the working tree file (or its absence)
+func (r Repository) stage(idx *git.Index, p string, exists bool) error {
+	if err := idx.RemoveConflict(p); err != nil {
+		return fmt.Errorf("could not clear conflict on %s: %s", p, err.Error())
+	}
+
+	var err error
+	if exists {
+		err = idx.AddByPath(p)
+	} else if err = idx.RemoveByPath(p); git.IsErrorCode(err, git.ErrNotFound) {
+		err = nil // nothing staged to remove
+	}
+	if err != nil {
+		return fmt.Errorf("could not stage %s: %s", p, err.Error())
+	}
+
+	return idx.Write()
+}
+
+// Abort the merge in progress, putting HEAD, the index and the working tree
+// back to where they were before the pull (ORIG_HEAD)
+func (r Repository) AbortMerge() error {
+	if r.Merging() == false {
+		return fmt.Errorf("no merge in progress")
+	}
+
+	orig, err := r.OrigHead()
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.LookupCommit(orig)
+	if err != nil {
+		return fmt.Errorf("could not find the pre-pull HEAD: %s", err.Error())
+	}
+	defer commit.Free()
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.ResetToCommit(commit, git.ResetHard, &opts); err != nil {
+		return fmt.Errorf("could not reset to the pre-pull HEAD: %s", err.Error())
+	}
+
+	return r.StateCleanup()
+}
+
+// Commit the merge in progress once nothing is left in conflict. The paths
+// that were resolved by hand are listed in the commit message.
+func (r Repository) FinishMerge(resolved []string) (*git.Commit, error) {
+	idx, err := r.Index()
+	if err != nil {
+		return nil, fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	if idx.HasConflicts() {
+		return nil, fmt.Errorf("conflicts remain, resolve them first")
+	}
+
+	merge_head, err := r.References.Lookup("MERGE_HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("no merge in progress")
+	}
+	defer merge_head.Free()
+
+	theirs, err := r.LookupCommit(merge_head.Target())
+	if err != nil {
+		return nil, err
+	}
+	defer theirs.Free()
+
+	ours, err := r.HeadCommit()
+	if err != nil {
+		return nil, err
+	}
+	defer ours.Free()
+
+	tree_id, err := idx.WriteTree()
+	if err != nil {
+		return nil, fmt.Errorf("could not write tree to repo: %s", err.Error())
+	}
+
+	tree, err := r.LookupTree(tree_id)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	sig, err := r.DefaultSignature()
+	if err != nil {
+		return nil, fmt.Errorf("could not get signature for commit: %s", err.Error())
+	}
+
+	commit_id, err := r.CreateCommit("HEAD", sig, sig, r.mergeMessage(resolved), tree, ours, theirs)
+	if err != nil {
+		return nil, fmt.Errorf("could not create commit after merge: %s", err.Error())
+	}
+
+	if err := r.StateCleanup(); err != nil {
+		return nil, err
+	}
+
+	return r.LookupCommit(commit_id)
+}
+
+// Describe the merge of the upstream into the current branch
+func (r Repository) mergeMessage(resolved []string) string {
+	msg := "Merge upstream"
+	if branch, err := r.CurrentBranch(); err == nil {
+		if up, err := r.UpstreamOf(branch); err == nil {
+			msg = fmt.Sprintf("Merge %s into %s", up, branch)
+		}
+	}
+
+	if len(resolved) > 0 {
+		msg += "\n\nConflicts:\n\t" + strings.Join(resolved, "\n\t")
+	}
+
+	return msg + "\n"
+}
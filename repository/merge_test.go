@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zmarcantel/hearth/config"
+)
+
+func TestHasConflictMarkers(t *testing.T) {
+	conflicted := "a\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> origin/master\nb\n"
+	if HasConflictMarkers([]byte(conflicted)) == false {
+		t.Errorf("expected conflict markers to be found")
+	}
+
+	clean := "a\n<<<<<<<not a marker\n=======\nb\n"
+	if HasConflictMarkers([]byte(clean)) {
+		t.Errorf("expected no conflict markers")
+	}
+}
+
+// A clone that pushed a commit to origin, and a repo with a local commit made
+// since the first one, changing the same file or not. The repo has not pulled.
+func diverged_clones(t *testing.T, same_file bool) (Repository, Repository, string) {
+	origin, origin_path := create_origin_repo(t)
+	defer origin.Free()
+
+	repo := create_repo(origin_path, t)
+	file := path.Join(repo.Path, "shared")
+	check_fatal(t, ioutil.WriteFile(file, []byte("base\n"), 0644))
+	c, err := repo.CommitAndPush("first commit", "master")
+	check_fatal(t, err)
+	c.Free()
+
+	clone, err := Clone(temp_dir(), origin_path)
+	check_fatal(t, err)
+
+	their_file := "shared"
+	if same_file == false {
+		their_file = "other"
+	}
+	check_fatal(t, ioutil.WriteFile(path.Join(clone.Path, their_file), []byte("theirs\n"), 0644))
+	c, err = clone.CommitAndPush("their change", "master")
+	check_fatal(t, err)
+	c.Free()
+
+	check_fatal(t, ioutil.WriteFile(file, []byte("mine\n"), 0644))
+	c, err = repo.CommitAll("my change")
+	check_fatal(t, err)
+	c.Free()
+
+	return repo, clone, origin_path
+}
+
+// A repo and a clone that changed the same file. Returns the repo with its
+// pull stopped on the conflict.
+func conflicting_clones(t *testing.T) (Repository, Repository, string) {
+	repo, clone, origin_path := diverged_clones(t, true)
+
+	err := repo.Pull()
+	if _, ok := err.(*ConflictError); ok == false {
+		t.Fatalf("expected the pull to stop on conflicts, got: %v", err)
+	}
+
+	return repo, clone, origin_path
+}
+
+func TestResolveConflict(t *testing.T) {
+	repo, clone, origin_path := conflicting_clones(t)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	if repo.Merging() == false {
+		t.Errorf("expected a merge in progress")
+	}
+
+	conflicts, err := repo.Conflicts()
+	check_fatal(t, err)
+	if len(conflicts) != 1 || conflicts[0] != "shared" {
+		t.Fatalf("wrong conflicts: %v", conflicts)
+	}
+
+	if _, err := repo.FinishMerge(conflicts); err == nil {
+		t.Errorf("expected the merge to be refused while in conflict")
+	}
+
+	check_fatal(t, repo.TakeTheirs("shared"))
+	contents, err := ioutil.ReadFile(path.Join(repo.Path, "shared"))
+	check_fatal(t, err)
+	if string(contents) != "theirs\n" {
+		t.Errorf("expected their version, got: %q", contents)
+	}
+
+	merge, err := repo.FinishMerge(conflicts)
+	check_fatal(t, err)
+	defer merge.Free()
+
+	if merge.ParentCount() != 2 {
+		t.Errorf("expected a merge commit, got %d parent(s)", merge.ParentCount())
+	}
+	if strings.HasPrefix(merge.Message(), "Merge origin/master into master") == false ||
+		strings.Contains(merge.Message(), "\tshared") == false {
+		t.Errorf("wrong merge message: %q", merge.Message())
+	}
+	if repo.Merging() {
+		t.Errorf("expected the merge to be over")
+	}
+}
+
+func TestMarkResolved(t *testing.T) {
+	repo, clone, origin_path := conflicting_clones(t)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	// libgit2 leaves the file with markers
+	if err := repo.MarkResolved("shared"); err == nil {
+		t.Errorf("expected a file with conflict markers to be refused")
+	}
+
+	check_fatal(t, ioutil.WriteFile(path.Join(repo.Path, "shared"), []byte("both\n"), 0644))
+	check_fatal(t, repo.MarkResolved("shared"))
+
+	conflicts, err := repo.Conflicts()
+	check_fatal(t, err)
+	if len(conflicts) != 0 {
+		t.Errorf("expected no conflicts left, got: %v", conflicts)
+	}
+}
+
+func TestAbortMerge(t *testing.T) {
+	repo, clone, origin_path := conflicting_clones(t)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	orig, err := repo.OrigHead()
+	check_fatal(t, err)
+
+	check_fatal(t, repo.AbortMerge())
+
+	head, err := repo.HeadCommit()
+	check_fatal(t, err)
+	defer head.Free()
+	if head.Id().Equal(orig) == false {
+		t.Errorf("expected HEAD back at ORIG_HEAD")
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(repo.Path, "shared"))
+	check_fatal(t, err)
+	if string(contents) != "mine\n" {
+		t.Errorf("expected the pre-pull file back, got: %q", contents)
+	}
+	if repo.Merging() {
+		t.Errorf("expected no merge in progress")
+	}
+}
+
+func TestOpenConflicted(t *testing.T) {
+	origin, origin_path := create_origin_repo(t)
+	defer os.RemoveAll(origin_path)
+	defer origin.Free()
+
+	repo := create_repo(origin_path, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	rc := path.Join(repo.Path, config.Name)
+	check_fatal(t, ioutil.WriteFile(rc, []byte("directory: "+repo.Path+"\nvars:\n  editor: base\n"), 0644))
+	c, err := repo.CommitAndPush("first commit", "master")
+	check_fatal(t, err)
+	c.Free()
+
+	clone, err := Clone(temp_dir(), origin_path)
+	check_fatal(t, err)
+	defer os.RemoveAll(clone.Path)
+	defer clone.Free()
+
+	theirs := []byte("directory: " + repo.Path + "\nvars:\n  editor: theirs\n")
+	check_fatal(t, ioutil.WriteFile(path.Join(clone.Path, config.Name), theirs, 0644))
+	c, err = clone.CommitAndPush("their change", "master")
+	check_fatal(t, err)
+	c.Free()
+
+	check_fatal(t, ioutil.WriteFile(rc, []byte("directory: "+repo.Path+"\nvars:\n  editor: mine\n"), 0644))
+	c, err = repo.CommitAll("my change")
+	check_fatal(t, err)
+	c.Free()
+
+	if _, ok := repo.Pull().(*ConflictError); ok == false {
+		t.Fatalf("expected the pull to stop on conflicts in %s", config.Name)
+	}
+
+	home := temp_dir()
+	check_fatal(t, os.MkdirAll(home, 0755))
+	defer os.RemoveAll(home)
+	old_home := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", old_home)
+	check_fatal(t, os.Symlink(rc, config.Path()))
+
+	if _, err := config.Open(); err == nil {
+		t.Fatalf("expected the conflicted %s not to parse", config.Name)
+	}
+
+	conflicted, err := OpenConflicted()
+	check_fatal(t, err)
+	defer conflicted.Free()
+
+	if conflicted.Path != repo.Path {
+		t.Errorf("expected the repository at %s, got %s", repo.Path, conflicted.Path)
+	}
+	if conflicted.Merging() == false {
+		t.Errorf("expected a merge in progress")
+	}
+	if conflicted.Config.Vars["editor"] != "mine" {
+		t.Errorf("expected the config from before the pull, got vars: %v", conflicted.Config.Vars)
+	}
+
+	check_fatal(t, conflicted.AbortMerge())
+	if _, err := config.Open(); err != nil {
+		t.Errorf("expected the config to parse once the pull is aborted: %s", err)
+	}
+}
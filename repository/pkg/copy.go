@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//==================================================
+// Copies and hardlinks
+//==================================================
+
+// Truthy function on whether both paths are the same file, as hardlinks are
+func sameFile(a, b string) bool {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(sa, sb)
+}
+
+// Get the checksum the link had when last installed or updated, empty when
+// there is no record of it
+func (i Info) recordedSum(l Link) string {
+	for _, r := range i.Recorded {
+		if r.Target == l.Target && r.Mode == l.Mode {
+			return r.Sum
+		}
+	}
+	return ""
+}
+
+// Bring a copied or hardlinked file and its source back in sync. Whichever side
+// changed since the last install or update is copied over the other, a
+// hardlink replaced by a file of its own is linked again. When both changed,
+// or there is no record to tell, the link is left alone as diverged.
+func (i Info) sync(l Link, rec *Record) error {
+	s, err := os.Lstat(l.Target)
+	if os.IsNotExist(err) {
+		return i.resync(l, rec)
+	} else if err != nil {
+		return err
+	} else if s.Mode().IsRegular() == false {
+		return fmt.Errorf("cannot %s %s: something other than a file is in the way", l.Mode, l.Target)
+	}
+
+	if l.Mode == ModeHardlink && sameFile(l.Source, l.Target) {
+		l.Sum = fileSum(l.Source)
+		rec.Links = append(rec.Links, l)
+		return nil
+	}
+
+	source, target, last := fileSum(l.Source), fileSum(l.Target), i.recordedSum(l)
+	switch {
+	case source == target || target == last:
+		return i.resync(l, rec)
+
+	case source == last:
+		if rec.DryRun == false {
+			if err := copyBack(l); err != nil {
+				return err
+			}
+		}
+		rec.CopiedBack = append(rec.CopiedBack, l)
+		return i.resync(l, rec)
+	}
+
+	rec.Diverged = append(rec.Diverged, l)
+	return nil
+}
+
+// Put the source at the target again, replacing the file there
+func (i Info) resync(l Link, rec *Record) error {
+	contents, err := ioutil.ReadFile(l.Source)
+	if err != nil {
+		return err
+	}
+	l.Sum = checksum(contents)
+
+	if i.placed(l) == false && rec.DryRun == false {
+		if l.Mode == ModeHardlink {
+			if err := os.Remove(l.Target); err != nil && os.IsNotExist(err) == false {
+				return err
+			}
+		}
+		if err := place(l, contents); err != nil {
+			return err
+		}
+	}
+	rec.Links = append(rec.Links, l)
+
+	return nil
+}
+
+// Write the file at the target over its source in the package, keeping the
+// permissions it has at the target
+func copyBack(l Link) error {
+	s, err := os.Stat(l.Target)
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadFile(l.Target)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(l.Source, contents, s.Mode().Perm())
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+//==================================================
+// copy and hardlink tests
+//==================================================
+
+// A package with a single executable file, installed in the given mode
+func synced_package(mode Mode, t *testing.T) (string, string, string, Info) {
+	dir, pkg_dir, target := package_fixture(map[string]string{"run.sh": "echo one\n"}, 0750, t)
+
+	info := Info{Name: "pkg", Target: "all:" + target, Mode: mode}
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Recorded = rec.Links
+
+	return dir, pkg_dir, path.Join(target, "run.sh"), info
+}
+
+func TestInfo_Install_Copy(t *testing.T) {
+	dir, pkg_dir, copied, info := synced_package(ModeCopy, t)
+	defer os.RemoveAll(dir)
+
+	s, err := os.Lstat(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode().IsRegular() == false || s.Mode().Perm() != 0750 {
+		t.Errorf("expected a regular file keeping the source's permissions, got %v", s.Mode())
+	}
+	if len(info.Recorded) != 1 || info.Recorded[0].Sum != checksum([]byte("echo one\n")) {
+		t.Errorf("expected the checksum to be recorded: %+v", info.Recorded)
+	}
+
+	// the source changed
+	if err := ioutil.WriteFile(path.Join(pkg_dir, "run.sh"), []byte("echo two\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect_contents(copied, "echo two\n", t)
+	info.Recorded = rec.Links
+
+	// the copy changed
+	if err := ioutil.WriteFile(copied, []byte("echo three\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect_contents(path.Join(pkg_dir, "run.sh"), "echo three\n", t)
+	if len(rec.CopiedBack) != 1 {
+		t.Errorf("expected the copy to be copied back: %+v", rec)
+	}
+	info.Recorded = rec.Links
+
+	// both changed
+	if err := ioutil.WriteFile(path.Join(pkg_dir, "run.sh"), []byte("echo four\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(copied, []byte("echo five\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Diverged) != 1 {
+		t.Errorf("expected a conflict: %+v", rec)
+	}
+	// both sides are left alone
+	expect_contents(path.Join(pkg_dir, "run.sh"), "echo four\n", t)
+	expect_contents(copied, "echo five\n", t)
+
+	health, _, err := info.Check(pkg_dir, info.Recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthDrifted {
+		t.Errorf("expected drifted, got '%s'", health)
+	}
+}
+
+func TestInfo_Install_Hardlink(t *testing.T) {
+	dir, pkg_dir, linked, info := synced_package(ModeHardlink, t)
+	defer os.RemoveAll(dir)
+
+	source := path.Join(pkg_dir, "run.sh")
+	if sameFile(source, linked) == false {
+		t.Fatalf("expected a hardlink")
+	}
+
+	// a tool saving by replacing the file breaks the link
+	if err := os.Remove(linked); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(linked, []byte("echo edited\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	health, _, err := info.Check(pkg_dir, info.Recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthDrifted {
+		t.Errorf("expected drifted, got '%s'", health)
+	}
+
+	if _, err := info.Update(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_contents(source, "echo edited\n", t)
+	if sameFile(source, linked) == false {
+		t.Errorf("expected the edit to be copied back and linked again")
+	}
+
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(linked, "expected the hardlink to be removed", t)
+	expect_file(source, "expected the source to be kept", t)
+}
@@ -3,14 +3,58 @@ package pkg
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/zmarcantel/hearth/secret"
 )
 
+//==================================================
+// Records
+//==================================================
+
+// A command run on behalf of a package, as it was actually executed
+type Command struct {
+	Cmd   string    `yaml:"cmd"`
+	Dir   string    `yaml:"dir,omitempty"`
+	File  string    `yaml:"file,omitempty"`
+	Ran   time.Time `yaml:"ran"`
+	Error string    `yaml:"error,omitempty"`
+}
+
+// How a conflicting file at a link target was dealt with
+type Resolution struct {
+	Target string
+	Policy Conflict
+	Backup string // where the file was moved to under ConflictBackup
+}
+
+// Everything a package did to the system during a single install, update or uninstall.
+// On a dry run nothing is touched and the record is the plan of what would be done.
+type Record struct {
+	DryRun     bool
+	Links      []Link
+	Commands   []Command
+	Conflicts  []Resolution
+	CopiedBack []Link   // copies changed at the target, copied back into the package
+	Diverged   []Link   // copies changed both in the package and at the target, left alone
+	Unfolded   []string // directories linked by another package, split up to be shared
+}
+
+func (r *Record) ran(cmd, dir, file string, err error) {
+	c := Command{Cmd: cmd, Dir: dir, File: file, Ran: time.Now()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Commands = append(r.Commands, c)
+}
+
 //==================================================
 // Installation config
 //==================================================
@@ -19,10 +63,14 @@ type Install struct {
 	PreCmd  string `yaml:"pre,omitempty"`
 	Cmd     string `yaml:"cmd,omitempty"`
 	PostCmd string `yaml:"post,omitempty"`
-	Stow    bool   `yaml:",omitempty"`
+	Stow    bool   `yaml:",omitempty"` // with a target, mirror the package under it like GNU stow
 }
 
 func (i Install) RunAll(wd string) error {
+	return i.runAll(wd, &Record{})
+}
+
+func (i Install) runAll(wd string, rec *Record) error {
 	if len(i.Cmd) == 0 {
 		return nil
 	}
@@ -40,17 +88,17 @@ func (i Install) RunAll(wd string) error {
 	}
 
 	if len(i.PreCmd) > 0 {
-		if err := i.run(i.PreCmd); err != nil {
+		if err := i.run(i.PreCmd, wd, rec); err != nil {
 			return err
 		}
 	}
 
-	if err := i.run(i.Cmd); err != nil {
+	if err := i.run(i.Cmd, wd, rec); err != nil {
 		return err
 	}
 
 	if len(i.PostCmd) > 0 {
-		if err := i.run(i.PostCmd); err != nil {
+		if err := i.run(i.PostCmd, wd, rec); err != nil {
 			return err
 		}
 	}
@@ -58,7 +106,7 @@ func (i Install) RunAll(wd string) error {
 	return nil
 }
 
-func (i Install) run(cmd_str string) error {
+func (i Install) run(cmd_str, wd string, rec *Record) error {
 	cmd_str = os.ExpandEnv(cmd_str)
 	cmd_raw := strings.Split(cmd_str, " ")
 	if length := len(cmd_raw); length == 0 {
@@ -70,12 +118,18 @@ func (i Install) run(cmd_str string) error {
 
 	// TODO: add env vars
 
+	if rec.DryRun {
+		rec.ran(cmd_str, wd, "", nil)
+		return nil
+	}
+
 	var out bytes.Buffer
 	cmd := exec.Command(cmd_raw[0], cmd_raw[1:]...)
 	cmd.Stdout = &out
 	cmd.Stderr = &out
 
 	err := cmd.Run()
+	rec.ran(cmd_str, wd, "", err)
 	if err != nil {
 		fmt.Println(out.String())
 		return err
@@ -85,7 +139,7 @@ func (i Install) run(cmd_str string) error {
 }
 
 func (i Install) MarshalYAML() (interface{}, error) {
-	if len(i.PreCmd) > 0 || len(i.PostCmd) > 0 {
+	if len(i.PreCmd) > 0 || len(i.PostCmd) > 0 || i.Stow {
 		return i, nil
 	}
 
@@ -116,6 +170,10 @@ type Update struct {
 }
 
 func (u Update) RunAll(root string) error {
+	return u.runAll(root, &Record{})
+}
+
+func (u Update) runAll(root string, rec *Record) error {
 	pushd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -123,7 +181,7 @@ func (u Update) RunAll(root string) error {
 	defer os.Chdir(pushd)
 
 	if len(u.Once) != 0 {
-		if err := u.run(u.Once, root, ""); err != nil {
+		if err := u.run(u.Once, root, "", rec); err != nil {
 			return err
 		}
 	}
@@ -135,7 +193,7 @@ func (u Update) RunAll(root string) error {
 
 		// directory command
 		if i.IsDir() && len(u.Directory) != 0 {
-			if err := u.run(u.Directory, p, ""); err != nil {
+			if err := u.run(u.Directory, p, "", rec); err != nil {
 				return fmt.Errorf("could not run directory comand: %s", err.Error())
 			}
 		}
@@ -146,7 +204,7 @@ func (u Update) RunAll(root string) error {
 				return fmt.Errorf("could not set hearth file env: %s", err.Error())
 			}
 
-			if err := u.run(u.File, filepath.Dir(p), p); err != nil {
+			if err := u.run(u.File, filepath.Dir(p), p, rec); err != nil {
 				return fmt.Errorf("could not run file comand: %s", err.Error())
 			}
 		}
@@ -156,7 +214,7 @@ func (u Update) RunAll(root string) error {
 
 }
 
-func (u Update) run(cmd_str, wd, fname string) error {
+func (u Update) run(cmd_str, wd, fname string, rec *Record) error {
 	// set env
 	if len(wd) > 0 {
 		if err := os.Setenv("HEARTH_DIR", wd); err != nil {
@@ -173,6 +231,11 @@ func (u Update) run(cmd_str, wd, fname string) error {
 	cmd_str = os.ExpandEnv(cmd_str)
 	cmd_str = strings.TrimSpace(cmd_str)
 
+	if rec.DryRun {
+		rec.ran(cmd_str, wd, fname, nil)
+		return nil
+	}
+
 	cmd_array := []string{"-c", cmd_str}
 
 	// keep an output buffer
@@ -185,6 +248,7 @@ func (u Update) run(cmd_str, wd, fname string) error {
 
 	// ... and go
 	err := cmd.Run()
+	rec.ran(cmd_str, wd, fname, err)
 	if err != nil && u.IgnoreErrors == false {
 		fmt.Println(out.String())
 		return err
@@ -193,75 +257,703 @@ func (u Update) run(cmd_str, wd, fname string) error {
 	return nil
 }
 
-//
 // update config map
 type UpdateMap map[string]Update
 
 // TODO: string-or-list like the install config
 
+//==================================================
+// Conflict policy
+//==================================================
+
+// What to do when something already exists where a package wants to link
+type Conflict string
+
+const (
+	ConflictFail      Conflict = "fail"      // stop the install
+	ConflictSkip      Conflict = "skip"      // leave the existing file and do not link
+	ConflictBackup    Conflict = "backup"    // move the existing file into the backup directory
+	ConflictOverwrite Conflict = "overwrite" // delete the existing file
+	ConflictAdopt     Conflict = "adopt"     // move the existing file into the package
+)
+
+// Validate a conflict policy given by the user. Empty is the default, ConflictFail.
+func ParseConflict(s string) (Conflict, error) {
+	switch c := Conflict(s); c {
+	case "":
+		return ConflictFail, nil
+	case ConflictFail, ConflictSkip, ConflictBackup, ConflictOverwrite, ConflictAdopt:
+		return c, nil
+	}
+
+	return "", fmt.Errorf("unknown conflict policy '%s' (expected fail, skip, backup, overwrite or adopt)", s)
+}
+
+// Move the file or directory at p over dest. Directories are merged into an
+// existing destination directory, with the contents of p taking priority.
+func adopt(p, dest string) error {
+	from, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	to, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return os.Rename(p, dest)
+	} else if err != nil {
+		return err
+	}
+
+	if from.IsDir() != to.IsDir() {
+		return fmt.Errorf("cannot adopt %s: it is not the same kind of file as %s", p, dest)
+	} else if from.IsDir() == false {
+		return os.Rename(p, dest)
+	}
+
+	children, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		if err := adopt(path.Join(p, c.Name()), path.Join(dest, c.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(p)
+}
+
+//==================================================
+// Placement mode
+//==================================================
+
+// How a package puts its files at the target
+type Mode string
+
+const (
+	ModeLink     Mode = ""         // symlink, the default
+	ModeTemplate Mode = "template" // render every file as a template, see Render
+	ModeSecret   Mode = "secret"   // decrypt, only for files sealed with secret.Seal
+	ModeCopy     Mode = "copy"     // copy every file, kept in sync both ways by Update
+	ModeHardlink Mode = "hardlink" // hardlink every file, kept in sync both ways by Update
+)
+
+// Truthy function on whether files are written to the target, rather than
+// linked, and so carry a checksum
+func (m Mode) written() bool {
+	return m == ModeTemplate || m == ModeSecret || m == ModeCopy
+}
+
+// Truthy function on whether the mode places files one by one, so directories
+// are created rather than linked
+func (m Mode) perFile() bool {
+	return m == ModeTemplate || m == ModeCopy || m == ModeHardlink
+}
+
+// Truthy function on whether the target is kept in sync with its source in
+// both directions
+func (m Mode) synced() bool {
+	return m == ModeCopy || m == ModeHardlink
+}
+
+// Validate a placement mode given by the user
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "link":
+		return ModeLink, nil
+	case ModeLink, ModeTemplate, ModeCopy, ModeHardlink:
+		return m, nil
+	}
+
+	return "", fmt.Errorf("unknown mode '%s' (expected link, template, copy or hardlink)", s)
+}
+
 //==================================================
 // Base Info struct
 //==================================================
 
 // Holds metadata and creates an action point for packages.
 type Info struct {
-	Name       string  `yaml:"-"`
-	UpdateCmd  Update  `yaml:"update,omitempty"`
-	InstallCmd Install `yaml:"install,omitempty"` // mutually exclusive with Target
-	Target     string  `yaml:",omitempty"`        // mutually exclusive with Install
+	Name         string   `yaml:"-"`
+	UpdateCmd    Update   `yaml:"update,omitempty"`
+	InstallCmd   Install  `yaml:"install,omitempty"`   // mutually exclusive with Target, but for stow
+	UninstallCmd Install  `yaml:"uninstall,omitempty"` // only used alongside InstallCmd
+	Target       string   `yaml:",omitempty"`          // mutually exclusive with Install
+	Depends      []string `yaml:"depends,omitempty"`   // installed before this package
+	Conflict     Conflict `yaml:"conflict,omitempty"`  // policy when a link target already exists
+	When         When     `yaml:"when,omitempty"`      // where the package applies, everywhere when empty
+	Mode         Mode     `yaml:"mode,omitempty"`      // how files are put at the target, symlinked by default
+	Vars         Vars     `yaml:"vars,omitempty"`      // for templates, over the vars of the config
+	Secrets      []string `yaml:"secrets,omitempty"`   // globs of files, relative to the package, only committed sealed
+	Facts        Facts    `yaml:"-"`                   // what templates are rendered with besides Vars
+	Recorded     []Link   `yaml:"-"`                   // links of the last install or update, to tell which side of a copy changed
+	BackupDir    string   `yaml:"-"`                   // where ConflictBackup moves files to
+	DryRun       bool     `yaml:"-"`                   // only plan, do not touch anything
+}
+
+// A single file or directory managed by a package. Source lives inside the
+// package directory and Target is the path created on the filesystem, a
+// symlink unless the mode says otherwise.
+type Link struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+	Mode   Mode   `yaml:"mode,omitempty"`
+	Sum    string `yaml:"sum,omitempty"` // sha256 of the contents written, when not a symlink
 }
 
-func (i Info) Install(wd string) error {
-	if strings.HasPrefix(i.Target, "~/") {
-		i.Target = path.Join(os.Getenv("HOME"), i.Target[2:])
+// Expand a leading ~/ to the user's home directory
+func ExpandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		return path.Join(os.Getenv("HOME"), p[2:])
 	}
+	return p
+}
 
-	all_files := false
-	target := i.Target
-	if strings.HasPrefix(i.Target, "all:") {
-		all_files = true
-		target = target[4:]
+// Get the links the package creates when installed from the package directory wd.
+// A target prefixed with `all:` links every top-level entry of the package into
+// the target, otherwise the package directory itself is linked into the target.
+// Templates are rendered and secrets decrypted rather than linked, so
+// directories holding them are split into the links of what is inside. Stow
+// packages mirror their tree under the target instead, see stowLinks.
+func (i Info) Links(wd string) ([]Link, error) {
+	if len(i.Target) == 0 {
+		return []Link{}, nil
 	}
-	if strings.HasPrefix(target, "~/") {
-		target = path.Join(os.Getenv("HOME"), target[2:])
+
+	if _, err := ParseMode(string(i.Mode)); err != nil {
+		return nil, err
 	}
 
-	fmt.Println(i.Target)
+	if i.InstallCmd.Stow {
+		return i.stowLinks(wd)
+	}
+
+	var links []Link
+	target := ExpandHome(i.Target)
+	if strings.HasPrefix(target, "all:") {
+		target = ExpandHome(target[4:])
 
-	// if we have a target, then symlink and shortcircuit the rest of the install
-	if all_files {
 		top_levels, err := filepath.Glob(filepath.Join(wd, "*"))
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
+		links = make([]Link, 0, len(top_levels))
 		for _, p := range top_levels {
-			target = path.Join(target, path.Base(p))
+			links = append(links, Link{Source: p, Target: path.Join(target, path.Base(p))})
+		}
+	} else {
+		links = []Link{{Source: wd, Target: path.Join(target, i.Name)}}
+	}
 
-			fmt.Printf("            --> %s\n", target)
-			if err := os.Symlink(p, target); err != nil {
-				log.Println(err)
-			}
+	expanded := make([]Link, 0, len(links))
+	for _, l := range links {
+		split, err := i.expand(l)
+		if err != nil {
+			return nil, err
 		}
+		expanded = append(expanded, split...)
+	}
 
-		return nil
-	} else if len(i.Target) > 0 {
-		target = path.Join(target, i.Name)
-		if err := os.Symlink(wd, target); err != nil {
-			log.Fatal(err)
+	return expanded, nil
+}
+
+// Split a link to a directory into the links of its entries when some of them
+// are templates (every file is, in template mode) or secrets, or when every
+// file is copied or hardlinked. Templates and secrets lose their suffix at the
+// target.
+func (i Info) expand(l Link) ([]Link, error) {
+	s, err := os.Stat(l.Source)
+	if os.IsNotExist(err) {
+		return []Link{l}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s.IsDir() == false {
+		if secret.IsSecret(l.Source) {
+			l.Mode = ModeSecret
+			l.Target = strings.TrimSuffix(l.Target, secret.Suffix)
+		} else if i.Mode == ModeTemplate || IsTemplate(l.Source) {
+			l.Mode = ModeTemplate
+			l.Target = strings.TrimSuffix(l.Target, TemplateSuffix)
+		} else {
+			l.Mode = i.Mode
 		}
-		return nil
+		return []Link{l}, nil
+	}
+
+	if i.Mode.perFile() == false && holdsWritten(l.Source) == false {
+		return []Link{l}, nil
+	}
+
+	entries, err := ioutil.ReadDir(l.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]Link, 0, len(entries))
+	for _, e := range entries {
+		split, err := i.expand(Link{Source: path.Join(l.Source, e.Name()), Target: path.Join(l.Target, e.Name())})
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, split...)
+	}
+
+	return links, nil
+}
+
+func (i Info) Install(wd string) (Record, error) {
+	rec := Record{DryRun: i.DryRun}
+	fmt.Println(ExpandHome(i.Target))
+
+	// if we have a target, then symlink and shortcircuit the rest of the install
+	if len(i.Target) > 0 {
+		policy, err := ParseConflict(string(i.Conflict))
+		if err != nil {
+			return rec, err
+		}
+
+		links, err := i.Links(wd)
+		if err != nil {
+			return rec, err
+		}
+
+		for _, l := range links {
+			fmt.Printf("            --> %s\n", l.Target)
+			if i.InstallCmd.Stow {
+				room, err := i.unfoldAbove(wd, l.Target, policy, &rec)
+				if err != nil {
+					return rec, err
+				} else if room == false {
+					continue
+				}
+			}
+			if err := i.link(l, policy, &rec); err != nil {
+				return rec, err
+			}
+		}
+
+		return rec, nil
 	}
 
 	// if we do not have a regular command, abort
 	if len(i.InstallCmd.Cmd) == 0 {
+		return rec, nil
+	}
+
+	err := i.InstallCmd.runAll(wd, &rec)
+	return rec, err
+}
+
+// Create a single link, resolving anything already at the target with the
+// given policy. A link that is already in place is left as is.
+func (i Info) link(l Link, policy Conflict, rec *Record) error {
+	var contents []byte
+	if l.Mode.written() {
+		written, err := i.contents(l)
+		if err != nil {
+			return err
+		}
+		contents = written
+		l.Sum = checksum(contents)
+	} else if l.Mode == ModeHardlink {
+		l.Sum = fileSum(l.Source)
+	}
+
+	if _, err := os.Lstat(l.Target); err != nil && os.IsNotExist(err) == false {
+		return err
+	} else if err == nil {
+		if i.placed(l) {
+			rec.Links = append(rec.Links, l)
+			return nil
+		}
+
+		if cleared, err := i.clear(l, policy, rec); err != nil || cleared == false {
+			return err
+		}
+
+		// the adopted file is the source now
+		if l.Mode.synced() && policy == ConflictAdopt && rec.DryRun == false {
+			if contents, err = ioutil.ReadFile(l.Source); err != nil {
+				return err
+			}
+			l.Sum = checksum(contents)
+		}
+	}
+
+	if rec.DryRun == false {
+		if err := place(l, contents); err != nil {
+			return err
+		}
+	}
+	rec.Links = append(rec.Links, l)
+
+	return nil
+}
+
+// Truthy function on whether the link's target is already what the link puts there
+func (i Info) placed(l Link) bool {
+	if l.Mode.written() {
+		return fileSum(l.Target) == l.Sum
+	} else if l.Mode == ModeHardlink {
+		return sameFile(l.Source, l.Target)
+	}
+
+	dest, err := os.Readlink(l.Target)
+	return err == nil && dest == l.Source
+}
+
+// Deal with something already at the link's target using the policy. Returns
+// false when the link is skipped.
+func (i Info) clear(l Link, policy Conflict, rec *Record) (bool, error) {
+	res := Resolution{Target: l.Target, Policy: policy}
+	switch policy {
+	case ConflictSkip:
+		rec.Conflicts = append(rec.Conflicts, res)
+		return false, nil
+
+	case ConflictBackup:
+		if len(i.BackupDir) == 0 {
+			return false, fmt.Errorf("cannot back up %s: no backup directory", l.Target)
+		}
+
+		res.Backup = path.Join(i.BackupDir, l.Target)
+		if rec.DryRun {
+			break
+		}
+		if err := os.MkdirAll(path.Dir(res.Backup), 0755); err != nil {
+			return false, fmt.Errorf("could not create backup directory: %s", err.Error())
+		}
+		if err := os.Rename(l.Target, res.Backup); err != nil {
+			return false, fmt.Errorf("could not back up %s: %s", l.Target, err.Error())
+		}
+
+	case ConflictOverwrite:
+		if rec.DryRun {
+			break
+		}
+		if err := os.RemoveAll(l.Target); err != nil {
+			return false, fmt.Errorf("could not overwrite %s: %s", l.Target, err.Error())
+		}
+
+	case ConflictAdopt:
+		if l.Mode == ModeTemplate || l.Mode == ModeSecret {
+			return false, fmt.Errorf("cannot adopt %s: it would replace the %s %s", l.Target, l.Mode, l.Source)
+		}
+		if rec.DryRun {
+			break
+		}
+		if err := adopt(l.Target, l.Source); err != nil {
+			return false, fmt.Errorf("could not adopt %s: %s", l.Target, err.Error())
+		}
+
+	default:
+		return false, fmt.Errorf("%s already exists", l.Target)
+	}
+
+	rec.Conflicts = append(rec.Conflicts, res)
+	return true, nil
+}
+
+// Put the link at its target, creating the directories above it. Contents are
+// written as a file when not a link, with the mode of the source or, for
+// secrets, readable by the user alone.
+func place(l Link, contents []byte) error {
+	if err := os.MkdirAll(path.Dir(l.Target), 0755); err != nil {
+		return err
+	}
+
+	switch l.Mode {
+	case ModeSecret:
+		return writeFile(l.Target, contents, 0600)
+	case ModeTemplate, ModeCopy:
+		s, err := os.Stat(l.Source)
+		if err != nil {
+			return err
+		}
+		return writeFile(l.Target, contents, s.Mode().Perm())
+	case ModeHardlink:
+		if err := os.Link(l.Source, l.Target); err != nil {
+			return fmt.Errorf("could not hardlink %s (across filesystems, use mode: copy): %s", l.Target, err.Error())
+		}
 		return nil
 	}
 
-	return i.InstallCmd.RunAll(wd)
+	return os.Symlink(l.Source, l.Target)
+}
+
+// Write the file, replacing whatever regular file is there
+func writeFile(p string, contents []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(p, contents, perm); err != nil {
+		return err
+	}
+	return os.Chmod(p, perm) // WriteFile keeps the mode of an existing file
+}
+
+// Reverse an install from the package directory wd. Only links that point back
+// into wd are removed, anything else found at a target is left untouched.
+// Command-based packages run their uninstall commands instead.
+func (i Info) Uninstall(wd string) (Record, error) {
+	rec := Record{DryRun: i.DryRun}
+	if len(i.Target) == 0 {
+		err := i.UninstallCmd.runAll(wd, &rec)
+		return rec, err
+	}
+
+	links, err := i.Links(wd)
+	if err != nil {
+		return rec, err
+	}
+
+	err = i.Unlink(wd, links, &rec)
+	return rec, err
+}
+
+// Remove the given links if, and only if, they resolve into the package
+// directory wd, or for templates if the file is as rendered. Removed links are
+// appended to the record.
+func (i Info) Unlink(wd string, links []Link, rec *Record) error {
+	for _, l := range links {
+		if _, err := os.Lstat(l.Target); os.IsNotExist(err) {
+			continue
+		}
+
+		owned, err := i.owns(l, wd)
+		if err != nil {
+			return err
+		}
+
+		if owned == false {
+			log.Printf("skipping %s: not linked into %s", l.Target, wd)
+			continue
+		}
+
+		fmt.Printf("            <-- %s\n", l.Target)
+		if rec.DryRun == false {
+			if err := os.Remove(l.Target); err != nil {
+				return fmt.Errorf("could not remove link %s: %s", l.Target, err.Error())
+			}
+			if i.InstallCmd.Stow {
+				if err := refoldAbove(i.stowRoot(), l.Target, path.Dir(wd)); err != nil {
+					return err
+				}
+			}
+		}
+		rec.Links = append(rec.Links, l)
+	}
+
+	return nil
 }
 
-func (i Info) Update(wd string) error {
+// Truthy function on whether the link's target was put there by the package
+// in wd. A written file is only the package's while it is unchanged.
+func (i Info) owns(l Link, wd string) (bool, error) {
+	if l.Mode == ModeHardlink {
+		return sameFile(l.Source, l.Target) || (len(l.Sum) > 0 && fileSum(l.Target) == l.Sum), nil
+	} else if l.Mode.written() == false {
+		return LinksInto(l.Target, wd)
+	}
+
+	sum := fileSum(l.Target)
+	if len(sum) == 0 {
+		return false, nil
+	} else if sum == l.Sum {
+		return true, nil
+	}
+
+	written, err := i.contents(l)
+	if err != nil {
+		return false, nil // the source may be gone, only the recorded sum counts
+	}
+	return sum == checksum(written), nil
+}
+
+//==================================================
+// Install health
+//==================================================
+
+// State of a single link target on the filesystem
+type LinkState string
+
+const (
+	LinkOk       LinkState = "ok"       // links into the package
+	LinkMissing  LinkState = "missing"  // nothing at the target
+	LinkDangling LinkState = "dangling" // a link to something that does not exist
+	LinkForeign  LinkState = "foreign"  // a link to somewhere outside the package
+	LinkBlocked  LinkState = "blocked"  // a regular file or directory is in the way
+	LinkDrifted  LinkState = "drifted"  // a written file that differs from its rendered or decrypted source
+)
+
+// Overall state of a package on the filesystem
+type Health string
+
+const (
+	HealthInstalled Health = "installed"     // every link is in place
+	HealthPartial   Health = "partial"       // some links are in place, others missing or blocked
+	HealthMissing   Health = "not installed" // no links are in place
+	HealthBroken    Health = "broken"        // dangling or foreign links at a target
+	HealthDrifted   Health = "drifted"       // everything is in place, but written files have changed
+	HealthUnknown   Health = "unknown"       // command based, nothing to check on disk
+)
+
+// A link along with what is currently at its target
+type LinkStatus struct {
+	Link
+	State LinkState
+}
+
+// Get the state of whatever is at the link's target
+func (i Info) checkLink(l Link, wd string) (LinkState, error) {
+	s, err := os.Lstat(l.Target)
+	if os.IsNotExist(err) {
+		return LinkMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if l.Mode.written() {
+		if s.Mode().IsRegular() == false {
+			return LinkBlocked, nil
+		}
+
+		// without a key secrets cannot be compared, being there has to do
+		if l.Mode == ModeSecret && i.Facts.Unlock == nil {
+			return LinkOk, nil
+		}
+
+		written, err := i.contents(l)
+		if err != nil {
+			return "", err
+		} else if fileSum(l.Target) != checksum(written) {
+			return LinkDrifted, nil
+		}
+		return LinkOk, nil
+	}
+
+	if l.Mode == ModeHardlink {
+		if s.Mode().IsRegular() == false {
+			return LinkBlocked, nil
+		} else if sameFile(l.Source, l.Target) == false {
+			return LinkDrifted, nil // replaced by a file of its own
+		}
+		return LinkOk, nil
+	}
+
+	if s.Mode()&os.ModeSymlink == 0 {
+		return LinkBlocked, nil
+	}
+
+	if _, err := os.Stat(l.Target); err != nil {
+		return LinkDangling, nil
+	}
+
+	owned, err := LinksInto(l.Target, wd)
+	if err != nil {
+		return "", err
+	} else if owned == false {
+		return LinkForeign, nil
+	}
+
+	return LinkOk, nil
+}
+
+// Check how much of the package, installed from the package directory wd, is in
+// place. Links recorded by an earlier install are checked along with the links
+// the package currently defines.
+func (i Info) Check(wd string, recorded []Link) (Health, []LinkStatus, error) {
+	if len(i.Target) == 0 {
+		return HealthUnknown, []LinkStatus{}, nil
+	}
+
+	links, err := i.Links(wd)
+	if err != nil {
+		return "", nil, err
+	}
+
+	seen := make(map[string]bool)
+	statuses := make([]LinkStatus, 0, len(links)+len(recorded))
+	counts := make(map[LinkState]int)
+	for n, l := range append(links, recorded...) {
+		if seen[l.Target] {
+			continue
+		}
+		seen[l.Target] = true
+
+		state, err := i.checkLink(l, wd)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// links from an old install that are gone now are not part of the package anymore
+		if state == LinkMissing && n >= len(links) {
+			continue
+		}
+
+		// nor are directories stowed since unfolded, their entries are checked instead
+		if state == LinkBlocked && n >= len(links) && i.InstallCmd.Stow && unfoldedInto(l, links) {
+			continue
+		}
+
+		// nor entries of a directory since folded back into a link, checked in their place
+		if n >= len(links) && i.InstallCmd.Stow && foldedAbove(i.stowRoot(), l, wd) {
+			continue
+		}
+
+		counts[state] += 1
+		statuses = append(statuses, LinkStatus{Link: l, State: state})
+	}
+
+	health := HealthPartial
+	if counts[LinkDangling] > 0 || counts[LinkForeign] > 0 {
+		health = HealthBroken
+	} else if counts[LinkOk] == len(statuses) {
+		health = HealthInstalled
+	} else if counts[LinkOk]+counts[LinkDrifted] == len(statuses) {
+		health = HealthDrifted
+	} else if counts[LinkOk] == 0 && counts[LinkDrifted] == 0 {
+		health = HealthMissing
+	}
+
+	return health, statuses, nil
+}
+
+// Truthy function on whether the file at p is a symlink resolving to dir or
+// something inside of it. A missing file is not an error.
+func LinksInto(p, dir string) (bool, error) {
+	s, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if s.Mode()&os.ModeSymlink == 0 {
+		return false, nil
+	}
+
+	dest, err := os.Readlink(p)
+	if err != nil {
+		return false, err
+	}
+
+	if filepath.IsAbs(dest) == false {
+		dest = filepath.Join(filepath.Dir(p), dest)
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(dest))
+	if err != nil {
+		return false, nil
+	}
+
+	return rel != ".." && strings.HasPrefix(rel, "../") == false, nil
+}
+
+func (i Info) Update(wd string) (Record, error) {
+	rec := Record{DryRun: i.DryRun}
+
 	// save current dir and defer popping
 	pushd, err := os.Getwd()
 	if err != nil {
@@ -271,8 +963,28 @@ func (i Info) Update(wd string) error {
 
 	// move into the package directory
 	if err := os.Chdir(wd); err != nil {
-		return err
+		return rec, err
+	}
+
+	// written files follow their sources the way links follow the repo,
+	// copies also bring changes made at the target back
+	links, err := i.Links(wd)
+	if err != nil {
+		return rec, err
+	}
+	for _, l := range links {
+		switch {
+		case l.Mode.synced():
+			if err := i.sync(l, &rec); err != nil {
+				return rec, err
+			}
+		case l.Mode.written():
+			if err := i.rerender(l, &rec); err != nil {
+				return rec, err
+			}
+		}
 	}
 
-	return i.UpdateCmd.RunAll(wd)
+	err = i.UpdateCmd.runAll(wd, &rec)
+	return rec, err
 }
@@ -95,6 +95,27 @@ func make_dir(prefix string, t *testing.T) string {
 	return dir
 }
 
+// Make a package and a target directory side by side in a new temp dir, the
+// package holding the files (path in the package: contents) with the given
+// permissions
+func package_fixture(files map[string]string, perm os.FileMode, t *testing.T) (dir, pkg_dir, target string) {
+	dir = mktemp(t)
+	pkg_dir = make_dir(dir, t)
+	target = make_dir(dir, t)
+
+	for f, contents := range files {
+		p := path.Join(pkg_dir, f)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return
+}
+
 func expect_file(p, err_str string, t *testing.T) {
 	if _, err := os.Stat(p); err != nil {
 		t.Errorf(err_str)
@@ -204,3 +225,381 @@ func TestUpdate_RunAll_NoCmd(t *testing.T) {
 		t.Fatalf("did not make test-script executable")
 	}
 }
+
+//==================================================
+// uninstall tests
+//==================================================
+
+func TestInfo_Uninstall_RemovesLink(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+
+	info := Info{Name: "pkg", Target: target}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_file(path.Join(target, "pkg"), "did not install link", t)
+
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(path.Join(target, "pkg"), "did not remove link", t)
+}
+
+func TestInfo_Uninstall_AllFiles(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+	for _, f := range []string{".bashrc", ".profile"} {
+		if err := ioutil.WriteFile(path.Join(pkg_dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info := Info{Name: "pkg", Target: "all:" + target}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_file(path.Join(target, ".bashrc"), "did not install .bashrc", t)
+	expect_file(path.Join(target, ".profile"), "did not install .profile", t)
+
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(path.Join(target, ".bashrc"), "did not remove .bashrc", t)
+	expect_no_file(path.Join(target, ".profile"), "did not remove .profile", t)
+}
+
+func TestInfo_Uninstall_LeavesForeignLink(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	other := make_dir(dir, t)
+	target := make_dir(dir, t)
+
+	if err := os.Symlink(other, path.Join(target, "pkg")); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{Name: "pkg", Target: target}
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_file(path.Join(target, "pkg"), "removed a link not owned by the package", t)
+}
+
+func TestInfo_Uninstall_RunsCommand(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	info := Info{
+		Name:         "pkg",
+		InstallCmd:   Install{Cmd: "touch installed.txt"},
+		UninstallCmd: Install{Cmd: "touch uninstalled.txt"},
+	}
+	if _, err := info.Uninstall(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expect_no_file(path.Join(dir, "installed.txt"), "ran install command", t)
+	expect_file(path.Join(dir, "uninstalled.txt"), "did not run uninstall command", t)
+}
+
+//==================================================
+// conflict tests
+//==================================================
+
+// make a package with a single .rc file and a target already holding its own .rc
+func conflict_setup(t *testing.T) (dir, pkg_dir, target string) {
+	dir, pkg_dir, target = package_fixture(map[string]string{".rc": "package"}, 0644, t)
+	if err := ioutil.WriteFile(path.Join(target, ".rc"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func expect_contents(p, expect string, t *testing.T) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != expect {
+		t.Errorf("expected '%s' in %s, got '%s'", expect, p, string(b))
+	}
+}
+
+func TestInfo_Install_ConflictFail(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	info := Info{Name: "pkg", Target: "all:" + target}
+	if _, err := info.Install(pkg_dir); err == nil {
+		t.Fatal("expected install to fail on an existing file")
+	}
+
+	expect_contents(path.Join(target, ".rc"), "existing", t)
+}
+
+func TestInfo_Install_ConflictSkip(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	info := Info{Name: "pkg", Target: "all:" + target, Conflict: ConflictSkip}
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(target, ".rc"), "existing", t)
+	if len(rec.Links) != 0 || len(rec.Conflicts) != 1 {
+		t.Errorf("expected 0 links and 1 conflict, got %d and %d", len(rec.Links), len(rec.Conflicts))
+	}
+}
+
+func TestInfo_Install_ConflictBackup(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	backup := path.Join(dir, "backup")
+	info := Info{Name: "pkg", Target: "all:" + target, Conflict: ConflictBackup, BackupDir: backup}
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(target, ".rc"), "package", t)
+	expect_contents(path.Join(backup, target, ".rc"), "existing", t)
+	if len(rec.Conflicts) != 1 || rec.Conflicts[0].Backup != path.Join(backup, target, ".rc") {
+		t.Errorf("backup not recorded: %v", rec.Conflicts)
+	}
+}
+
+func TestInfo_Install_ConflictOverwrite(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	info := Info{Name: "pkg", Target: "all:" + target, Conflict: ConflictOverwrite}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(target, ".rc"), "package", t)
+}
+
+func TestInfo_Install_ConflictAdopt(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	info := Info{Name: "pkg", Target: "all:" + target, Conflict: ConflictAdopt}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(pkg_dir, ".rc"), "existing", t)
+	expect_contents(path.Join(target, ".rc"), "existing", t)
+}
+
+func TestInfo_Install_ConflictAdoptDirectory(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+	if err := os.Mkdir(path.Join(target, "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(target, "pkg", "local"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{Name: "pkg", Target: target, Conflict: ConflictAdopt}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(pkg_dir, "local"), "local", t)
+	expect_contents(path.Join(target, "pkg", "local"), "local", t)
+}
+
+func TestInfo_Install_AlreadyLinked(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+
+	info := Info{Name: "pkg", Target: target}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatalf("reinstalling over our own link failed: %s", err.Error())
+	}
+	if len(rec.Links) != 1 || len(rec.Conflicts) != 0 {
+		t.Errorf("expected the existing link to be kept, got %v", rec)
+	}
+}
+
+func TestParseConflict(t *testing.T) {
+	if c, err := ParseConflict(""); err != nil || c != ConflictFail {
+		t.Errorf("expected empty policy to default to fail")
+	}
+
+	if _, err := ParseConflict("explode"); err == nil {
+		t.Errorf("expected an unknown policy to be rejected")
+	}
+}
+
+//==================================================
+// dry run tests
+//==================================================
+
+func TestInfo_Install_DryRun(t *testing.T) {
+	dir, pkg_dir, target := conflict_setup(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(pkg_dir, ".new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{Name: "pkg", Target: "all:" + target, Conflict: ConflictOverwrite, DryRun: true}
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_contents(path.Join(target, ".rc"), "existing", t)
+	expect_no_file(path.Join(target, ".new"), "dry run created a link", t)
+
+	if len(rec.Links) != 2 || len(rec.Conflicts) != 1 {
+		t.Errorf("expected 2 planned links and 1 conflict, got %d and %d", len(rec.Links), len(rec.Conflicts))
+	}
+}
+
+func TestInfo_Update_DryRun(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/bash"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{
+		Name:      "pkg",
+		UpdateCmd: Update{Once: "touch once.txt", File: "chmod +x $HEARTH_FILE"},
+		DryRun:    true,
+	}
+	rec, err := info.Update(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect_no_file(path.Join(dir, "once.txt"), "dry run ran the once command", t)
+	if len(rec.Commands) != 2 {
+		t.Fatalf("expected 2 planned commands, got %d", len(rec.Commands))
+	}
+
+	file_cmd := rec.Commands[1]
+	if file_cmd.File != script || file_cmd.Cmd != "chmod +x "+script {
+		t.Errorf("file command not resolved: %v", file_cmd)
+	}
+}
+
+//==================================================
+// health tests
+//==================================================
+
+func TestInfo_Check(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+	for _, f := range []string{".a", ".b"} {
+		if err := ioutil.WriteFile(path.Join(pkg_dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info := Info{Name: "pkg", Target: "all:" + target}
+	expect_health := func(expect Health) {
+		health, _, err := info.Check(pkg_dir, []Link{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if health != expect {
+			t.Fatalf("expected '%s', got '%s'", expect, health)
+		}
+	}
+
+	expect_health(HealthMissing)
+
+	if err := os.Symlink(path.Join(pkg_dir, ".a"), path.Join(target, ".a")); err != nil {
+		t.Fatal(err)
+	}
+	expect_health(HealthPartial)
+
+	if err := os.Symlink(path.Join(pkg_dir, ".b"), path.Join(target, ".b")); err != nil {
+		t.Fatal(err)
+	}
+	expect_health(HealthInstalled)
+
+	if err := os.Remove(path.Join(pkg_dir, ".b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(pkg_dir, ".c"), []byte(".c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(dir, "elsewhere"), path.Join(target, ".c")); err != nil {
+		t.Fatal(err)
+	}
+
+	health, statuses, err := info.Check(pkg_dir, []Link{{Source: path.Join(pkg_dir, ".b"), Target: path.Join(target, ".b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthBroken {
+		t.Fatalf("expected broken, got '%s'", health)
+	}
+
+	states := make(map[string]LinkState)
+	for _, s := range statuses {
+		states[path.Base(s.Target)] = s.State
+	}
+	if states[".a"] != LinkOk || states[".b"] != LinkDangling || states[".c"] != LinkDangling {
+		t.Errorf("wrong link states: %v", states)
+	}
+}
+
+func TestInfo_Check_Foreign(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	pkg_dir := make_dir(dir, t)
+	other := make_dir(dir, t)
+	target := make_dir(dir, t)
+	if err := os.Symlink(other, path.Join(target, "pkg")); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{Name: "pkg", Target: target}
+	health, statuses, err := info.Check(pkg_dir, []Link{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if health != HealthBroken || statuses[0].State != LinkForeign {
+		t.Fatalf("expected a broken package with a foreign link, got '%s' %v", health, statuses)
+	}
+}
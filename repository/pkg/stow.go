@@ -0,0 +1,357 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//==================================================
+// Stow
+//==================================================
+
+// File at the root of a package listing what is not stowed, one regular
+// expression per line as with GNU stow
+const StowIgnoreName = ".stow-local-ignore"
+
+// What GNU stow ignores when a package has no ignore file
+var DefaultStowIgnore = []string{
+	`RCS`, `.+,v`, `CVS`, `\.\#.+`, `\.cvsignore`, `\.svn`, `_darcs`, `\.hg`,
+	`\.git`, `\.gitignore`, `\.gitmodules`, `.+~`, `\#.*\#`,
+	`^/README.*`, `^/LICENSE.*`, `^/COPYING`,
+}
+
+// Entries of a package left out of the stow. An expression holding a / is
+// matched against the path in the package with a leading /, any other against
+// the base name as a whole.
+type stowIgnore struct {
+	base  []*regexp.Regexp
+	paths []*regexp.Regexp
+}
+
+// Read the ignore file of the package in wd, or the defaults when it has none
+func readStowIgnore(wd string) (stowIgnore, error) {
+	var ignore stowIgnore
+	patterns := DefaultStowIgnore
+
+	f, err := os.Open(path.Join(wd, StowIgnoreName))
+	if err == nil {
+		defer f.Close()
+
+		patterns = make([]string, 0)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) > 0 && strings.HasPrefix(line, "#") == false {
+				patterns = append(patterns, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return ignore, err
+		}
+	} else if os.IsNotExist(err) == false {
+		return ignore, err
+	}
+
+	for _, p := range patterns {
+		if strings.Contains(p, "/") {
+			re, err := regexp.Compile("(?:" + p + ")$")
+			if err != nil {
+				return ignore, fmt.Errorf("invalid pattern in %s: %s", StowIgnoreName, err.Error())
+			}
+			ignore.paths = append(ignore.paths, re)
+			continue
+		}
+
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return ignore, fmt.Errorf("invalid pattern in %s: %s", StowIgnoreName, err.Error())
+		}
+		ignore.base = append(ignore.base, re)
+	}
+
+	return ignore, nil
+}
+
+// Truthy function on whether the entry, relative to the package, is not stowed
+func (s stowIgnore) matches(rel string) bool {
+	if rel == StowIgnoreName {
+		return true
+	}
+
+	for _, re := range s.base {
+		if re.MatchString(path.Base(rel)) {
+			return true
+		}
+	}
+	for _, re := range s.paths {
+		if re.MatchString("/" + rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the directory the package is mirrored into
+func (i Info) stowRoot() string {
+	return ExpandHome(strings.TrimPrefix(ExpandHome(i.Target), "all:"))
+}
+
+// Get the links that mirror the package in wd under the target. Every
+// directory is folded into a single link, unless there is a directory at its
+// target already (or a link to another package's directory, unfolded on
+// install) or it holds files that are not symlinked.
+func (i Info) stowLinks(wd string) ([]Link, error) {
+	ignore, err := readStowIgnore(wd)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.stowDir(wd, i.stowRoot(), "", path.Dir(wd), ignore)
+}
+
+func (i Info) stowDir(src, dst, rel, repo string, ignore stowIgnore) ([]Link, error) {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]Link, 0, len(entries))
+	for _, e := range entries {
+		entry_rel := path.Join(rel, e.Name())
+		if ignore.matches(entry_rel) {
+			continue
+		}
+
+		l := Link{Source: path.Join(src, e.Name()), Target: path.Join(dst, e.Name())}
+		if e.IsDir() && (i.Mode.perFile() || holdsWritten(l.Source) || sharedDir(l, repo)) {
+			inner, err := i.stowDir(l.Source, l.Target, entry_rel, repo, ignore)
+			if err != nil {
+				return nil, err
+			}
+			links = append(links, inner...)
+			continue
+		}
+
+		split, err := i.expand(l)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, split...)
+	}
+
+	return links, nil
+}
+
+// Truthy function on whether there is a directory at the target of the link
+// to a directory, other than the link itself, that its entries must go into.
+// A link there only counts when it is into the repository, to another package.
+func sharedDir(l Link, repo string) bool {
+	s, err := os.Lstat(l.Target)
+	if err != nil {
+		return false
+	}
+
+	if s.Mode()&os.ModeSymlink != 0 {
+		if dest, err := os.Readlink(l.Target); err == nil && dest == l.Source {
+			return false // folded already
+		}
+		if owned, err := LinksInto(l.Target, repo); err != nil || owned == false {
+			return false // the user's, in the way of the link
+		}
+		s, err = os.Stat(l.Target)
+		if err != nil {
+			return false
+		}
+	}
+
+	return s.IsDir()
+}
+
+// Make every directory between the stow root and the target of the package in
+// wd a real one, unfolding those that are links to another package's directory.
+// Links to anywhere else are dealt with using the policy. Returns false when one
+// is left in the way.
+func (i Info) unfoldAbove(wd, target string, policy Conflict, rec *Record) (bool, error) {
+	root := i.stowRoot()
+	dirs := make([]string, 0)
+	for dir := path.Dir(target); strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+
+	// from the root down
+	for n := len(dirs) - 1; n >= 0; n-- {
+		s, err := os.Lstat(dirs[n])
+		if os.IsNotExist(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		} else if s.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		owned, err := LinksInto(dirs[n], path.Dir(wd))
+		if err != nil {
+			return false, err
+		} else if owned {
+			if err := unfold(dirs[n], rec); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		// every link below meets the same one, it is only dealt with once
+		for _, res := range rec.Conflicts {
+			if res.Target == dirs[n] {
+				return res.Policy != ConflictSkip, nil
+			}
+		}
+		source := path.Join(wd, strings.TrimPrefix(dirs[n], root+"/"))
+		return i.clear(Link{Source: source, Target: dirs[n]}, policy, rec)
+	}
+
+	return true, nil
+}
+
+// Replace the link to a directory with a directory of links to its entries
+func unfold(dir string, rec *Record) error {
+	dest, err := os.Readlink(dir)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(dest) == false {
+		dest = filepath.Join(filepath.Dir(dir), dest)
+	}
+
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return fmt.Errorf("cannot unfold %s: %s", dir, err.Error())
+	}
+
+	rec.Unfolded = append(rec.Unfolded, dir)
+	if rec.DryRun {
+		return nil
+	}
+
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Symlink(path.Join(dest, e.Name()), path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tidy the directories above a removed link up to the root: those left empty
+// are removed, and those left holding only links into a single directory of the
+// repository are folded back into a link to it
+func refoldAbove(root, target, repo string) error {
+	for dir := path.Dir(target); strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		s, err := os.Lstat(dir)
+		if err != nil || s.IsDir() == false {
+			return nil
+		}
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		into, ok := foldable(dir, entries, repo)
+		if ok == false {
+			return nil
+		}
+
+		for _, e := range entries {
+			if err := os.Remove(path.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+		if err := os.Symlink(into, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the directory of the repository every entry links into under the same
+// name, when they all do
+func foldable(dir string, entries []os.FileInfo, repo string) (string, bool) {
+	into := ""
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink == 0 {
+			return "", false
+		}
+
+		dest, err := os.Readlink(path.Join(dir, e.Name()))
+		if err != nil || filepath.IsAbs(dest) == false || path.Base(dest) != e.Name() {
+			return "", false
+		}
+
+		if len(into) == 0 {
+			into = path.Dir(dest)
+		} else if path.Dir(dest) != into {
+			return "", false
+		}
+	}
+
+	if s, err := os.Stat(into); err != nil || s.IsDir() == false {
+		return "", false
+	}
+
+	// links of the user's own, into anywhere else, are left as they are
+	if owned, err := LinksInto(path.Join(dir, entries[0].Name()), repo); err != nil || owned == false {
+		return "", false
+	}
+	return into, true
+}
+
+// Truthy function on whether the recorded link is to a directory that has since
+// been unfolded to make room for another package, its entries among the links
+func unfoldedInto(l Link, links []Link) bool {
+	if s, err := os.Lstat(l.Target); err != nil || s.IsDir() == false {
+		return false
+	}
+
+	for _, inner := range links {
+		if strings.HasPrefix(inner.Target, l.Target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Truthy function on whether the recorded link is reached through a directory
+// since folded back into a link to the package in wd, which stands for it now
+func foldedAbove(root string, l Link, wd string) bool {
+	for dir := path.Dir(l.Target); strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		if s, err := os.Lstat(dir); err == nil && s.Mode()&os.ModeSymlink != 0 {
+			owned, err := LinksInto(dir, wd)
+			return err == nil && owned
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+//==================================================
+// stow tests
+//==================================================
+
+// Create a package directory holding the given files
+func stow_package(dir string, files []string, t *testing.T) string {
+	pkg_dir := make_dir(dir, t)
+	for _, f := range files {
+		p := path.Join(pkg_dir, f)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pkg_dir
+}
+
+func expect_link(p, dest string, t *testing.T) {
+	if got, err := os.Readlink(p); err != nil || got != dest {
+		t.Errorf("expected %s to link to %s, got '%s' (%v)", p, dest, got, err)
+	}
+}
+
+func TestInfo_Stow_FoldAndUnfold(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+	target := make_dir(dir, t)
+
+	vim_dir := stow_package(dir, []string{".vimrc", ".config/nvim/init.vim", "README.md"}, t)
+	git_dir := stow_package(dir, []string{".config/git/config"}, t)
+	vim := Info{Name: "vim", Target: target, InstallCmd: Install{Stow: true}}
+	git := Info{Name: "git", Target: target, InstallCmd: Install{Stow: true}}
+
+	// nothing there yet, so whole directories are linked
+	vim_rec, err := vim.Install(vim_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect_link(path.Join(target, ".config"), path.Join(vim_dir, ".config"), t)
+	expect_link(path.Join(target, ".vimrc"), path.Join(vim_dir, ".vimrc"), t)
+	expect_no_file(path.Join(target, "README.md"), "expected README.md to be ignored", t)
+
+	// sharing .config unfolds it
+	rec, err := git.Install(git_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Unfolded) != 1 || rec.Unfolded[0] != path.Join(target, ".config") {
+		t.Errorf("expected .config to be unfolded: %+v", rec)
+	}
+	if s, err := os.Lstat(path.Join(target, ".config")); err != nil || s.IsDir() == false {
+		t.Fatalf("expected .config to be a directory")
+	}
+	expect_link(path.Join(target, ".config/nvim"), path.Join(vim_dir, ".config/nvim"), t)
+	expect_link(path.Join(target, ".config/git"), path.Join(git_dir, ".config/git"), t)
+
+	health, statuses, err := vim.Check(vim_dir, vim_rec.Links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthInstalled {
+		t.Errorf("expected vim to still be installed, got '%s': %+v", health, statuses)
+	}
+
+	// once no longer shared, it is folded back
+	if _, err := git.Uninstall(git_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_link(path.Join(target, ".config"), path.Join(vim_dir, ".config"), t)
+
+	if _, err := vim.Uninstall(vim_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(path.Join(target, ".config"), "expected .config to be removed", t)
+	expect_no_file(path.Join(target, ".vimrc"), "expected .vimrc to be removed", t)
+
+	// folded into the package that is left, its entries stay installed
+	if _, err := vim.Install(vim_dir); err != nil {
+		t.Fatal(err)
+	}
+	git_rec, err := git.Install(git_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vim.Uninstall(vim_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_link(path.Join(target, ".config"), path.Join(git_dir, ".config"), t)
+
+	health, statuses, err = git.Check(git_dir, git_rec.Links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthInstalled {
+		t.Errorf("expected git to still be installed, got '%s': %+v", health, statuses)
+	}
+}
+
+func TestInfo_Stow_LocalIgnore(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+	target := make_dir(dir, t)
+
+	pkg_dir := stow_package(dir, []string{".zshrc", ".zsh/plugins.zsh", ".zsh/cache.zwc", "docs/notes.md", "README.md"}, t)
+	ignore := "# local only\n.+\\.zwc\n^/docs\n"
+	if err := ioutil.WriteFile(path.Join(pkg_dir, StowIgnoreName), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory already at the target is never replaced by a link
+	if err := os.Mkdir(path.Join(target, ".zsh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{Name: "zsh", Target: target, InstallCmd: Install{Stow: true}}
+	links, err := info.Links(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		path.Join(target, ".zshrc"):           true,
+		path.Join(target, ".zsh/plugins.zsh"): true,
+		path.Join(target, "README.md"):        true, // the defaults are replaced by the ignore file
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("wrong links: %+v", links)
+	}
+	for _, l := range links {
+		if expected[l.Target] == false {
+			t.Errorf("unexpected link %s", l.Target)
+		}
+	}
+}
+
+func TestInfo_Stow_ForeignDirectoryLink(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+	target := make_dir(dir, t)
+	foreign := mktemp(t)
+	defer os.RemoveAll(foreign)
+
+	// the user's own link, out of the repository, is not unfolded
+	if err := ioutil.WriteFile(path.Join(foreign, "settings"), []byte("mine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(foreign, path.Join(target, ".config")); err != nil {
+		t.Fatal(err)
+	}
+
+	vim_dir := stow_package(dir, []string{".config/nvim/init.vim"}, t)
+	vim := Info{Name: "vim", Target: target, InstallCmd: Install{Stow: true}}
+	if _, err := vim.Install(vim_dir); err == nil {
+		t.Errorf("expected the install to stop at the existing link")
+	}
+	expect_link(path.Join(target, ".config"), foreign, t)
+	expect_no_file(path.Join(foreign, "nvim"), "expected nothing to be linked into the user's directory", t)
+
+	// files placed one by one meet it above them, and are skipped along with it
+	copied := Info{Name: "vim", Target: target, Mode: ModeCopy, Conflict: ConflictSkip, InstallCmd: Install{Stow: true}}
+	rec, err := copied.Install(vim_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Conflicts) != 1 || rec.Conflicts[0].Target != path.Join(target, ".config") {
+		t.Errorf("expected .config to be skipped once, got: %+v", rec.Conflicts)
+	}
+	if len(rec.Unfolded) != 0 || len(rec.Links) != 0 {
+		t.Errorf("expected nothing unfolded nor placed: %+v", rec)
+	}
+	expect_no_file(path.Join(foreign, "nvim"), "expected nothing to be copied into the user's directory", t)
+
+	vim.Conflict = ConflictBackup
+	vim.BackupDir = make_dir(dir, t)
+	rec, err = vim.Install(vim_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Conflicts) != 1 {
+		t.Fatalf("expected the link to be backed up, got: %+v", rec.Conflicts)
+	}
+	expect_link(rec.Conflicts[0].Backup, foreign, t)
+	expect_link(path.Join(target, ".config"), path.Join(vim_dir, ".config"), t)
+	expect_file(path.Join(foreign, "settings"), "expected the user's directory to be left", t)
+}
+
+func TestInfo_Stow_KeepsForeignLinksUnfolded(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+	target := make_dir(dir, t)
+	foreign := mktemp(t)
+	defer os.RemoveAll(foreign)
+
+	// the user's own bin, holding a link out of the repository
+	if err := ioutil.WriteFile(path.Join(foreign, "tool"), []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(target, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(foreign, "tool"), path.Join(target, "bin/tool")); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg_dir := stow_package(dir, []string{"bin/script"}, t)
+	info := Info{Name: "scripts", Target: target, InstallCmd: Install{Stow: true}}
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_link(path.Join(target, "bin/script"), path.Join(pkg_dir, "bin/script"), t)
+
+	// what is left only links elsewhere, so it is not folded
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := os.Lstat(path.Join(target, "bin")); err != nil || s.IsDir() == false {
+		t.Fatalf("expected bin to be left a directory")
+	}
+	expect_link(path.Join(target, "bin/tool"), path.Join(foreign, "tool"), t)
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/zmarcantel/hearth/secret"
+)
+
+//==================================================
+// Templates
+//==================================================
+
+// Files ending in this are rendered in any mode, and written without it
+const TemplateSuffix = ".tmpl"
+
+// Truthy function on whether the file is a template outside of template mode
+func IsTemplate(p string) bool {
+	return strings.HasSuffix(p, TemplateSuffix)
+}
+
+// Truthy function on whether a template or secret is anywhere under the directory
+func holdsWritten(dir string) bool {
+	found := fmt.Errorf("template found") // stops the walk
+	err := filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err == nil && i.IsDir() == false && (IsTemplate(p) || secret.IsSecret(p)) {
+			return found
+		}
+		return nil
+	})
+
+	return err == found
+}
+
+// Values for templates, set in the config
+type Vars map[string]interface{}
+
+// What templates are rendered and secrets decrypted with besides the
+// package's vars, filled in by the caller
+type Facts struct {
+	Environment string                     // the environment (branch) checked out
+	Vars        Vars                       // vars of the whole config, the package's own take priority
+	Unlock      func() (secret.Key, error) // get the key for secrets, only called when one is met
+}
+
+// Everything a template can use, e.g. {{ .Vars.email }}, {{ .Env.USER }} or
+// {{ .Host.Hostname }}
+type templateData struct {
+	Package     string
+	Environment string
+	Vars        Vars
+	Env         map[string]string
+	Host        hostFacts
+}
+
+type hostFacts struct {
+	Hostname string
+	OS       string
+	Arch     string
+	User     string
+	Home     string
+}
+
+func (i Info) templateData() templateData {
+	data := templateData{
+		Package:     i.Name,
+		Environment: i.Facts.Environment,
+		Vars:        make(Vars),
+		Env:         make(map[string]string),
+		Host: hostFacts{
+			OS:   runtime.GOOS,
+			Arch: runtime.GOARCH,
+			Home: os.Getenv("HOME"),
+		},
+	}
+
+	for k, v := range i.Facts.Vars {
+		data.Vars[k] = v
+	}
+	for k, v := range i.Vars {
+		data.Vars[k] = v
+	}
+
+	for _, kv := range os.Environ() {
+		if eq := strings.Index(kv, "="); eq > 0 {
+			data.Env[kv[:eq]] = kv[eq+1:]
+		}
+	}
+
+	data.Host.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		data.Host.User = u.Username
+	}
+
+	return data
+}
+
+// Render the template file with Go's text/template. Using a var or variable
+// that is not set is an error.
+func (i Info) Render(p string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(filepath.Base(p)).Option("missingkey=error").Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse template %s: %s", p, err.Error())
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, i.templateData()); err != nil {
+		return nil, fmt.Errorf("could not render %s: %s", p, err.Error())
+	}
+
+	return out.Bytes(), nil
+}
+
+// Get what a link that is written, rather than linked, puts at its target
+func (i Info) contents(l Link) ([]byte, error) {
+	if l.Mode == ModeCopy {
+		return ioutil.ReadFile(l.Source)
+	} else if l.Mode != ModeSecret {
+		return i.Render(l.Source)
+	}
+
+	if i.Facts.Unlock == nil {
+		return nil, fmt.Errorf("no key to decrypt %s with", l.Source)
+	}
+
+	key, err := i.Facts.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return secret.OpenFile(key, l.Source)
+}
+
+// Write the link's contents over its target again, unless it is already as
+// written. A file changed at the target since it was last written, or with no
+// record to tell, is dealt with using the conflict policy as on install.
+func (i Info) rerender(l Link, rec *Record) error {
+	rendered, err := i.contents(l)
+	if err != nil {
+		return err
+	}
+	l.Sum = checksum(rendered)
+
+	s, err := os.Lstat(l.Target)
+	if err == nil && s.Mode().IsRegular() == false {
+		return fmt.Errorf("cannot write %s: something other than a file is in the way", l.Target)
+	} else if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	if current := fileSum(l.Target); err == nil && current != l.Sum && current != i.recordedSum(l) {
+		policy, err := ParseConflict(string(i.Conflict))
+		if err != nil {
+			return err
+		}
+		if cleared, err := i.clear(l, policy, rec); err != nil || cleared == false {
+			return err
+		}
+	}
+
+	if i.placed(l) == false && rec.DryRun == false {
+		if err := place(l, rendered); err != nil {
+			return err
+		}
+	}
+	rec.Links = append(rec.Links, l)
+
+	return nil
+}
+
+func checksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get the checksum of the file's contents, empty when it cannot be read
+func fileSum(p string) string {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	return checksum(contents)
+}
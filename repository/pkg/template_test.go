@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/zmarcantel/hearth/secret"
+)
+
+//==================================================
+// template tests
+//==================================================
+
+// A package with a plain file and a template nested in a directory
+func template_package(t *testing.T) (string, string, string, Info) {
+	dir, pkg_dir, target := package_fixture(map[string]string{
+		".vimrc":           "set nocompatible\n",
+		".ssh/config.tmpl": "User {{ .Vars.user }}\nHost {{ .Environment }}\n",
+		".ssh/known_hosts": "",
+		".gitconfig.tmpl":  "email = {{ .Vars.email }}\n",
+	}, 0600, t)
+
+	info := Info{
+		Name:   "pkg",
+		Target: "all:" + target,
+		Vars:   Vars{"email": "me@work"},
+		Facts:  Facts{Environment: "work", Vars: Vars{"user": "me", "email": "me@home"}},
+	}
+	return dir, pkg_dir, target, info
+}
+
+func TestInfo_Links_Templates(t *testing.T) {
+	dir, pkg_dir, target, info := template_package(t)
+	defer os.RemoveAll(dir)
+
+	links, err := info.Links(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modes := make(map[string]Mode)
+	for _, l := range links {
+		modes[l.Target] = l.Mode
+	}
+
+	expected := map[string]Mode{
+		path.Join(target, ".vimrc"):           ModeLink,
+		path.Join(target, ".gitconfig"):       ModeTemplate,
+		path.Join(target, ".ssh/config"):      ModeTemplate,
+		path.Join(target, ".ssh/known_hosts"): ModeLink,
+	}
+	if len(modes) != len(expected) {
+		t.Fatalf("wrong links: %+v", links)
+	}
+	for p, mode := range expected {
+		if m, exists := modes[p]; exists == false || m != mode {
+			t.Errorf("expected %s with mode '%s', got: %+v", p, mode, links)
+		}
+	}
+}
+
+func TestInfo_Install_Template(t *testing.T) {
+	dir, pkg_dir, target, info := template_package(t)
+	defer os.RemoveAll(dir)
+
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Recorded = rec.Links
+
+	contents, err := ioutil.ReadFile(path.Join(target, ".ssh/config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "User me\nHost work\n" {
+		t.Errorf("wrong rendering: %q", contents)
+	}
+
+	// the package's vars win over the config's
+	contents, err = ioutil.ReadFile(path.Join(target, ".gitconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "email = me@work\n" {
+		t.Errorf("wrong rendering: %q", contents)
+	}
+
+	if s, err := os.Lstat(path.Join(target, ".ssh")); err != nil || s.IsDir() == false {
+		t.Errorf("expected a real directory holding the rendered file")
+	}
+	if owned, _ := LinksInto(path.Join(target, ".ssh/known_hosts"), pkg_dir); owned == false {
+		t.Errorf("expected the plain file next to the template to be linked")
+	}
+
+	health, _, err := info.Check(pkg_dir, []Link{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthInstalled {
+		t.Fatalf("expected installed, got '%s'", health)
+	}
+
+	// a change to the vars is rendered again by an update
+	info.Vars["email"] = "me@elsewhere"
+	rec, err = info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Recorded = rec.Links
+	contents, err = ioutil.ReadFile(path.Join(target, ".gitconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "email = me@elsewhere\n" {
+		t.Errorf("expected the update to render again, got: %q", contents)
+	}
+
+	// drift is found, and an update leaves the edit unless the policy says otherwise
+	if err := ioutil.WriteFile(path.Join(target, ".gitconfig"), []byte("email = edited\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	health, statuses, err := info.Check(pkg_dir, []Link{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthDrifted {
+		t.Fatalf("expected drifted, got '%s': %+v", health, statuses)
+	}
+
+	info.Vars["email"] = "me@work"
+	if _, err := info.Update(pkg_dir); err == nil {
+		t.Errorf("expected the update to stop at the edited file")
+	}
+	contents, err = ioutil.ReadFile(path.Join(target, ".gitconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "email = edited\n" {
+		t.Errorf("expected the edit to be left, got: %q", contents)
+	}
+
+	info.Conflict = ConflictBackup
+	info.BackupDir = make_dir(dir, t)
+	rec, err = info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Conflicts) != 1 {
+		t.Fatalf("expected the edited file to be backed up, got: %+v", rec.Conflicts)
+	}
+	expect_file(rec.Conflicts[0].Backup, "expected the edit in the backup directory", t)
+	contents, err = ioutil.ReadFile(path.Join(target, ".gitconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "email = me@work\n" {
+		t.Errorf("expected the update to render again, got: %q", contents)
+	}
+
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(path.Join(target, ".gitconfig"), "expected the rendered file to be removed", t)
+	expect_no_file(path.Join(target, ".ssh/known_hosts"), "expected the link to be removed", t)
+}
+
+func TestInfo_Uninstall_LeavesEditedRendering(t *testing.T) {
+	dir, pkg_dir, target, info := template_package(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := info.Install(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(target, ".gitconfig"), []byte("mine now\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_file(path.Join(target, ".gitconfig"), "expected the edited file to be left", t)
+}
+
+func TestInfo_Render_MissingVar(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "file.tmpl")
+	if err := ioutil.WriteFile(p, []byte("{{ .Vars.nope }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (Info{Name: "pkg"}).Render(p); err == nil {
+		t.Errorf("expected an unset var to fail the render")
+	}
+}
+
+func TestInfo_Install_Secret(t *testing.T) {
+	dir := mktemp(t)
+	defer os.RemoveAll(dir)
+	pkg_dir := make_dir(dir, t)
+	target := make_dir(dir, t)
+
+	key, err := secret.CreateKeyfile(path.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secret.SealFile(key, path.Join(pkg_dir, "token.secret"), []byte("hunter2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Info{
+		Name:   "pkg",
+		Target: "all:" + target,
+		Facts: Facts{Unlock: func() (secret.Key, error) {
+			return key, nil
+		}},
+	}
+	rec, err := info.Install(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Recorded = rec.Links
+
+	decrypted := path.Join(target, "token")
+	contents, err := ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hunter2\n" {
+		t.Errorf("wrong plaintext: %q", contents)
+	}
+	if s, err := os.Stat(decrypted); err != nil || s.Mode().Perm() != 0600 {
+		t.Errorf("expected the secret to be readable by the user alone, got %v", s.Mode())
+	}
+
+	// without a key, being there is all that can be checked
+	info.Facts.Unlock = nil
+	health, _, err := info.Check(pkg_dir, []Link{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health != HealthInstalled {
+		t.Fatalf("expected installed, got '%s'", health)
+	}
+
+	info.Facts.Unlock = func() (secret.Key, error) {
+		return key, nil
+	}
+
+	// a plaintext edited in place is not lost to a new secret
+	if err := ioutil.WriteFile(decrypted, []byte("edited\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := secret.SealFile(key, path.Join(pkg_dir, "token.secret"), []byte("hunter3\n")); err != nil {
+		t.Fatal(err)
+	}
+	info.Conflict = ConflictSkip
+	rec, err = info.Update(pkg_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Conflicts) != 1 || rec.Conflicts[0].Target != decrypted {
+		t.Errorf("expected the edited plaintext to be skipped, got: %+v", rec.Conflicts)
+	}
+	if contents, err = ioutil.ReadFile(decrypted); err != nil || string(contents) != "edited\n" {
+		t.Errorf("expected the edit to be left, got: %q", contents)
+	}
+
+	info.Conflict = ConflictOverwrite
+	if _, err := info.Update(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err = ioutil.ReadFile(decrypted); err != nil || string(contents) != "hunter3\n" {
+		t.Errorf("expected the new secret to be decrypted, got: %q", contents)
+	}
+
+	// removing it is only done once the contents are known to be ours
+	if _, err := info.Uninstall(pkg_dir); err != nil {
+		t.Fatal(err)
+	}
+	expect_no_file(decrypted, "expected the decrypted file to be removed", t)
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+//==================================================
+// Conditions
+//==================================================
+
+// One or many values, written in the config as a single string or a list
+type Values []string
+
+func (v *Values) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*v = Values{single}
+		return nil
+	}
+
+	return unmarshal((*[]string)(v))
+}
+
+// Where a package applies. Every predicate given must hold, an empty When
+// applies everywhere.
+type When struct {
+	OS       Values            `yaml:"os,omitempty"`       // any of, e.g. linux or darwin
+	Arch     Values            `yaml:"arch,omitempty"`     // any of, e.g. amd64 or arm64
+	Hostname Values            `yaml:"hostname,omitempty"` // any of these globs, e.g. work-*
+	Env      map[string]string `yaml:"env,omitempty"`      // each variable set, and matching the glob unless empty
+	Command  Values            `yaml:"command,omitempty"`  // each found on PATH
+	File     Values            `yaml:"file,omitempty"`     // each exists, a leading ~/ is expanded
+}
+
+// Check whether the package applies to this machine. When it does not, the
+// reason is the first predicate that failed.
+func (w When) Check() (bool, string) {
+	if len(w.OS) > 0 && w.OS.contains(runtime.GOOS) == false {
+		return false, fmt.Sprintf("os is %s, not %s", runtime.GOOS, strings.Join(w.OS, " or "))
+	}
+
+	if len(w.Arch) > 0 && w.Arch.contains(runtime.GOARCH) == false {
+		return false, fmt.Sprintf("arch is %s, not %s", runtime.GOARCH, strings.Join(w.Arch, " or "))
+	}
+
+	if len(w.Hostname) > 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			return false, fmt.Sprintf("could not get hostname: %s", err.Error())
+		}
+
+		// also tried without the domain
+		short := host
+		if dot := strings.Index(host, "."); dot > 0 {
+			short = host[:dot]
+		}
+
+		if w.Hostname.match(host) == false && w.Hostname.match(short) == false {
+			return false, fmt.Sprintf("hostname %s does not match %s", host, strings.Join(w.Hostname, " or "))
+		}
+	}
+
+	// sorted so the reason given is always the same
+	names := make([]string, 0, len(w.Env))
+	for name := range w.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, set := os.LookupEnv(name)
+		if set == false {
+			return false, fmt.Sprintf("$%s is not set", name)
+		}
+
+		if pattern := w.Env[name]; len(pattern) > 0 && (Values{pattern}).match(value) == false {
+			return false, fmt.Sprintf("$%s does not match %s", name, pattern)
+		}
+	}
+
+	for _, cmd := range w.Command {
+		if _, err := exec.LookPath(cmd); err != nil {
+			return false, fmt.Sprintf("%s is not on PATH", cmd)
+		}
+	}
+
+	for _, f := range w.File {
+		if _, err := os.Stat(ExpandHome(f)); err != nil {
+			return false, fmt.Sprintf("%s does not exist", f)
+		}
+	}
+
+	return true, ""
+}
+
+func (v Values) contains(value string) bool {
+	for _, candidate := range v {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Truthy function on whether the value matches any of the globs
+func (v Values) match(value string) bool {
+	for _, pattern := range v {
+		if ok, _ := filepath.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
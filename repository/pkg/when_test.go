@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+//==================================================
+// Conditions
+//==================================================
+
+func TestWhen_Unmarshal(t *testing.T) {
+	test := `
+os: linux
+arch: [amd64, arm64]
+env:
+    DISPLAY: ""
+    TERM: xterm-*
+`
+
+	var when When
+	if err := yaml.Unmarshal([]byte(test), &when); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(when.OS) != 1 || when.OS[0] != "linux" {
+		t.Errorf("wrong os: %v", when.OS)
+	}
+	if len(when.Arch) != 2 || when.Arch[1] != "arm64" {
+		t.Errorf("wrong arch: %v", when.Arch)
+	}
+	if _, exists := when.Env["DISPLAY"]; exists == false || when.Env["TERM"] != "xterm-*" {
+		t.Errorf("wrong env: %v", when.Env)
+	}
+}
+
+func TestWhen_Check_Empty(t *testing.T) {
+	if ok, reason := (When{}).Check(); ok == false {
+		t.Errorf("expected an empty when to apply everywhere, got: %s", reason)
+	}
+}
+
+func TestWhen_Check_Platform(t *testing.T) {
+	here := When{OS: Values{"plan9", runtime.GOOS}, Arch: Values{runtime.GOARCH}}
+	if ok, reason := here.Check(); ok == false {
+		t.Errorf("expected this platform to match, got: %s", reason)
+	}
+
+	elsewhere := When{OS: Values{"plan9"}}
+	if ok, reason := elsewhere.Check(); ok || strings.Contains(reason, "plan9") == false {
+		t.Errorf("expected another os to be refused, got: %v (%s)", ok, reason)
+	}
+}
+
+func TestWhen_Check_Hostname(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	if ok, reason := (When{Hostname: Values{"nomatch-*", host[:1] + "*"}}).Check(); ok == false {
+		t.Errorf("expected the glob to match %s, got: %s", host, reason)
+	}
+	if ok, _ := (When{Hostname: Values{"nomatch-*"}}).Check(); ok {
+		t.Errorf("expected the glob not to match %s", host)
+	}
+}
+
+func TestWhen_Check_Env(t *testing.T) {
+	os.Setenv("HEARTH_WHEN_TEST", "work-laptop")
+	defer os.Unsetenv("HEARTH_WHEN_TEST")
+
+	if ok, reason := (When{Env: map[string]string{"HEARTH_WHEN_TEST": ""}}).Check(); ok == false {
+		t.Errorf("expected a set variable to match, got: %s", reason)
+	}
+	if ok, reason := (When{Env: map[string]string{"HEARTH_WHEN_TEST": "work-*"}}).Check(); ok == false {
+		t.Errorf("expected the glob to match, got: %s", reason)
+	}
+	if ok, _ := (When{Env: map[string]string{"HEARTH_WHEN_TEST": "home-*"}}).Check(); ok {
+		t.Errorf("expected the glob not to match")
+	}
+	if ok, reason := (When{Env: map[string]string{"HEARTH_WHEN_UNSET": ""}}).Check(); ok || reason != "$HEARTH_WHEN_UNSET is not set" {
+		t.Errorf("expected an unset variable to be refused, got: %v (%s)", ok, reason)
+	}
+}
+
+func TestWhen_Check_CommandAndFile(t *testing.T) {
+	dir := make_dir(os.TempDir(), t)
+	defer os.RemoveAll(dir)
+
+	if ok, reason := (When{Command: Values{"sh"}, File: Values{dir}}).Check(); ok == false {
+		t.Errorf("expected sh and %s to be found, got: %s", dir, reason)
+	}
+	if ok, _ := (When{Command: Values{"hearth-no-such-command"}}).Check(); ok {
+		t.Errorf("expected a missing command to be refused")
+	}
+	if ok, _ := (When{File: Values{dir + "/missing"}}).Check(); ok {
+		t.Errorf("expected a missing file to be refused")
+	}
+}
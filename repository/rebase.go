@@ -0,0 +1,548 @@
+package repository
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	git "gopkg.in/libgit2/git2go.v23"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//==================================================
+// Rebasing pulls
+//==================================================
+
+// Where an unfinished rebase is kept, inside the git directory
+const rebaseFile = "hearth-rebase.yml"
+
+// A rebase of local commits onto the upstream. Saved between steps so a rebase
+// stopped on conflicts can be continued, skipped or aborted in a later run.
+//
+// The binding has no rebase API, so each commit is replayed with a three way
+// merge of its parent, the rewritten tip and itself.
+type Rebase struct {
+	Branch   string   `yaml:"branch"`
+	Upstream string   `yaml:"upstream"`  // e.g. origin/master
+	Onto     string   `yaml:"onto"`      // commit of the upstream
+	OrigHead string   `yaml:"orig_head"` // where the branch was before
+	Current  string   `yaml:"current"`   // tip of the commits rewritten so far
+	Todo     []string `yaml:"todo"`      // commits left to replay, the first is the one stopped on
+}
+
+// Get the short id of the commit the rebase stopped on, empty if none
+func (b Rebase) StoppedAt() string {
+	if len(b.Todo) == 0 || len(b.Todo[0]) < 7 {
+		return ""
+	}
+	return b.Todo[0][:7]
+}
+
+func (r Repository) rebasePath() string {
+	return path.Join(r.Repository.Path(), rebaseFile)
+}
+
+// Truthy function on whether a rebase is in progress
+func (r Repository) Rebasing() bool {
+	_, err := os.Stat(r.rebasePath())
+	return err == nil
+}
+
+// Get the rebase in progress, or nil when there is none
+func (r Repository) RebaseInProgress() (*Rebase, error) {
+	contents, err := ioutil.ReadFile(r.rebasePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read rebase state: %s", err.Error())
+	}
+
+	state := &Rebase{}
+	if err := yaml.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("could not parse rebase state: %s", err.Error())
+	}
+	return state, nil
+}
+
+func (r Repository) saveRebase(state *Rebase) error {
+	contents, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(r.rebasePath(), contents, 0644); err != nil {
+		return fmt.Errorf("could not save rebase state: %s", err.Error())
+	}
+	return nil
+}
+
+// Fetch the current branch's upstream and rebase local commits onto it. Stops
+// with a ConflictError when a commit does not apply cleanly, leaving the rebase
+// in progress.
+func (r Repository) PullRebase() error {
+	branch, err := r.CurrentBranch()
+	if err != nil {
+		return err
+	}
+
+	up, err := r.UpstreamOf(branch)
+	if err != nil {
+		return err
+	}
+
+	if err := r.fetch(up.Remote, []string{up.FetchRefspec()}); err != nil {
+		return err
+	}
+
+	return r.rebaseUpstream(branch, up)
+}
+
+// Bring the already fetched upstream into the branch, which must be HEAD, the
+// way the config asks for
+func (r Repository) integrateUpstream(branch string, up Upstream) error {
+	if r.Config.Pull.Rebase {
+		return r.rebaseUpstream(branch, up)
+	}
+	return r.mergeUpstream(branch, up)
+}
+
+// Rebase the branch, which must be HEAD, onto the already fetched upstream
+func (r Repository) rebaseUpstream(branch string, up Upstream) error {
+	if r.Rebasing() || r.Merging() {
+		return fmt.Errorf("a pull is already in progress, finish or abort it first")
+	}
+
+	if dirty, err := r.uncommitted(); err != nil {
+		return err
+	} else if dirty {
+		return fmt.Errorf("uncommitted changes in the repository, save or discard them first")
+	}
+
+	remote, err := r.References.Lookup(up.TrackingRef())
+	if err != nil {
+		return fmt.Errorf("could not find %s: %s", up, err.Error())
+	}
+	defer remote.Free()
+	onto := remote.Target()
+
+	head, err := r.HeadCommit()
+	if err != nil {
+		return err
+	}
+	defer head.Free()
+
+	// nothing local to replay, leave it to the merge (up to date or fast-forward)
+	if head.Id().Equal(onto) {
+		return r.mergeUpstream(branch, up)
+	} else if behind, err := r.DescendantOf(onto, head.Id()); err != nil {
+		return err
+	} else if behind {
+		return r.mergeUpstream(branch, up)
+	}
+
+	if ahead, err := r.DescendantOf(head.Id(), onto); err != nil {
+		return err
+	} else if ahead {
+		fmt.Println("Already up to date.")
+		return nil
+	}
+
+	// save where we were so callers can see what the pull brought in
+	if _, err := r.References.Create("ORIG_HEAD", head.Id(), true, "pull: saving pre-rebase HEAD"); err != nil {
+		return fmt.Errorf("could not save pre-rebase HEAD: %s", err.Error())
+	}
+
+	todo, err := r.commitsToReplay(head.Id(), onto)
+	if err != nil {
+		return err
+	}
+
+	state := &Rebase{
+		Branch:   branch,
+		Upstream: up.String(),
+		Onto:     onto.String(),
+		OrigHead: head.Id().String(),
+		Current:  onto.String(),
+		Todo:     todo,
+	}
+	if err := r.saveRebase(state); err != nil {
+		return err
+	}
+
+	return r.replay(state)
+}
+
+// Get the commits on head that are not on onto, oldest first. Merge commits
+// are left out, their changes come with the commits they merged.
+func (r Repository) commitsToReplay(head, onto *git.Oid) ([]string, error) {
+	walk, err := r.Walk()
+	if err != nil {
+		return nil, fmt.Errorf("could not walk history: %s", err.Error())
+	}
+	defer walk.Free()
+
+	walk.Sorting(git.SortTopological | git.SortReverse)
+	if err := walk.Push(head); err != nil {
+		return nil, err
+	}
+	if err := walk.Hide(onto); err != nil {
+		return nil, err
+	}
+
+	todo := make([]string, 0)
+	err = walk.Iterate(func(c *git.Commit) bool {
+		if c.ParentCount() == 1 {
+			todo = append(todo, c.Id().String())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk history: %s", err.Error())
+	}
+
+	return todo, nil
+}
+
+// Replay the commits left to do, then move the branch to the result
+func (r Repository) replay(state *Rebase) error {
+	for len(state.Todo) > 0 {
+		commit, current, err := r.rebaseStep(state)
+		if err != nil {
+			return err
+		}
+
+		idx, err := r.replayIndex(commit, current)
+		if err != nil {
+			commit.Free()
+			current.Free()
+			return err
+		}
+
+		if idx.HasConflicts() {
+			err = r.stopRebase(state, current, idx)
+		} else {
+			var tree_id *git.Oid
+			if tree_id, err = idx.WriteTreeTo(r.Repository); err == nil {
+				err = r.commitReplayed(state, commit, current, tree_id)
+			}
+		}
+
+		idx.Free()
+		commit.Free()
+		current.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.finishRebase(state)
+}
+
+// Get the commit being replayed and the rewritten tip it goes on
+func (r Repository) rebaseStep(state *Rebase) (commit, current *git.Commit, err error) {
+	if commit, err = r.lookupCommitString(state.Todo[0]); err != nil {
+		return nil, nil, err
+	}
+	if current, err = r.lookupCommitString(state.Current); err != nil {
+		commit.Free()
+		return nil, nil, err
+	}
+	return commit, current, nil
+}
+
+func (r Repository) lookupCommitString(id string) (*git.Commit, error) {
+	oid, err := git.NewOid(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit id in rebase state: %s", id)
+	}
+
+	commit, err := r.LookupCommit(oid)
+	if err != nil {
+		return nil, fmt.Errorf("could not find commit %s: %s", id, err.Error())
+	}
+	return commit, nil
+}
+
+// Merge what the commit changed into the tip, as an index not tied to the repo
+func (r Repository) replayIndex(commit, current *git.Commit) (*git.Index, error) {
+	parent := commit.Parent(0)
+	if parent == nil {
+		return nil, fmt.Errorf("could not find parent of %s", commit.Id().String())
+	}
+	defer parent.Free()
+
+	trees := make([]*git.Tree, 0, 3)
+	defer func() {
+		for _, t := range trees {
+			t.Free()
+		}
+	}()
+	for _, c := range []*git.Commit{parent, current, commit} {
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("could not get tree of %s: %s", c.Id().String(), err.Error())
+		}
+		trees = append(trees, tree)
+	}
+
+	idx, err := r.MergeTrees(trees[0], trees[1], trees[2], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply %s: %s", commit.Id().String(), err.Error())
+	}
+	return idx, nil
+}
+
+// Commit the tree as the replayed commit on top of the tip, keeping its author
+// and message. A commit that changes nothing any more (already upstream) is
+// dropped.
+func (r Repository) commitReplayed(state *Rebase, commit, current *git.Commit, tree_id *git.Oid) error {
+	if tree_id.Equal(current.TreeId()) == false {
+		tree, err := r.LookupTree(tree_id)
+		if err != nil {
+			return err
+		}
+		defer tree.Free()
+
+		sig, err := r.DefaultSignature()
+		if err != nil {
+			return fmt.Errorf("could not get signature for commit: %s", err.Error())
+		}
+
+		commit_id, err := r.CreateCommit("", commit.Author(), sig, commit.Message(), tree, current)
+		if err != nil {
+			return fmt.Errorf("could not replay %s: %s", commit.Id().String(), err.Error())
+		}
+		state.Current = commit_id.String()
+	}
+
+	state.Todo = state.Todo[1:]
+	return r.saveRebase(state)
+}
+
+// Stop on the conflicts of replaying a commit. HEAD is detached at the tip and
+// the conflicts are written to the index and working tree to be resolved.
+func (r Repository) stopRebase(state *Rebase, current *git.Commit, merged *git.Index) error {
+	if err := r.SetHeadDetached(current.Id()); err != nil {
+		return fmt.Errorf("could not detach HEAD: %s", err.Error())
+	}
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.ResetToCommit(current, git.ResetHard, &opts); err != nil {
+		return fmt.Errorf("could not check out %s: %s", state.Upstream, err.Error())
+	}
+	if err := r.CheckoutIndex(merged, &opts); err != nil {
+		return fmt.Errorf("could not write conflicts: %s", err.Error())
+	}
+
+	conflicts, err := r.copyIndex(merged)
+	if err != nil {
+		return err
+	}
+
+	if err := r.saveRebase(state); err != nil {
+		return err
+	}
+	return &ConflictError{conflicts}
+}
+
+// Make the repository's index the merged one, conflicts and all. Returns the
+// sorted paths in conflict.
+func (r Repository) copyIndex(merged *git.Index) ([]string, error) {
+	idx, err := r.Index()
+	if err != nil {
+		return nil, fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	iter, err := merged.ConflictIterator()
+	if err != nil {
+		return nil, fmt.Errorf("could not create iterator for conflicts: %s", err.Error())
+	}
+	defer iter.Free()
+
+	conflicts := make([]git.IndexConflict, 0)
+	in_conflict := make(map[string]bool)
+	for {
+		conflict, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read conflicts: %s", err.Error())
+		}
+
+		conflicts = append(conflicts, conflict)
+		for _, entry := range []*git.IndexEntry{conflict.Our, conflict.Their, conflict.Ancestor} {
+			if entry != nil {
+				in_conflict[entry.Path] = true
+			}
+		}
+	}
+
+	if err := idx.Clear(); err != nil {
+		return nil, err
+	}
+	for i := uint(0); i < merged.EntryCount(); i += 1 {
+		entry, err := merged.EntryByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		if in_conflict[entry.Path] == false {
+			if err := idx.Add(entry); err != nil {
+				return nil, fmt.Errorf("could not stage %s: %s", entry.Path, err.Error())
+			}
+		}
+	}
+	for _, c := range conflicts {
+		if err := idx.AddConflict(c.Ancestor, c.Our, c.Their); err != nil {
+			return nil, fmt.Errorf("could not record conflict: %s", err.Error())
+		}
+	}
+
+	if err := idx.Write(); err != nil {
+		return nil, fmt.Errorf("could not write repo index: %s", err.Error())
+	}
+
+	return r.Conflicts()
+}
+
+// Move the branch to the rewritten tip, check it out and forget the rebase
+func (r Repository) finishRebase(state *Rebase) error {
+	if err := r.resetBranch(state.Branch, state.Current, "pull: rebase onto "+state.Upstream); err != nil {
+		return err
+	}
+
+	// resetting moved ORIG_HEAD, callers want where the pull started
+	orig, err := git.NewOid(state.OrigHead)
+	if err != nil {
+		return fmt.Errorf("invalid commit id in rebase state: %s", state.OrigHead)
+	}
+	if _, err := r.References.Create("ORIG_HEAD", orig, true, "pull: saving pre-rebase HEAD"); err != nil {
+		return fmt.Errorf("could not save pre-rebase HEAD: %s", err.Error())
+	}
+
+	return os.Remove(r.rebasePath())
+}
+
+// Point the branch at the commit, put HEAD back on it and make the index and
+// working tree match
+func (r Repository) resetBranch(branch, id, msg string) error {
+	commit, err := r.lookupCommitString(id)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+
+	ref, err := r.References.Lookup(path.Join("refs/heads", branch))
+	if err != nil {
+		return fmt.Errorf("could not find branch %s: %s", branch, err.Error())
+	}
+	defer ref.Free()
+
+	moved, err := ref.SetTarget(commit.Id(), msg)
+	if err != nil {
+		return fmt.Errorf("could not move %s: %s", branch, err.Error())
+	}
+	defer moved.Free()
+
+	if err := r.SetHead(moved.Name()); err != nil {
+		return fmt.Errorf("could not set HEAD to %s: %s", branch, err.Error())
+	}
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.ResetToCommit(commit, git.ResetHard, &opts); err != nil {
+		return fmt.Errorf("could not check out %s: %s", branch, err.Error())
+	}
+
+	return nil
+}
+
+// Commit the resolved conflicts as the commit that was stopped on, then go on
+// replaying the rest
+func (r Repository) ContinueRebase() error {
+	state, err := r.RebaseInProgress()
+	if err != nil {
+		return err
+	} else if state == nil {
+		return fmt.Errorf("no rebase in progress")
+	}
+
+	idx, err := r.Index()
+	if err != nil {
+		return fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	if idx.HasConflicts() {
+		return fmt.Errorf("conflicts remain, resolve them first")
+	}
+
+	tree_id, err := idx.WriteTree()
+	if err != nil {
+		return fmt.Errorf("could not write tree to repo: %s", err.Error())
+	}
+
+	commit, current, err := r.rebaseStep(state)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	defer current.Free()
+
+	if err := r.commitReplayed(state, commit, current, tree_id); err != nil {
+		return err
+	}
+
+	return r.replay(state)
+}
+
+// Drop the commit that was stopped on and go on replaying the rest
+func (r Repository) SkipRebase() error {
+	state, err := r.RebaseInProgress()
+	if err != nil {
+		return err
+	} else if state == nil {
+		return fmt.Errorf("no rebase in progress")
+	}
+
+	current, err := r.lookupCommitString(state.Current)
+	if err != nil {
+		return err
+	}
+	defer current.Free()
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.ResetToCommit(current, git.ResetHard, &opts); err != nil {
+		return fmt.Errorf("could not drop the conflicts: %s", err.Error())
+	}
+
+	state.Todo = state.Todo[1:]
+	if err := r.saveRebase(state); err != nil {
+		return err
+	}
+
+	return r.replay(state)
+}
+
+// Put the branch, index and working tree back to where they were before the
+// pull and forget the rebase
+func (r Repository) AbortRebase() error {
+	state, err := r.RebaseInProgress()
+	if err != nil {
+		return err
+	} else if state == nil {
+		return fmt.Errorf("no rebase in progress")
+	}
+
+	if err := r.resetBranch(state.Branch, state.OrigHead, "pull: abort rebase onto "+state.Upstream); err != nil {
+		return err
+	}
+
+	return os.Remove(r.rebasePath())
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPullRebase(t *testing.T) {
+	repo, clone, origin_path := diverged_clones(t, false)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	check_fatal(t, repo.PullRebase())
+	if repo.Rebasing() {
+		t.Errorf("expected the rebase to be done")
+	}
+
+	head, err := repo.HeadCommit()
+	check_fatal(t, err)
+	defer head.Free()
+
+	// the local commit now sits on top of the one from the clone
+	if head.ParentCount() != 1 || head.Message() != "my change" {
+		t.Fatalf("expected the local commit replayed, got %q with %d parent(s)", head.Message(), head.ParentCount())
+	}
+	parent := head.Parent(0)
+	defer parent.Free()
+	if parent.Message() != "their change" {
+		t.Errorf("expected the upstream commit below, got %q", parent.Message())
+	}
+
+	for _, name := range []string{"shared", "other"} {
+		if _, err := os.Stat(path.Join(repo.Path, name)); err != nil {
+			t.Errorf("expected %s in the working tree: %s", name, err)
+		}
+	}
+
+	branch, err := repo.CurrentBranch()
+	check_fatal(t, err)
+	if branch != "master" {
+		t.Errorf("expected HEAD back on master, got %s", branch)
+	}
+}
+
+func TestPullRebaseConflict(t *testing.T) {
+	repo, clone, origin_path := diverged_clones(t, true)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	err := repo.PullRebase()
+	if _, ok := err.(*ConflictError); ok == false {
+		t.Fatalf("expected the rebase to stop on conflicts, got: %v", err)
+	}
+
+	state, err := repo.RebaseInProgress()
+	check_fatal(t, err)
+	if state == nil || len(state.Todo) != 1 || state.Upstream != "origin/master" {
+		t.Fatalf("wrong rebase state: %+v", state)
+	}
+
+	if err := repo.ContinueRebase(); err == nil {
+		t.Errorf("expected continue to be refused while in conflict")
+	}
+
+	check_fatal(t, repo.TakeTheirs("shared"))
+	check_fatal(t, repo.ContinueRebase())
+	if repo.Rebasing() {
+		t.Errorf("expected the rebase to be done")
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(repo.Path, "shared"))
+	check_fatal(t, err)
+	if string(contents) != "mine\n" {
+		t.Errorf("expected the local version, got: %q", contents)
+	}
+
+	head, err := repo.HeadCommit()
+	check_fatal(t, err)
+	defer head.Free()
+	if head.ParentCount() != 1 || head.Message() != "my change" {
+		t.Errorf("expected the local commit replayed, got %q", head.Message())
+	}
+}
+
+func TestAbortRebase(t *testing.T) {
+	repo, clone, origin_path := diverged_clones(t, true)
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone.Path)
+	defer repo.Free()
+	defer clone.Free()
+
+	before, err := repo.HeadCommit()
+	check_fatal(t, err)
+	defer before.Free()
+
+	if _, ok := repo.PullRebase().(*ConflictError); ok == false {
+		t.Fatalf("expected the rebase to stop on conflicts")
+	}
+	check_fatal(t, repo.AbortRebase())
+
+	after, err := repo.HeadCommit()
+	check_fatal(t, err)
+	defer after.Free()
+	if after.Id().Equal(before.Id()) == false {
+		t.Errorf("expected HEAD back where it was")
+	}
+
+	branch, err := repo.CurrentBranch()
+	check_fatal(t, err)
+	if branch != "master" || repo.Rebasing() {
+		t.Errorf("expected no rebase and HEAD on master, got %s", branch)
+	}
+}
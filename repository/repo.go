@@ -1,8 +1,8 @@
 package repository
 
 import (
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -38,11 +38,7 @@ func Open() (Repository, error) {
 		return repo, err
 	}
 
-	conf_path := conf.BaseDirectory
-	if strings.HasPrefix(conf_path, "~/") {
-		conf_path = path.Join(os.Getenv("HOME"), conf_path[2:])
-	}
-
+	conf_path := pkg.ExpandHome(conf.BaseDirectory)
 	repo_raw, err := git.OpenRepository(conf_path)
 	if err != nil {
 		return repo, fmt.Errorf("could not open git repository: %s", err)
@@ -52,6 +48,57 @@ func Open() (Repository, error) {
 	return repo, nil
 }
 
+// Open the managed repository when its config may not parse, as when a pull
+// left conflict markers in .hearthrc. The repository is found through the
+// ~/.hearthrc link into it, and while the config does not parse the one from
+// before the pull (ORIG_HEAD) is used instead.
+func OpenConflicted() (Repository, error) {
+	var repo Repository
+	repo_path := locate()
+	repo_raw, err := git.OpenRepository(repo_path)
+	if err != nil {
+		return repo, fmt.Errorf("could not open git repository: %s", err)
+	}
+	repo = Repository{repo_raw, repo_path, config.Config{}}
+
+	conf, err := config.Open()
+	if err != nil {
+		orig_id, orig_err := repo.OrigHead()
+		if orig_err != nil {
+			return repo, err
+		}
+
+		if conf, err = repo.ConfigAt(orig_id); err != nil {
+			return repo, err
+		}
+	}
+	repo.Config = conf
+
+	return repo, nil
+}
+
+// Find the repository without parsing the config: where ~/.hearthrc links to,
+// or else the directory of the local overrides, or else the default path
+func locate() string {
+	if dest, err := os.Readlink(config.Path()); err == nil {
+		if filepath.IsAbs(dest) == false {
+			dest = filepath.Join(filepath.Dir(config.Path()), dest)
+		}
+		return filepath.Dir(dest)
+	}
+
+	if layer, exists, err := config.ReadLayer(config.LocalName, config.LocalPath()); err == nil && exists {
+		if local, err := config.Parse(layer.Contents); err == nil && len(local.BaseDirectory) > 0 {
+			return pkg.ExpandHome(local.BaseDirectory)
+		}
+	}
+
+	return DefaultPath()
+}
+
+// Clone the repository into the given path and read the config it holds,
+// leaving it as committed. A repository without a config gets a new one, as
+// Create would make.
 func Clone(path, repository string) (Repository, error) {
 	repo_raw, err := git.Clone(repository, path, &git.CloneOptions{})
 	if err != nil {
@@ -59,7 +106,14 @@ func Clone(path, repository string) (Repository, error) {
 	}
 
 	repo := Repository{repo_raw, path, config.Config{}}
-	if err := repo.InitFiles(); err != nil {
+	contents, err := ioutil.ReadFile(filepath.Join(path, config.Name))
+	if os.IsNotExist(err) {
+		return repo, repo.InitFiles()
+	} else if err != nil {
+		return repo, fmt.Errorf("could not read the cloned config: %s", err.Error())
+	}
+
+	if repo.Config, err = config.Parse(contents); err != nil {
 		return repo, err
 	}
 
@@ -142,8 +196,265 @@ func (r Repository) GetPackage(name string) (pkg.Info, bool) {
 	return p, exists
 }
 
+// Re-read the config, e.g. after a pull or checkout changed it on disk
+func (r *Repository) ReloadConfig() error {
+	conf, err := config.Open()
+	if err != nil {
+		return err
+	}
+
+	r.Config = conf
+	return nil
+}
+
+// Look up the tree of the commit with the given id. A nil id gives a nil tree.
+func (r Repository) treeAt(id *git.Oid) (*git.Tree, error) {
+	if id == nil {
+		return nil, nil
+	}
+
+	commit, err := r.LookupCommit(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not find commit %s: %s", id.String(), err.Error())
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("could not get tree for commit %s: %s", id.String(), err.Error())
+	}
+
+	return tree, nil
+}
+
+// Get the config as committed at the given commit, with the overrides for this
+// host committed alongside it and the user's local overrides merged on top
+func (r Repository) ConfigAt(id *git.Oid) (config.Config, error) {
+	tree, err := r.treeAt(id)
+	if err != nil {
+		return config.Config{}, err
+	}
+	defer tree.Free()
+
+	host_path, err := config.HostPath()
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	layers := make([]config.Layer, 0, 3)
+	for _, p := range []string{config.Name, host_path} {
+		entry, err := tree.EntryByPath(p)
+		if err != nil && p == config.Name {
+			return config.Config{}, fmt.Errorf("no %s at %s", config.Name, id.String())
+		} else if err != nil {
+			continue // no overrides for this host
+		}
+
+		blob, err := r.LookupBlob(entry.Id)
+		if err != nil {
+			return config.Config{}, fmt.Errorf("could not read %s at %s: %s", p, id.String(), err.Error())
+		}
+		layers = append(layers, config.Layer{Name: p, Contents: blob.Contents()})
+		blob.Free()
+	}
+
+	local, exists, err := config.ReadLayer(config.LocalName, config.LocalPath())
+	if err != nil {
+		return config.Config{}, err
+	} else if exists {
+		layers = append(layers, local)
+	}
+
+	conf, _, err := config.Merge(layers)
+	return conf, err
+}
+
+//==================================================
+// Changes between commits
+//==================================================
+
+// A file moved between two commits
+type Rename struct {
+	From string
+	To   string
+}
+
+// Paths, relative to the repository, changed between two commits
+type ChangeSet struct {
+	Added    []string
+	Modified []string
+	Deleted  []string
+	Renamed  []Rename
+}
+
+// Get the sorted names of the packages touched by the changes. A rename
+// touches the package on both sides of it.
+func (c ChangeSet) Packages() []string {
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if name := PackageOf(p); len(name) > 0 {
+			seen[name] = true
+		}
+	}
+
+	for _, list := range [][]string{c.Added, c.Modified, c.Deleted} {
+		for _, p := range list {
+			add(p)
+		}
+	}
+	for _, r := range c.Renamed {
+		add(r.From)
+		add(r.To)
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Diff the trees of two commits. A nil old_id diffs against an empty tree, so
+// everything in the newer commit is added.
+func (r Repository) ChangedBetween(old_id, new_id *git.Oid) (ChangeSet, error) {
+	changes := ChangeSet{
+		Added:    make([]string, 0),
+		Modified: make([]string, 0),
+		Deleted:  make([]string, 0),
+		Renamed:  make([]Rename, 0),
+	}
+
+	old_tree, err := r.treeAt(old_id)
+	if err != nil {
+		return changes, err
+	}
+	if old_tree != nil {
+		defer old_tree.Free()
+	}
+
+	new_tree, err := r.treeAt(new_id)
+	if err != nil {
+		return changes, err
+	}
+	defer new_tree.Free()
+
+	diff_opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return changes, fmt.Errorf("could not get diff options: %s", err.Error())
+	}
+	diff_opts.IgnoreSubmodules = git.SubmoduleIgnoreAll
+
+	diff, err := r.DiffTreeToTree(old_tree, new_tree, &diff_opts)
+	if err != nil {
+		return changes, fmt.Errorf("could not diff commits: %s", err.Error())
+	}
+	defer diff.Free()
+
+	// pair up deletes and adds of the same content as renames
+	find_opts, err := git.DefaultDiffFindOptions()
+	if err != nil {
+		return changes, fmt.Errorf("could not get rename options: %s", err.Error())
+	}
+	find_opts.Flags = git.DiffFindRenames
+	if err := diff.FindSimilar(&find_opts); err != nil {
+		return changes, fmt.Errorf("could not find renames: %s", err.Error())
+	}
+
+	count, err := diff.NumDeltas()
+	if err != nil {
+		return changes, fmt.Errorf("could not count changes: %s", err.Error())
+	}
+
+	for i := 0; i < count; i += 1 {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return changes, fmt.Errorf("could not get change: %s", err.Error())
+		}
+
+		switch delta.Status {
+		case git.DeltaAdded, git.DeltaCopied:
+			changes.Added = append(changes.Added, delta.NewFile.Path)
+		case git.DeltaModified, git.DeltaTypeChange:
+			changes.Modified = append(changes.Modified, delta.NewFile.Path)
+		case git.DeltaDeleted:
+			changes.Deleted = append(changes.Deleted, delta.OldFile.Path)
+		case git.DeltaRenamed:
+			changes.Renamed = append(changes.Renamed, Rename{delta.OldFile.Path, delta.NewFile.Path})
+		}
+	}
+
+	return changes, nil
+}
+
+// Sort the given packages into those added and those modified between two
+// commits. A package is added when its directory is new in the newer commit.
+// Packages not in the newer commit are left out. A nil old_id treats every
+// package as added.
+func (r Repository) PackagesChanged(old_id, new_id *git.Oid, names []string) (added, modified []string, err error) {
+	added = make([]string, 0)
+	modified = make([]string, 0)
+
+	changes, err := r.ChangedBetween(old_id, new_id)
+	if err != nil {
+		return
+	}
+
+	touched := make(map[string]bool)
+	for _, name := range changes.Packages() {
+		touched[name] = true
+	}
+
+	old_tree, err := r.treeAt(old_id)
+	if err != nil {
+		return
+	}
+	if old_tree != nil {
+		defer old_tree.Free()
+	}
+
+	new_tree, err := r.treeAt(new_id)
+	if err != nil {
+		return
+	}
+	defer new_tree.Free()
+
+	for _, name := range names {
+		if touched[name] == false {
+			continue
+		}
+
+		if _, lookup_err := new_tree.EntryByPath(name); lookup_err != nil {
+			continue
+		}
+
+		if old_tree == nil {
+			added = append(added, name)
+		} else if _, lookup_err := old_tree.EntryByPath(name); lookup_err != nil {
+			added = append(added, name)
+		} else {
+			modified = append(modified, name)
+		}
+	}
+
+	return
+}
+
+// Get the commit HEAD pointed to before the last pull (ORIG_HEAD)
+func (r Repository) OrigHead() (*git.Oid, error) {
+	ref, err := r.References.Lookup("ORIG_HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("could not find the pre-pull HEAD: %s", err.Error())
+	}
+	defer ref.Free()
+
+	return ref.Target(), nil
+}
+
+// Truthy function on whether the path (absolute, or relative to the repo) was
+// modified by the commit at HEAD. Files created by the commit were not modified.
 // NOTE: eats errors
-// TODO: docs
 func (r Repository) ModifiedInLast(path string) bool {
 	var err error
 	if filepath.IsAbs(path) {
@@ -153,16 +464,6 @@ func (r Repository) ModifiedInLast(path string) bool {
 		}
 	}
 
-	// check if even in last commit
-	changed, err := r.ChangedInLastCommit()
-	if err != nil {
-		return false
-	}
-	sort.StringSlice(changed).Sort()
-	if sort.SearchStrings(changed, path) == len(changed) {
-		return false
-	}
-
 	// get head
 	commit, err := r.HeadCommit()
 	if err != nil {
@@ -170,27 +471,25 @@ func (r Repository) ModifiedInLast(path string) bool {
 	}
 	defer commit.Free()
 
-	// then get parent
+	// then get parent. no parent == first commit == created
 	parent := commit.Parent(0)
 	if parent == nil {
 		return false
 	}
 	defer parent.Free()
 
-	// ... and the parent's tree
-	tree, err := parent.Tree()
+	changes, err := r.ChangedBetween(parent.Id(), commit.Id())
 	if err != nil {
 		return false
 	}
-	defer tree.Free()
 
-	// if we can get the entry it was changed
-	_, err = tree.EntryByPath(path)
-	if err != nil {
-		return false
+	for _, p := range changes.Modified {
+		if p == path {
+			return true
+		}
 	}
 
-	return true
+	return false
 }
 
 // NOTE: eats errors
@@ -250,7 +549,8 @@ func (r Repository) CommitAll(message string) (*git.Commit, error) {
 	}
 	defer idx.Free()
 
-	// walk the tree and add all files. essentially running `git add --all .` in the repo directory
+	// walk the tree and gather all files. essentially running `git add --all .` in the repo directory
+	relpaths := make([]string, 0)
 	err = filepath.Walk(r.Path, func(p string, i os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -267,18 +567,25 @@ func (r Repository) CommitAll(message string) (*git.Commit, error) {
 			return err
 		}
 
-		// add to the new index
-		err = idx.AddByPath(relpath)
-		if err != nil {
-			return fmt.Errorf("could not add %s to commit: %s", p, err.Error())
-		}
-
+		relpaths = append(relpaths, relpath)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	// plaintext secrets never make it into a commit
+	if err := r.checkSealed(relpaths); err != nil {
+		return nil, err
+	}
+
+	// add to the new index
+	for _, relpath := range relpaths {
+		if err := idx.AddByPath(relpath); err != nil {
+			return nil, fmt.Errorf("could not add %s to commit: %s", relpath, err.Error())
+		}
+	}
+
 	// finalize the diff tree
 	tree_id, err := idx.WriteTree()
 	if err != nil {
@@ -323,25 +630,66 @@ func (r Repository) CommitAll(message string) (*git.Commit, error) {
 	return commit, nil
 }
 
-// TODO: docs
+// Push the given branch, and every tag, to its upstream. A branch pushed for
+// the first time gets the branch of the same name on origin as its upstream.
 func (r Repository) Push(branch string) error {
-	// make sure we have an origin to push to
-	origin, err := r.Remotes.Lookup("origin")
+	up, err := r.UpstreamOf(branch)
+	if err != nil {
+		return err
+	}
+
+	// make sure we have a remote to push to
+	remote, err := r.Remotes.Lookup(up.Remote)
+	if err != nil {
+		return fmt.Errorf("remote:%s does not exist in repository", up.Remote)
+	}
+	defer remote.Free()
+
+	refspecs, err := r.pushRefspecs(branch, up)
+	if err != nil {
+		return err
+	}
+
+	callbacks, wrap, err := r.remoteCallbacks(remote)
 	if err != nil {
-		log.Fatal("remote:origin does not exist in repository")
+		return err
+	}
+
+	push_opts := git.PushOptions{
+		RemoteCallbacks: callbacks,
+	}
+	if err := remote.Push(refspecs, &push_opts); err != nil {
+		return wrap(err)
 	}
-	defer origin.Free()
 
+	return r.SetUpstream(branch, up)
+}
+
+// Get the refspecs a push of the branch sends: the branch and every tag
+func (r Repository) pushRefspecs(branch string, up Upstream) ([]string, error) {
 	// TODO: sanitize the branch
-	branch = path.Join("refs/heads/", branch)
-	return origin.Push([]string{branch}, nil)
+	tags, err := r.tagRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	spec := path.Join("refs/heads/", branch)
+	if up.Merge != spec {
+		spec = fmt.Sprintf("%s:%s", spec, up.Merge)
+	}
+
+	return append([]string{spec}, tags...), nil
 }
 
 // Commit all changes in the repo with the given message. Subsequently,
-// push this commit to the given branch on origin.
+// push the given branch (the current one when empty) to its upstream.
 func (r Repository) CommitAndPush(message, branch string) (*git.Commit, error) {
 	if len(branch) == 0 {
-		branch = "master"
+		current, err := r.CurrentBranch()
+		if err != nil {
+			return nil, err
+		}
+		branch = current
 	}
 
 	commit, err := r.CommitAll(message)
@@ -375,58 +723,86 @@ func (r Repository) CommitCount() (uint64, error) {
 	return count, nil
 }
 
-func credentialsCallback(url, username string, allowedTypes git.CredType) (git.ErrorCode, *git.Cred) {
-	ret, cred := git.NewCredSshKeyFromAgent(username)
-	code := git.ErrorCode(ret)
-
-	// TODO: get user:pass in cli.... add as args?
+// Callbacks used for every operation talking to the remote. Each operation
+// needs its own, so a rejected credential is not offered again. The returned
+// function explains a failed operation with why a callback refused to go on.
+func (r Repository) remoteCallbacks(remote *git.Remote) (git.RemoteCallbacks, func(error) error, error) {
+	creds, err := NewCredentialChain(r.Config.Auth)
+	if err != nil {
+		return git.RemoteCallbacks{}, nil, err
+	}
 
-	return code, &cred // TODO: return ptr? seems weird
-}
+	host := NewHostVerifier(remote.Name(), remote.Url(), r.Config.Verify)
+	wrap := func(err error) error {
+		return creds.Wrap(host.Wrap(err))
+	}
 
-func certificateCheckCallback(cert *git.Certificate, valid bool, hostname string) git.ErrorCode {
-	// TODO: !!!!!!!!!!!!!!!!
-	return git.ErrorCode(0)
+	return git.RemoteCallbacks{
+		CredentialsCallback:      creds.Callback,
+		CertificateCheckCallback: host.Callback,
+	}, wrap, nil
 }
 
-func completionCallback(remote git.RemoteCompletion) git.ErrorCode {
-	fmt.Println(remote)
-	return git.ErrOk
-}
+// Fetch the given refspecs (and all tags) from the named remote
+func (r Repository) fetch(remote_name string, refspecs []string) error {
+	remote, err := r.Remotes.Lookup(remote_name)
+	if err != nil {
+		return fmt.Errorf("remote:%s does not exist in repository", remote_name)
+	}
+	defer remote.Free()
 
-func (r Repository) Pull() error {
-	origin, err := r.Remotes.Lookup("origin")
+	callbacks, wrap, err := r.remoteCallbacks(remote)
 	if err != nil {
 		return err
 	}
-	defer origin.Free()
 
 	fetch_opts := git.FetchOptions{
 		Prune:           git.FetchPruneUnspecified,
 		DownloadTags:    git.DownloadTagsAll,
 		UpdateFetchhead: true,
-		RemoteCallbacks: git.RemoteCallbacks{
-			CredentialsCallback:      credentialsCallback,
-			CertificateCheckCallback: certificateCheckCallback,
-			CompletionCallback:       completionCallback,
-		},
+		RemoteCallbacks: callbacks,
 	}
 
-	err = origin.Fetch([]string{"refs/heads/master"}, &fetch_opts, "") // TODO: do not assume master
+	return wrap(remote.Fetch(refspecs, &fetch_opts, ""))
+}
+
+// Fetch the upstream of the current branch and merge it into HEAD
+func (r Repository) Pull() error {
+	branch, err := r.CurrentBranch()
 	if err != nil {
 		return err
 	}
 
-	remoteBranch, err := r.References.Lookup("refs/remotes/origin/master") // TODO: do not assume master
+	up, err := r.UpstreamOf(branch)
 	if err != nil {
 		return err
 	}
 
+	if err := r.fetch(up.Remote, []string{up.FetchRefspec()}); err != nil {
+		return err
+	}
+
+	return r.mergeUpstream(branch, up)
+}
+
+// Merge the already fetched upstream into the branch, which must be HEAD
+func (r Repository) mergeUpstream(branch string, up Upstream) error {
+	remoteBranch, err := r.References.Lookup(up.TrackingRef())
+	if err != nil {
+		return fmt.Errorf("could not find %s: %s", up, err.Error())
+	}
+	defer remoteBranch.Free()
+
 	head, err := r.Head()
 	if err != nil {
 		return err
 	}
 
+	// save where we were so callers can see what the pull brought in
+	if _, err := r.References.Create("ORIG_HEAD", head.Target(), true, "pull: saving pre-merge HEAD"); err != nil {
+		return fmt.Errorf("could not save pre-merge HEAD: %s", err.Error())
+	}
+
 	remoteBranchID := remoteBranch.Target()
 	annotatedCommit, err := r.AnnotatedCommitFromRef(remoteBranch)
 	if err != nil {
@@ -450,80 +826,43 @@ func (r Repository) Pull() error {
 			return err
 		}
 
-		// Check for conflicts
-		index, err := r.Index()
-		if err != nil {
-			return err
-		}
-		defer index.Free()
-
-		if index.HasConflicts() {
-			iter, err := index.ConflictIterator()
-			if err != nil {
-				return fmt.Errorf("could not create iterator for conflicts: %s", err.Error())
-			}
-			defer iter.Free()
-
-			for entry, err := iter.Next(); err != nil; entry, err = iter.Next() {
-				fmt.Printf("CONFLICT: %s\n", entry.Our.Path)
-			}
-			return errors.New("Conflicts encountered. Please resolve them.")
-		}
-
-		// Make the merge commit
-		sig, err := r.DefaultSignature()
+		// stop for conflicts, leaving the merge in progress to be resolved
+		conflicts, err := r.Conflicts()
 		if err != nil {
 			return err
 		}
-
-		// Get Write Tree
-		treeId, err := index.WriteTree()
-		if err != nil {
-			return err
+		if len(conflicts) > 0 {
+			return &ConflictError{conflicts}
 		}
 
-		tree, err := r.LookupTree(treeId)
-		if err != nil {
+		if _, err := r.FinishMerge(nil); err != nil {
 			return err
 		}
-		defer tree.Free()
-
-		localCommit, err := r.LookupCommit(head.Target())
-		if err != nil {
-			return err
-		}
-		defer localCommit.Free()
-
+	} else if analysis&git.MergeAnalysisFastForward != 0 {
+		// Fast-forward changes
+		// Get remote tree
 		remoteCommit, err := r.LookupCommit(remoteBranchID)
 		if err != nil {
 			return err
 		}
 		defer remoteCommit.Free()
 
-		_, err = r.CreateCommit("HEAD", sig, sig, "", tree, localCommit, remoteCommit)
-		if err != nil {
-			return fmt.Errorf("could not create commit after merge: %s", err.Error())
-		}
-
-		// Clean up
-		r.StateCleanup()
-	} else if analysis&git.MergeAnalysisFastForward != 0 {
-		// Fast-forward changes
-		// Get remote tree
-		remoteTree, err := r.LookupTree(remoteBranchID)
+		remoteTree, err := remoteCommit.Tree()
 		if err != nil {
 			return err
 		}
+		defer remoteTree.Free()
 
 		// Checkout
 		if err := r.CheckoutTree(remoteTree, nil); err != nil {
 			return err
 		}
 
-		branchRef, err := r.References.Lookup("refs/heads/master") // TODO: not just master
+		branchRef, err := r.References.Lookup(path.Join("refs/heads", branch))
 		if err != nil {
 			return err
 		}
+		defer branchRef.Free()
 
 		// Point branch to the object
 		branchRef.SetTarget(remoteBranchID, "")
@@ -551,7 +890,8 @@ func (r Repository) HeadCommit() (*git.Commit, error) {
 	return commit, nil
 }
 
-// TODO: better name
+// Get every path (files and directories) in the tree at HEAD.
+// NOTE: this is not a diff, use ChangedBetween to find what a commit changed.
 func (r Repository) ChangedInLastCommit() ([]string, error) {
 	commit, err := r.HeadCommit()
 	if err != nil {
@@ -593,30 +933,99 @@ func (r Repository) NewBranch(name string) (*git.Branch, error) {
 	return branch, nil
 }
 
-func (r Repository) CheckoutBranch(b *git.Branch) error {
+// Check that the working tree can be switched to the branch, without touching
+// anything: a LocalChangesError is returned when an untracked file would be
+// overwritten or, unless they are to be discarded, uncommitted changes would
+// conflict with the branch
+func (r Repository) CanCheckout(b *git.Branch, discard bool) error {
 	if b == nil {
 		return fmt.Errorf("nil branch reference")
 	}
 
+	name, err := b.Name()
+	if err != nil {
+		return fmt.Errorf("could not get branch name: %s", err.Error())
+	}
+
+	target, err := r.LookupCommit(b.Target())
+	if err != nil {
+		return fmt.Errorf("could not find commit of %s: %s", name, err.Error())
+	}
+	defer target.Free()
+
+	tree, err := target.Tree()
+	if err != nil {
+		return fmt.Errorf("could not get tree of %s: %s", name, err.Error())
+	}
+	defer tree.Free()
+
+	collisions, err := r.untrackedCollisions(tree)
+	if err != nil {
+		return err
+	} else if len(collisions) > 0 {
+		return &LocalChangesError{collisions, "untracked files would be overwritten by " + name}
+	}
+
+	if discard {
+		return nil
+	} else if dirty, err := r.uncommitted(); err != nil || dirty == false {
+		return err
+	} else if r.Stashed() {
+		return fmt.Errorf("changes stashed earlier are still waiting in %s", StashRef)
+	}
+
+	conflicts, err := r.localConflicts(tree)
+	if err != nil {
+		return err
+	} else if len(conflicts) > 0 {
+		return &LocalChangesError{conflicts, "local changes would conflict with " + name}
+	}
+
+	return nil
+}
+
+// Switch the working tree to the branch. Uncommitted changes are stashed and
+// reapplied on the branch; a LocalChangesError is returned, with nothing
+// touched, when they would conflict with it or when an untracked file would be
+// overwritten (see CanCheckout). Use DiscardChanges first to throw the changes
+// away instead.
+func (r Repository) CheckoutBranch(b *git.Branch) error {
+	if err := r.CanCheckout(b, false); err != nil {
+		return err
+	}
+
 	// get branch's name
 	name, err := b.Name()
 	if err != nil {
 		return fmt.Errorf("could not get branch name: %s", err.Error())
 	}
 
+	stashed, err := r.Stash()
+	if err != nil {
+		return err
+	}
+
 	// set HEAD
 	err = r.SetHead(fmt.Sprintf("refs/heads/%s", name))
 	if err != nil {
 		return fmt.Errorf("could not set HEAD to branch: %s", err.Error())
 	}
 
-	// checkout options
+	// local changes are stashed and untracked files checked, nothing is lost
 	opts := git.CheckoutOpts{
-		Strategy: git.CheckoutForce, // TODO: scary
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.CheckoutHead(&opts); err != nil {
+		return err
+	}
+
+	if stashed {
+		if _, _, err := r.Unstash(); err != nil {
+			return fmt.Errorf("could not reapply local changes, they are in %s: %s", StashRef, err.Error())
+		}
 	}
 
-	return r.CheckoutHead(&opts)
-	//return r.CheckoutTree(tree, &opts)
+	return nil
 }
 
 func (r Repository) CheckoutBranchByName(name string) error {
@@ -628,3 +1037,279 @@ func (r Repository) CheckoutBranchByName(name string) error {
 
 	return r.CheckoutBranch(branch)
 }
+
+//==================================================
+// Status
+//==================================================
+
+// Where a change to a file currently lives
+type ChangeKind string
+
+const (
+	ChangeStaged    ChangeKind = "staged"
+	ChangeUnstaged  ChangeKind = "unstaged"
+	ChangeUntracked ChangeKind = "untracked"
+)
+
+// A single file in the repository that differs from HEAD
+type Change struct {
+	Path   string // relative to the repository
+	Kind   ChangeKind
+	Status string // new, modified, deleted, renamed or typechange
+}
+
+// Get the name of the package the path (relative to the repository) belongs to.
+// Files at the top of the repository belong to no package and give "".
+func PackageOf(p string) string {
+	parts := strings.SplitN(filepath.ToSlash(p), "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[0]
+}
+
+// Get every staged, unstaged and untracked change in the repository.
+// A file with both staged and unstaged changes is listed twice.
+func (r Repository) Changes() ([]Change, error) {
+	changes := make([]Change, 0)
+
+	status, err := r.StatusList(&git.StatusOptions{
+		Show:  git.StatusShowIndexAndWorkdir,
+		Flags: git.StatusOptIncludeUntracked | git.StatusOptRecurseUntrackedDirs | git.StatusOptRenamesHeadToIndex,
+	})
+	if err != nil {
+		return changes, fmt.Errorf("could not get repo status: %s", err.Error())
+	}
+	defer status.Free()
+
+	count, err := status.EntryCount()
+	if err != nil {
+		return changes, fmt.Errorf("could not count status entries: %s", err.Error())
+	}
+
+	for i := 0; i < count; i += 1 {
+		entry, err := status.ByIndex(i)
+		if err != nil {
+			return changes, fmt.Errorf("could not get status entry: %s", err.Error())
+		}
+
+		switch {
+		case entry.Status&git.StatusIndexNew != 0:
+			changes = append(changes, Change{entry.HeadToIndex.NewFile.Path, ChangeStaged, "new"})
+		case entry.Status&git.StatusIndexModified != 0:
+			changes = append(changes, Change{entry.HeadToIndex.NewFile.Path, ChangeStaged, "modified"})
+		case entry.Status&git.StatusIndexDeleted != 0:
+			changes = append(changes, Change{entry.HeadToIndex.OldFile.Path, ChangeStaged, "deleted"})
+		case entry.Status&git.StatusIndexRenamed != 0:
+			changes = append(changes, Change{entry.HeadToIndex.NewFile.Path, ChangeStaged, "renamed"})
+		case entry.Status&git.StatusIndexTypeChange != 0:
+			changes = append(changes, Change{entry.HeadToIndex.NewFile.Path, ChangeStaged, "typechange"})
+		}
+
+		switch {
+		case entry.Status&git.StatusWtNew != 0:
+			changes = append(changes, Change{entry.IndexToWorkdir.NewFile.Path, ChangeUntracked, "new"})
+		case entry.Status&git.StatusWtModified != 0:
+			changes = append(changes, Change{entry.IndexToWorkdir.NewFile.Path, ChangeUnstaged, "modified"})
+		case entry.Status&git.StatusWtDeleted != 0:
+			changes = append(changes, Change{entry.IndexToWorkdir.OldFile.Path, ChangeUnstaged, "deleted"})
+		case entry.Status&git.StatusWtRenamed != 0:
+			changes = append(changes, Change{entry.IndexToWorkdir.NewFile.Path, ChangeUnstaged, "renamed"})
+		case entry.Status&git.StatusWtTypeChange != 0:
+			changes = append(changes, Change{entry.IndexToWorkdir.NewFile.Path, ChangeUnstaged, "typechange"})
+		}
+	}
+
+	return changes, nil
+}
+
+// Truthy function on whether tracked files have changes that are not committed.
+// Untracked files are left out.
+func (r Repository) uncommitted() (bool, error) {
+	changes, err := r.Changes()
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range changes {
+		if c.Kind != ChangeUntracked {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get the name of the currently checked out branch (environment)
+func (r Repository) CurrentBranch() (string, error) {
+	head, err := r.Head()
+	if err != nil {
+		return "", fmt.Errorf("could not get HEAD: %s", err.Error())
+	}
+	defer head.Free()
+
+	if head.IsBranch() == false {
+		return "", fmt.Errorf("HEAD is not on a branch")
+	}
+
+	return head.Shorthand(), nil
+}
+
+// Count the commits the local branch has that its upstream does not (ahead)
+// and the commits the upstream has that the local one does not (behind).
+// Compares against the last fetch, nothing is fetched here.
+func (r Repository) CompareUpstream(branch string) (ahead, behind int, err error) {
+	local, err := r.References.Lookup(path.Join("refs/heads", branch))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not find branch %s: %s", branch, err.Error())
+	}
+	defer local.Free()
+
+	up, err := r.UpstreamOf(branch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	remote, err := r.References.Lookup(up.TrackingRef())
+	if err != nil {
+		return 0, 0, fmt.Errorf("branch %s has no upstream on %s", branch, up.Remote)
+	}
+	defer remote.Free()
+
+	return r.AheadBehind(local.Target(), remote.Target())
+}
+
+//==================================================
+// Dry runs
+//==================================================
+
+// Describes what a repository operation would do, without doing any of it
+type Plan struct {
+	Remote string   // url of the remote involved, if any
+	Stage  []string // paths, relative to the repo, a commit would include
+	Fetch  []string // refspecs fetched from the remote
+	Push   []string // refspecs pushed to the remote
+	Merge  string   // how fetched changes would be applied to HEAD
+}
+
+// Plan a CommitAll: every file that differs from HEAD and would be committed.
+// Deleted files are left out as CommitAll does not stage deletions.
+func (r Repository) PlanCommitAll() (Plan, error) {
+	plan := Plan{Stage: make([]string, 0)}
+
+	status, err := r.StatusList(&git.StatusOptions{
+		Show:  git.StatusShowIndexAndWorkdir,
+		Flags: git.StatusOptIncludeUntracked | git.StatusOptRecurseUntrackedDirs,
+	})
+	if err != nil {
+		return plan, fmt.Errorf("could not get repo status: %s", err.Error())
+	}
+	defer status.Free()
+
+	count, err := status.EntryCount()
+	if err != nil {
+		return plan, fmt.Errorf("could not count status entries: %s", err.Error())
+	}
+
+	for i := 0; i < count; i += 1 {
+		entry, err := status.ByIndex(i)
+		if err != nil {
+			return plan, fmt.Errorf("could not get status entry: %s", err.Error())
+		}
+
+		if entry.Status == git.StatusWtDeleted {
+			continue
+		}
+
+		p := entry.IndexToWorkdir.NewFile.Path
+		if len(p) == 0 {
+			p = entry.HeadToIndex.NewFile.Path
+		}
+		plan.Stage = append(plan.Stage, p)
+	}
+
+	return plan, r.checkSealed(plan.Stage)
+}
+
+// Plan a Push of the given branch to its upstream
+func (r Repository) PlanPush(branch string) (Plan, error) {
+	var plan Plan
+
+	up, err := r.UpstreamOf(branch)
+	if err != nil {
+		return plan, err
+	}
+
+	remote, err := r.Remotes.Lookup(up.Remote)
+	if err != nil {
+		return plan, fmt.Errorf("remote:%s does not exist in repository", up.Remote)
+	}
+	defer remote.Free()
+
+	plan.Remote = remote.Url()
+	plan.Push, err = r.pushRefspecs(branch, up)
+	return plan, err
+}
+
+// Plan a Pull. Asks origin where its branch points without fetching anything,
+// so the plan can only say how HEAD would move, not what would change.
+func (r Repository) PlanPull() (Plan, error) {
+	var plan Plan
+
+	branch, err := r.CurrentBranch()
+	if err != nil {
+		return plan, err
+	}
+
+	up, err := r.UpstreamOf(branch)
+	if err != nil {
+		return plan, err
+	}
+
+	remote, err := r.Remotes.Lookup(up.Remote)
+	if err != nil {
+		return plan, fmt.Errorf("remote:%s does not exist in repository", up.Remote)
+	}
+	defer remote.Free()
+
+	plan.Remote = remote.Url()
+	plan.Fetch = []string{up.FetchRefspec()}
+
+	callbacks, wrap, err := r.remoteCallbacks(remote)
+	if err != nil {
+		return plan, err
+	}
+	if err := remote.ConnectFetch(&callbacks); err != nil {
+		return plan, fmt.Errorf("could not connect to %s: %s", up.Remote, wrap(err).Error())
+	}
+	defer remote.Disconnect()
+
+	heads, err := remote.Ls(up.Merge)
+	if err != nil {
+		return plan, fmt.Errorf("could not list origin's references: %s", err.Error())
+	}
+	if len(heads) == 0 {
+		plan.Merge = "nothing to fetch"
+		return plan, nil
+	}
+	remote_id := heads[0].Id
+
+	commit, err := r.HeadCommit()
+	if err != nil {
+		plan.Merge = fmt.Sprintf("check out %s", remote_id.String())
+		return plan, nil
+	}
+	defer commit.Free()
+
+	if commit.Id().Equal(remote_id) {
+		plan.Merge = "already up to date"
+	} else if ahead, err := r.DescendantOf(commit.Id(), remote_id); err == nil && ahead {
+		plan.Merge = "already up to date (local commits not pushed)"
+	} else if behind, err := r.DescendantOf(remote_id, commit.Id()); err == nil && behind {
+		plan.Merge = fmt.Sprintf("fast-forward to %s", remote_id.String())
+	} else {
+		plan.Merge = fmt.Sprintf("merge %s", remote_id.String())
+	}
+
+	return plan, nil
+}
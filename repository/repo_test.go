@@ -583,3 +583,361 @@ func TestCheckoutBranchFilesChange(t *testing.T) {
 		t.Fatalf("wrong data (%s) in the file, expected (%s)", string(data), "1")
 	}
 }
+
+func TestPlanCommitAll(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	f := make_file(repo.Path, t)
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	defer c.Free()
+
+	// one modified and one new file
+	err = ioutil.WriteFile(f, []byte("changed"), 0755)
+	check_fatal(t, err)
+	added := make_file(repo.Path, t)
+
+	plan, err := repo.PlanCommitAll()
+	check_fatal(t, err)
+
+	if len(plan.Stage) != 2 {
+		t.Fatalf("expected 2 files to stage, got %v", plan.Stage)
+	}
+
+	sort.StringSlice(plan.Stage).Sort()
+	expect := []string{filepath.Base(f), filepath.Base(added)}
+	sort.StringSlice(expect).Sort()
+	for i := range expect {
+		if plan.Stage[i] != expect[i] {
+			t.Fatalf("expected to stage %v, got %v", expect, plan.Stage)
+		}
+	}
+
+	// and nothing was actually committed
+	count, err := repo.CommitCount()
+	check_fatal(t, err)
+	if count != 1 {
+		t.Fatalf("planning a commit created one")
+	}
+}
+
+func TestCommitAll_RefusesPlaintextSecrets(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	defer c.Free()
+
+	repo.Config.Secrets.Patterns = []string{"*.pem"}
+	err = ioutil.WriteFile(filepath.Join(repo.Path, "server.pem"), []byte("private"), 0600)
+	check_fatal(t, err)
+
+	if _, err := repo.PlanCommitAll(); err == nil {
+		t.Fatalf("expected the plan to refuse the plaintext secret")
+	}
+	if _, err := repo.CommitAll("leak"); err == nil {
+		t.Fatalf("expected the commit to refuse the plaintext secret")
+	}
+
+	count, err := repo.CommitCount()
+	check_fatal(t, err)
+	if count != 1 {
+		t.Fatalf("the plaintext secret was committed")
+	}
+
+	// sealed, it goes in
+	err = os.Rename(filepath.Join(repo.Path, "server.pem"), filepath.Join(repo.Path, "server.pem.secret"))
+	check_fatal(t, err)
+
+	c2, err := repo.CommitAll("sealed")
+	check_fatal(t, err)
+	defer c2.Free()
+
+	if repo.InHead("server.pem.secret") == false {
+		t.Fatalf("expected the sealed secret to be committed")
+	}
+}
+
+func TestPlanPush(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	plan, err := repo.PlanPush("master")
+	check_fatal(t, err)
+
+	if plan.Remote != default_origin {
+		t.Errorf("wrong remote: %s", plan.Remote)
+	}
+	if len(plan.Push) != 1 || plan.Push[0] != "refs/heads/master" {
+		t.Errorf("wrong refspecs: %v", plan.Push)
+	}
+}
+
+func TestPackageOf(t *testing.T) {
+	tests := map[string]string{
+		"vim/vimrc":              "vim",
+		"vim/autoload/thing.vim": "vim",
+		".hearthrc":              "",
+	}
+
+	for p, expect := range tests {
+		if got := PackageOf(p); got != expect {
+			t.Errorf("expected '%s' to be in package '%s', got '%s'", p, expect, got)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	dir := make_dir(repo.Path, t)
+	staged := make_file(dir, t)
+	unstaged := make_file(dir, t)
+
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	defer c.Free()
+
+	// stage one change, leave another in the workdir, and add an untracked file
+	check_fatal(t, ioutil.WriteFile(staged, []byte("staged"), 0755))
+	idx, err := repo.Index()
+	check_fatal(t, err)
+	rel, err := filepath.Rel(repo.Path, staged)
+	check_fatal(t, err)
+	check_fatal(t, idx.AddByPath(rel))
+	check_fatal(t, idx.Write())
+	idx.Free()
+
+	check_fatal(t, ioutil.WriteFile(unstaged, []byte("unstaged"), 0755))
+	untracked := make_file(dir, t)
+
+	changes, err := repo.Changes()
+	check_fatal(t, err)
+
+	kinds := make(map[string]ChangeKind)
+	for _, change := range changes {
+		kinds[path.Join(repo.Path, change.Path)] = change.Kind
+	}
+
+	if kinds[staged] != ChangeStaged {
+		t.Errorf("expected %s to be staged, got '%s'", staged, kinds[staged])
+	}
+	if kinds[unstaged] != ChangeUnstaged {
+		t.Errorf("expected %s to be unstaged, got '%s'", unstaged, kinds[unstaged])
+	}
+	if kinds[untracked] != ChangeUntracked {
+		t.Errorf("expected %s to be untracked, got '%s'", untracked, kinds[untracked])
+	}
+}
+
+func TestCurrentBranch(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	make_file(repo.Path, t)
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	defer c.Free()
+
+	b, err := repo.NewBranch("work")
+	check_fatal(t, err)
+	defer b.Free()
+	check_fatal(t, repo.CheckoutBranch(b))
+
+	name, err := repo.CurrentBranch()
+	check_fatal(t, err)
+	if name != "work" {
+		t.Fatalf("expected to be on 'work', got '%s'", name)
+	}
+}
+
+func TestPackagesChanged(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	kept := make_dir(repo.Path, t)
+	make_file(kept, t)
+	changed := make_dir(repo.Path, t)
+	changed_file := make_file(changed, t)
+
+	first, err := repo.CommitAll("first commit")
+	check_fatal(t, err)
+	defer first.Free()
+
+	check_fatal(t, ioutil.WriteFile(changed_file, []byte("changed"), 0755))
+	added := make_dir(repo.Path, t)
+	make_file(added, t)
+
+	second, err := repo.CommitAll("second commit")
+	check_fatal(t, err)
+	defer second.Free()
+
+	names := []string{filepath.Base(kept), filepath.Base(changed), filepath.Base(added), "not_in_repo"}
+	new_pkgs, modified_pkgs, err := repo.PackagesChanged(first.Id(), second.Id(), names)
+	check_fatal(t, err)
+
+	if len(new_pkgs) != 1 || new_pkgs[0] != filepath.Base(added) {
+		t.Errorf("expected only %s to be added, got %v", filepath.Base(added), new_pkgs)
+	}
+	if len(modified_pkgs) != 1 || modified_pkgs[0] != filepath.Base(changed) {
+		t.Errorf("expected only %s to be modified, got %v", filepath.Base(changed), modified_pkgs)
+	}
+}
+
+func TestChangedBetween(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	dir := make_dir(repo.Path, t)
+	modified := make_file(dir, t)
+	deleted := make_file(dir, t)
+	moved := path.Join(dir, "moved_from")
+	check_fatal(t, ioutil.WriteFile(moved, []byte("the same content on both sides of a rename\n"), 0644))
+
+	first, err := repo.CommitAll("first commit")
+	check_fatal(t, err)
+	defer first.Free()
+
+	// CommitAll does not stage deletions, so drop them from the index ourselves
+	idx, err := repo.Index()
+	check_fatal(t, err)
+	defer idx.Free()
+	for _, p := range []string{deleted, moved} {
+		rel, err := filepath.Rel(repo.Path, p)
+		check_fatal(t, err)
+		check_fatal(t, os.Remove(p))
+		check_fatal(t, idx.RemoveByPath(rel))
+	}
+	check_fatal(t, idx.Write())
+
+	check_fatal(t, ioutil.WriteFile(modified, []byte("changed"), 0755))
+	moved_to := path.Join(dir, "moved_to")
+	check_fatal(t, ioutil.WriteFile(moved_to, []byte("the same content on both sides of a rename\n"), 0644))
+	added := make_file(repo.Path, t)
+
+	second, err := repo.CommitAll("second commit")
+	check_fatal(t, err)
+	defer second.Free()
+
+	changes, err := repo.ChangedBetween(first.Id(), second.Id())
+	check_fatal(t, err)
+
+	rel := func(p string) string {
+		r, err := filepath.Rel(repo.Path, p)
+		check_fatal(t, err)
+		return r
+	}
+
+	if len(changes.Added) != 1 || changes.Added[0] != rel(added) {
+		t.Errorf("expected only %s to be added, got %v", rel(added), changes.Added)
+	}
+	if len(changes.Modified) != 1 || changes.Modified[0] != rel(modified) {
+		t.Errorf("expected only %s to be modified, got %v", rel(modified), changes.Modified)
+	}
+	if len(changes.Deleted) != 1 || changes.Deleted[0] != rel(deleted) {
+		t.Errorf("expected only %s to be deleted, got %v", rel(deleted), changes.Deleted)
+	}
+	if len(changes.Renamed) != 1 || changes.Renamed[0] != (Rename{rel(moved), rel(moved_to)}) {
+		t.Errorf("expected %s to be renamed to %s, got %v", rel(moved), rel(moved_to), changes.Renamed)
+	}
+
+	// a nil old commit means everything is new
+	everything, err := repo.ChangedBetween(nil, first.Id())
+	check_fatal(t, err)
+	if len(everything.Added) != 4 { // .hearthrc and the three files
+		t.Errorf("expected 4 files added by the first commit, got %v", everything.Added)
+	}
+}
+
+func TestChangeSetPackages(t *testing.T) {
+	changes := ChangeSet{
+		Added:    []string{"zsh/zshrc", ".hearthrc"},
+		Modified: []string{"vim/vimrc", "vim/colors/dark.vim"},
+		Deleted:  []string{"tmux/tmux.conf"},
+		Renamed:  []Rename{{"git/config", "gitconfig/config"}},
+	}
+
+	expect := []string{"git", "gitconfig", "tmux", "vim", "zsh"}
+	actual := changes.Packages()
+	if strings.Join(actual, ",") != strings.Join(expect, ",") {
+		t.Errorf("expected packages %v, got %v", expect, actual)
+	}
+}
+
+func TestConfigAt(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	first, err := repo.CommitAll("first commit")
+	check_fatal(t, err)
+	defer first.Free()
+
+	// a package only on the second commit
+	repo.Config.Packages = config.PackageMap{"vim": {Name: "vim", Target: "~"}}
+	check_fatal(t, repo.Config.Write(path.Join(repo.Path, config.Name)))
+	second, err := repo.CommitAll("add vim")
+	check_fatal(t, err)
+	defer second.Free()
+
+	before, err := repo.ConfigAt(first.Id())
+	check_fatal(t, err)
+	if len(before.Packages) != 0 {
+		t.Errorf("expected no packages at the first commit, got %v", before.Packages.Names())
+	}
+
+	after, err := repo.ConfigAt(second.Id())
+	check_fatal(t, err)
+	if pack, exists := after.Packages["vim"]; exists == false || pack.Target != "~" {
+		t.Errorf("expected vim at the second commit, got %v", after.Packages)
+	}
+	if after.BaseDirectory != repo.Config.BaseDirectory {
+		t.Errorf("wrong directory: %s", after.BaseDirectory)
+	}
+}
+
+func TestCloneKeepsConfig(t *testing.T) {
+	origin, origin_path := create_origin_repo(t)
+	repo := create_repo(origin_path, t)
+	clone_path := temp_dir()
+
+	defer os.RemoveAll(origin_path)
+	defer os.RemoveAll(repo.Path)
+	defer os.RemoveAll(clone_path)
+	defer origin.Free()
+	defer repo.Free()
+
+	repo.Config.Packages = config.PackageMap{"vim": {Name: "vim", Target: "~"}}
+	config_path := path.Join(repo.Path, config.Name)
+	check_fatal(t, repo.Config.Write(config_path))
+	c, err := repo.CommitAndPush("first commit", "master")
+	check_fatal(t, err)
+	defer c.Free()
+
+	clone, err := Clone(clone_path, origin_path)
+	check_fatal(t, err)
+	defer clone.Free()
+
+	if clone.Config.BaseDirectory != repo.Config.BaseDirectory {
+		t.Errorf("cloned config was rewritten: %s", clone.Config.BaseDirectory)
+	}
+	if _, exists := clone.Config.Packages["vim"]; exists == false {
+		t.Errorf("expected the committed packages, got %v", clone.Config.Packages.Names())
+	}
+
+	changes, err := clone.Changes()
+	check_fatal(t, err)
+	if len(changes) != 0 {
+		t.Errorf("expected a clean clone, got %+v", changes)
+	}
+}
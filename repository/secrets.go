@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zmarcantel/hearth/secret"
+)
+
+//==================================================
+// Secrets
+//==================================================
+
+// Fail on the paths that are secrets of the config still in plaintext
+func (r Repository) checkSealed(relpaths []string) error {
+	unsealed := r.Config.UnsealedSecrets(r.Path, relpaths)
+	if len(unsealed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("refusing to commit plaintext secrets, seal them with 'hearth secret add': %s", strings.Join(unsealed, ", "))
+}
+
+// Get the path, relative to the repository, of every sealed secret
+func (r Repository) SealedFiles() ([]string, error) {
+	sealed := make([]string, 0)
+	err := filepath.Walk(r.Path, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if i.IsDir() && i.Name() == ".git" {
+			return filepath.SkipDir
+		} else if i.IsDir() || secret.IsSecret(p) == false {
+			return nil
+		}
+
+		relpath, err := filepath.Rel(r.Path, p)
+		if err != nil {
+			return err
+		}
+
+		sealed = append(sealed, relpath)
+		return nil
+	})
+
+	return sealed, err
+}
+
+// Truthy function on whether the path, relative to the repository, is in the
+// HEAD commit
+// NOTE: eats errors
+func (r Repository) InHead(relpath string) bool {
+	commit, err := r.HeadCommit()
+	if err != nil {
+		return false
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return false
+	}
+	defer tree.Free()
+
+	_, err = tree.EntryByPath(filepath.ToSlash(relpath))
+	return err == nil
+}
@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+//==================================================
+// Local changes
+//==================================================
+
+// Where uncommitted changes are kept while the working tree is switched to
+// another environment or pulled. Kept apart from git's own stash.
+const StashRef = "refs/hearth/stash"
+
+// Returned when uncommitted changes would be lost by changing the working tree
+type LocalChangesError struct {
+	Paths  []string // relative to the repository
+	Reason string
+}
+
+func (e *LocalChangesError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, strings.Join(e.Paths, ", "))
+}
+
+// Truthy function on whether stashed changes are waiting to be reapplied
+func (r Repository) Stashed() bool {
+	ref, err := r.References.Lookup(StashRef)
+	if err != nil {
+		return false
+	}
+	ref.Free()
+	return true
+}
+
+// Save the uncommitted changes to tracked files as a commit on top of HEAD,
+// kept at StashRef, and put the index and working tree back to HEAD. Untracked
+// files are left alone. Returns false when there was nothing to stash.
+func (r Repository) Stash() (bool, error) {
+	if dirty, err := r.uncommitted(); err != nil || dirty == false {
+		return false, err
+	}
+
+	if r.Stashed() {
+		return false, fmt.Errorf("changes stashed earlier are still waiting in %s", StashRef)
+	}
+
+	head, err := r.HeadCommit()
+	if err != nil {
+		return false, err
+	}
+	defer head.Free()
+
+	tree, err := r.localTree()
+	if err != nil {
+		return false, err
+	}
+	defer tree.Free()
+
+	sig, err := r.DefaultSignature()
+	if err != nil {
+		return false, fmt.Errorf("could not get signature for commit: %s", err.Error())
+	}
+
+	message := "hearth: local changes"
+	if branch, err := r.CurrentBranch(); err == nil {
+		message += " on " + branch
+	}
+
+	stash_id, err := r.CreateCommit("", sig, sig, message, tree, head)
+	if err != nil {
+		return false, fmt.Errorf("could not stash local changes: %s", err.Error())
+	}
+
+	ref, err := r.References.Create(StashRef, stash_id, false, message)
+	if err != nil {
+		return false, fmt.Errorf("could not stash local changes: %s", err.Error())
+	}
+	ref.Free()
+
+	return true, r.DiscardChanges()
+}
+
+// Get the tree of the working tree's changes to tracked files. The index is
+// left as it was, on disk and in memory.
+func (r Repository) localTree() (*git.Tree, error) {
+	idx, err := r.Index()
+	if err != nil {
+		return nil, fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	staged_id, err := idx.WriteTree()
+	if err != nil {
+		return nil, fmt.Errorf("could not write tree to repo: %s", err.Error())
+	}
+	staged, err := r.LookupTree(staged_id)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Free()
+
+	if err := idx.UpdateAll(nil, nil); err != nil {
+		return nil, fmt.Errorf("could not read local changes: %s", err.Error())
+	}
+	tree_id, err := idx.WriteTree()
+	if err != nil {
+		return nil, fmt.Errorf("could not write tree to repo: %s", err.Error())
+	}
+
+	// only what is staged stays in the index
+	if err := idx.ReadTree(staged); err != nil {
+		return nil, err
+	}
+
+	return r.LookupTree(tree_id)
+}
+
+// Throw away uncommitted changes to tracked files, putting the index and
+// working tree back to HEAD
+func (r Repository) DiscardChanges() error {
+	head, err := r.HeadCommit()
+	if err != nil {
+		return err
+	}
+	defer head.Free()
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.ResetToCommit(head, git.ResetHard, &opts); err != nil {
+		return fmt.Errorf("could not discard local changes: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Get the stash commit and the merge of its changes onto the tree
+func (r Repository) mergeStash(onto *git.Tree) (*git.Commit, *git.Index, error) {
+	ref, err := r.References.Lookup(StashRef)
+	if err != nil {
+		return nil, nil, fmt.Errorf("nothing stashed")
+	}
+	defer ref.Free()
+
+	stash, err := r.LookupCommit(ref.Target())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not find stashed changes: %s", err.Error())
+	}
+
+	parent := stash.Parent(0)
+	if parent == nil {
+		stash.Free()
+		return nil, nil, fmt.Errorf("stashed changes have no parent commit")
+	}
+	defer parent.Free()
+
+	base, err := parent.Tree()
+	if err != nil {
+		stash.Free()
+		return nil, nil, err
+	}
+	defer base.Free()
+
+	changes, err := stash.Tree()
+	if err != nil {
+		stash.Free()
+		return nil, nil, err
+	}
+	defer changes.Free()
+
+	merged, err := r.MergeTrees(base, onto, changes, nil)
+	if err != nil {
+		stash.Free()
+		return nil, nil, fmt.Errorf("could not merge stashed changes: %s", err.Error())
+	}
+
+	return stash, merged, nil
+}
+
+// Get the paths whose uncommitted changes would conflict with the tree when
+// carried over to it
+func (r Repository) localConflicts(onto *git.Tree) ([]string, error) {
+	head, err := r.HeadCommit()
+	if err != nil {
+		return nil, err
+	}
+	defer head.Free()
+
+	base, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer base.Free()
+
+	changes, err := r.localTree()
+	if err != nil {
+		return nil, err
+	}
+	defer changes.Free()
+
+	merged, err := r.MergeTrees(base, onto, changes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not merge local changes: %s", err.Error())
+	}
+	defer merged.Free()
+
+	return indexConflicts(merged)
+}
+
+// Reapply the stashed changes onto the working tree, unstaged, and drop the
+// stash. Paths whose changes conflict with what is checked out now are left
+// with conflict markers and returned, with the id of the stash commit to get
+// the original changes back from.
+func (r Repository) Unstash() ([]string, *git.Oid, error) {
+	if r.Stashed() == false {
+		return nil, nil, nil
+	}
+
+	head, err := r.HeadCommit()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer head.Free()
+
+	head_tree, err := head.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer head_tree.Free()
+
+	stash, merged, err := r.mergeStash(head_tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stash.Free()
+	defer merged.Free()
+
+	conflicts, err := indexConflicts(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.CheckoutIndex(merged, &opts); err != nil {
+		return nil, nil, fmt.Errorf("could not reapply stashed changes: %s", err.Error())
+	}
+
+	// leave the changes unstaged, as they were
+	idx, err := r.Index()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get repo index: %s", err.Error())
+	}
+	defer idx.Free()
+
+	if err := idx.ReadTree(head_tree); err != nil {
+		return nil, nil, err
+	}
+	if err := idx.Write(); err != nil {
+		return nil, nil, fmt.Errorf("could not write repo index: %s", err.Error())
+	}
+
+	ref, err := r.References.Lookup(StashRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ref.Free()
+	if err := ref.Delete(); err != nil {
+		return nil, nil, fmt.Errorf("could not drop the stash: %s", err.Error())
+	}
+
+	return conflicts, stash.Id(), nil
+}
+
+// Get the untracked files that checking out the tree would overwrite
+func (r Repository) untrackedCollisions(target *git.Tree) ([]string, error) {
+	changes, err := r.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, c := range changes {
+		if c.Kind != ChangeUntracked {
+			continue
+		}
+
+		if entry, err := target.EntryByPath(c.Path); err == nil && entry != nil {
+			paths = append(paths, c.Path)
+		}
+	}
+
+	return paths, nil
+}
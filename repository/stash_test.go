@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+// A repo with a committed file and a second branch, test, at the same commit
+func stash_repo(t *testing.T) (Repository, string) {
+	repo := create_repo(default_origin, t)
+
+	f := make_file(repo.Path, t)
+	check_fatal(t, ioutil.WriteFile(f, []byte("committed"), 0644))
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	c.Free()
+
+	b, err := repo.NewBranch("test")
+	check_fatal(t, err)
+	b.Free()
+
+	return repo, f
+}
+
+func check_contents(t *testing.T, f, expect string) {
+	data, err := ioutil.ReadFile(f)
+	check_fatal(t, err)
+	if string(data) != expect {
+		t.Errorf("wrong data in %s\nexpected: %s\ngot: %s", path.Base(f), expect, string(data))
+	}
+}
+
+func TestStash(t *testing.T) {
+	repo, f := stash_repo(t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	stashed, err := repo.Stash()
+	check_fatal(t, err)
+	if stashed {
+		t.Errorf("expected nothing to stash in a clean tree")
+	}
+
+	check_fatal(t, ioutil.WriteFile(f, []byte("local"), 0644))
+	stashed, err = repo.Stash()
+	check_fatal(t, err)
+	if stashed == false || repo.Stashed() == false {
+		t.Fatalf("expected the change to be stashed")
+	}
+	check_contents(t, f, "committed")
+
+	conflicts, stash_id, err := repo.Unstash()
+	check_fatal(t, err)
+	if len(conflicts) != 0 || stash_id == nil {
+		t.Errorf("expected a clean reapply, got conflicts: %v", conflicts)
+	}
+	check_contents(t, f, "local")
+	if repo.Stashed() {
+		t.Errorf("expected the stash to be dropped")
+	}
+
+	// reapplied as an unstaged change
+	changes, err := repo.Changes()
+	check_fatal(t, err)
+	if len(changes) != 1 || changes[0].Kind != ChangeUnstaged {
+		t.Errorf("expected one unstaged change, got: %v", changes)
+	}
+}
+
+func TestCheckoutBranchKeepsChanges(t *testing.T) {
+	repo, f := stash_repo(t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	check_fatal(t, ioutil.WriteFile(f, []byte("local"), 0644))
+	check_fatal(t, repo.CheckoutBranchByName("test"))
+
+	branch, err := repo.CurrentBranch()
+	check_fatal(t, err)
+	if branch != "test" {
+		t.Errorf("did not change branches -- still on %s", branch)
+	}
+	check_contents(t, f, "local")
+}
+
+func TestCheckoutBranchRefusesConflicts(t *testing.T) {
+	repo, f := stash_repo(t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	// test changes the file and adds another
+	check_fatal(t, repo.CheckoutBranchByName("test"))
+	check_fatal(t, ioutil.WriteFile(f, []byte("on test"), 0644))
+	added := make_file(repo.Path, t)
+	c, err := repo.CommitAll("commit in test")
+	check_fatal(t, err)
+	defer c.Free()
+	check_fatal(t, repo.CheckoutBranchByName("master"))
+
+	// a conflicting local change
+	check_fatal(t, ioutil.WriteFile(f, []byte("local"), 0644))
+	err = repo.CheckoutBranchByName("test")
+	if _, ok := err.(*LocalChangesError); ok == false {
+		t.Fatalf("expected the switch to be refused, got: %v", err)
+	}
+	check_contents(t, f, "local")
+	if repo.Stashed() {
+		t.Errorf("expected the stash to be reapplied after refusing")
+	}
+
+	// an untracked file in the way
+	check_fatal(t, repo.DiscardChanges())
+	check_contents(t, f, "committed")
+	check_fatal(t, ioutil.WriteFile(added, []byte("untracked"), 0644))
+	err = repo.CheckoutBranchByName("test")
+	if _, ok := err.(*LocalChangesError); ok == false {
+		t.Fatalf("expected the switch to be refused, got: %v", err)
+	}
+	check_contents(t, added, "untracked")
+}
+
+func TestCanCheckout(t *testing.T) {
+	repo, f := stash_repo(t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	// test changes the file and adds another
+	check_fatal(t, repo.CheckoutBranchByName("test"))
+	check_fatal(t, ioutil.WriteFile(f, []byte("on test"), 0644))
+	added := make_file(repo.Path, t)
+	c, err := repo.CommitAll("commit in test")
+	check_fatal(t, err)
+	defer c.Free()
+	check_fatal(t, repo.CheckoutBranchByName("master"))
+
+	branch, err := repo.LookupBranch("test", git.BranchLocal)
+	check_fatal(t, err)
+	defer branch.Free()
+
+	check_fatal(t, repo.CanCheckout(branch, false))
+
+	// a conflicting local change is only in the way when kept
+	check_fatal(t, ioutil.WriteFile(f, []byte("local"), 0644))
+	if _, ok := repo.CanCheckout(branch, false).(*LocalChangesError); ok == false {
+		t.Errorf("expected the local change to be found conflicting")
+	}
+	check_fatal(t, repo.CanCheckout(branch, true))
+
+	// nothing was touched finding out
+	check_contents(t, f, "local")
+	if repo.Stashed() {
+		t.Errorf("expected nothing to be stashed")
+	}
+	changes, err := repo.Changes()
+	check_fatal(t, err)
+	if len(changes) != 1 || changes[0].Kind != ChangeUnstaged {
+		t.Errorf("expected the one unstaged change left, got: %v", changes)
+	}
+
+	// an untracked file is in the way either way
+	check_fatal(t, repo.DiscardChanges())
+	check_fatal(t, ioutil.WriteFile(added, []byte("untracked"), 0644))
+	if _, ok := repo.CanCheckout(branch, true).(*LocalChangesError); ok == false {
+		t.Errorf("expected the untracked file to be found in the way")
+	}
+}
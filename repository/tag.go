@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+//==================================================
+// Tags (snapshots)
+//==================================================
+
+// A tag in the repository and the commit it points at
+type Tag struct {
+	Name    string
+	Message string // empty for lightweight tags
+	Commit  *git.Oid
+	When    time.Time // tagger time, or the commit time for lightweight tags
+}
+
+// Sorts tags oldest first
+type byDate []Tag
+
+func (t byDate) Len() int           { return len(t) }
+func (t byDate) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byDate) Less(i, j int) bool { return t[i].When.Before(t[j].When) }
+
+// Create an annotated tag with the given message at HEAD
+func (r Repository) CreateTag(name, message string) (*git.Oid, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("a tag name is required")
+	}
+
+	sig, err := r.DefaultSignature()
+	if err != nil {
+		return nil, fmt.Errorf("could not get signature for tag: %s", err.Error())
+	}
+
+	commit, err := r.HeadCommit()
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	id, err := r.Tags.Create(name, commit, sig, message)
+	if err != nil {
+		return nil, fmt.Errorf("could not create tag %s: %s", name, err.Error())
+	}
+
+	return id, nil
+}
+
+// Get the full ref names of every tag in the repository
+func (r Repository) tagRefs() ([]string, error) {
+	iter, err := r.NewReferenceIteratorGlob("refs/tags/*")
+	if err != nil {
+		return nil, fmt.Errorf("could not list tags: %s", err.Error())
+	}
+	defer iter.Free()
+
+	refs := make([]string, 0)
+	for {
+		ref, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not list tags: %s", err.Error())
+		}
+
+		refs = append(refs, ref.Name())
+		ref.Free()
+	}
+
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// Get every tag in the repository, oldest first
+func (r Repository) ListTags() ([]Tag, error) {
+	refs, err := r.tagRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]Tag, 0, len(refs))
+	for _, name := range refs {
+		ref, err := r.References.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not get tag %s: %s", name, err.Error())
+		}
+
+		tag := Tag{Name: strings.TrimPrefix(name, "refs/tags/")}
+
+		// annotated tags point at a tag object, lightweight ones at the commit
+		if annotated, err := r.LookupTag(ref.Target()); err == nil {
+			tag.Message = strings.TrimSpace(annotated.Message())
+			tag.Commit = annotated.TargetId()
+			if tagger := annotated.Tagger(); tagger != nil {
+				tag.When = tagger.When
+			}
+			annotated.Free()
+		} else {
+			tag.Commit = ref.Target()
+		}
+		ref.Free()
+
+		if tag.When.IsZero() {
+			commit, err := r.LookupCommit(tag.Commit)
+			if err != nil {
+				return nil, fmt.Errorf("could not get commit of tag %s: %s", tag.Name, err.Error())
+			}
+			tag.When = commit.Committer().When
+			commit.Free()
+		}
+
+		tags = append(tags, tag)
+	}
+
+	sort.Stable(byDate(tags))
+
+	return tags, nil
+}
+
+// Find the commit a tag name, commit id or any other revision points at
+func (r Repository) ResolveCommit(spec string) (*git.Commit, error) {
+	obj, err := r.RevparseSingle(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %s", spec, err.Error())
+	}
+	defer obj.Free()
+
+	peeled, err := obj.Peel(git.ObjectCommit)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a commit: %s", spec, err.Error())
+	}
+	defer peeled.Free()
+
+	return r.LookupCommit(peeled.Id())
+}
+
+// Check that a rollback to the given tag or commit can go ahead: there are no
+// uncommitted changes it would lose, and HEAD is not at the snapshot already
+func (r Repository) CanRollback(spec string) error {
+	if dirty, err := r.uncommitted(); err != nil {
+		return err
+	} else if dirty {
+		return fmt.Errorf("uncommitted changes in the repository, save or discard them first")
+	}
+
+	snapshot, err := r.ResolveCommit(spec)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Free()
+
+	head, err := r.HeadCommit()
+	if err != nil {
+		return err
+	}
+	defer head.Free()
+
+	if head.TreeId().Equal(snapshot.TreeId()) {
+		return fmt.Errorf("already at %s", spec)
+	}
+	return nil
+}
+
+// Roll the working tree back to the snapshot at the given tag or commit.
+// History is kept: a new commit restoring the snapshot's tree is made on top
+// of HEAD, so it can be saved and pulled like any other change. Refuses to run
+// with uncommitted changes as they would be lost (see CanRollback).
+func (r Repository) Rollback(spec string) (*git.Commit, error) {
+	if err := r.CanRollback(spec); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := r.ResolveCommit(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Free()
+
+	tree, err := snapshot.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("could not get tree of %s: %s", spec, err.Error())
+	}
+	defer tree.Free()
+
+	head, err := r.HeadCommit()
+	if err != nil {
+		return nil, err
+	}
+	defer head.Free()
+
+	sig, err := r.DefaultSignature()
+	if err != nil {
+		return nil, fmt.Errorf("could not get signature for commit: %s", err.Error())
+	}
+
+	message := fmt.Sprintf("Roll back to %s (%s)", spec, snapshot.Id().String()[:7])
+	commit_id, err := r.CreateCommit("HEAD", sig, sig, message, tree, head)
+	if err != nil {
+		return nil, fmt.Errorf("could not create commit: %s", err.Error())
+	}
+
+	// the tree was clean, so forcing only writes the snapshot's files
+	opts := git.CheckoutOpts{
+		Strategy: git.CheckoutForce,
+	}
+	if err := r.CheckoutHead(&opts); err != nil {
+		return nil, fmt.Errorf("could not check out %s: %s", spec, err.Error())
+	}
+
+	return r.LookupCommit(commit_id)
+}
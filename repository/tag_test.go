@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCreateTag(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	make_file(repo.Path, t)
+	c, err := repo.CommitAll("test commit")
+	check_fatal(t, err)
+	defer c.Free()
+
+	_, err = repo.CreateTag("snapshot", "before the big change")
+	check_fatal(t, err)
+
+	tags, err := repo.ListTags()
+	check_fatal(t, err)
+
+	if len(tags) != 1 {
+		t.Fatalf("expected one tag, got %v", tags)
+	}
+	if tags[0].Name != "snapshot" || tags[0].Message != "before the big change" {
+		t.Errorf("wrong tag: %+v", tags[0])
+	}
+	if tags[0].Commit.Equal(c.Id()) == false {
+		t.Errorf("tag points at %s, expected %s", tags[0].Commit, c.Id())
+	}
+
+	// tags go out with every push
+	plan, err := repo.PlanPush("master")
+	check_fatal(t, err)
+	if len(plan.Push) != 2 || plan.Push[1] != "refs/tags/snapshot" {
+		t.Errorf("wrong refspecs: %v", plan.Push)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	f := make_file(repo.Path, t)
+	first, err := repo.CommitAll("first commit")
+	check_fatal(t, err)
+	defer first.Free()
+
+	_, err = repo.CreateTag("good", "known good")
+	check_fatal(t, err)
+
+	check_fatal(t, ioutil.WriteFile(f, []byte("a bad change"), 0755))
+	second, err := repo.CommitAll("second commit")
+	check_fatal(t, err)
+	defer second.Free()
+
+	rollback, err := repo.Rollback("good")
+	check_fatal(t, err)
+	defer rollback.Free()
+
+	// the rollback is a new commit on top, not a reset
+	if rollback.ParentCount() != 1 || rollback.ParentId(0).Equal(second.Id()) == false {
+		t.Errorf("rollback commit is not on top of the last commit")
+	}
+	if rollback.TreeId().Equal(first.TreeId()) == false {
+		t.Errorf("rollback commit does not have the tagged tree")
+	}
+
+	contents, err := ioutil.ReadFile(f)
+	check_fatal(t, err)
+	if string(contents) != f {
+		t.Errorf("file was not restored, contains: %s", contents)
+	}
+
+	// nothing left to roll back
+	if _, err := repo.Rollback("good"); err == nil {
+		t.Errorf("expected an error rolling back to the current tree")
+	}
+}
+
+func TestRollbackDirty(t *testing.T) {
+	repo := create_repo(default_origin, t)
+	defer os.RemoveAll(repo.Path)
+	defer repo.Free()
+
+	f := make_file(repo.Path, t)
+	first, err := repo.CommitAll("first commit")
+	check_fatal(t, err)
+	defer first.Free()
+
+	check_fatal(t, ioutil.WriteFile(f, []byte("changed"), 0755))
+	second, err := repo.CommitAll("second commit")
+	check_fatal(t, err)
+	defer second.Free()
+
+	check_fatal(t, ioutil.WriteFile(f, []byte("not saved"), 0755))
+	if _, err := repo.Rollback(first.Id().String()); err == nil {
+		t.Errorf("expected rollback to refuse a dirty working tree")
+	}
+}
@@ -0,0 +1,417 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/zmarcantel/hearth/config"
+	"github.com/zmarcantel/hearth/repository/pkg"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+//==================================================
+// Host verification
+//==================================================
+
+// Checks the host key or certificate a remote presents. SSH host keys must be
+// in a known hosts file, certificates must chain to the system's roots (or the
+// configured CA bundle) and match the hostname. Pinned fingerprints, when the
+// remote has any, replace both checks: only a pinned key or certificate is
+// accepted.
+type HostVerifier struct {
+	Remote     string // name of the remote, for pins and errors
+	Port       string // port in the remote's url, empty for the default
+	KnownHosts []string
+	CABundle   string
+	Pins       []string
+	err        error // why the last check failed
+}
+
+// Build the verifier for the named remote at the url
+func NewHostVerifier(remote_name, remote_url string, verify config.Verify) *HostVerifier {
+	return &HostVerifier{
+		Remote:     remote_name,
+		Port:       urlPort(remote_url),
+		KnownHosts: verify.KnownHostsFiles(),
+		CABundle:   verify.CABundle,
+		Pins:       verify.Pins[remote_name],
+	}
+}
+
+// Get the port of a remote url, or "" when it has none (scp-like urls never do)
+func urlPort(remote_url string) string {
+	u, err := url.Parse(remote_url)
+	if err != nil || len(u.Host) == 0 {
+		return ""
+	}
+
+	_, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// Callback refusing any host that fails Check
+func (h *HostVerifier) Callback(cert *git.Certificate, valid bool, hostname string) git.ErrorCode {
+	if h.err = h.Check(cert, valid, hostname); h.err != nil {
+		return git.ErrCertificate
+	}
+	return git.ErrOk
+}
+
+// Explain a failed remote operation with why the host was refused, if it was
+func (h *HostVerifier) Wrap(err error) error {
+	if err == nil || h.err == nil {
+		return err
+	}
+	return fmt.Errorf("%s (%s)", err.Error(), h.err.Error())
+}
+
+// Check the host key or certificate presented by hostname. Valid is whether
+// libgit2 could verify a certificate with the system's store.
+func (h *HostVerifier) Check(cert *git.Certificate, valid bool, hostname string) error {
+	if cert == nil {
+		return fmt.Errorf("%s presented nothing to verify", hostname)
+	}
+
+	if len(h.Pins) > 0 {
+		return h.checkPins(cert, hostname)
+	}
+
+	switch cert.Kind {
+	case git.CertificateHostkey:
+		return h.checkHostkey(cert.Hostkey, hostname)
+	case git.CertificateX509:
+		return h.checkX509(cert.X509, valid, hostname)
+	}
+
+	return fmt.Errorf("%s presented a certificate hearth cannot verify", hostname)
+}
+
+// Accept only a pinned fingerprint
+func (h *HostVerifier) checkPins(cert *git.Certificate, hostname string) error {
+	for _, pin := range h.Pins {
+		algo, want, err := ParseFingerprint(pin)
+		if err != nil {
+			return fmt.Errorf("bad pin for %s: %s", h.Remote, err.Error())
+		}
+
+		if got := certFingerprint(cert, algo); got != nil && bytes.Equal(got, want) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s presented %s, which is not pinned for %s", hostname, describeCert(cert), h.Remote)
+}
+
+// Get the fingerprint of the certificate with the algorithm, or nil when it
+// cannot be computed (libgit2 only gives MD5 and SHA1 of ssh host keys)
+func certFingerprint(cert *git.Certificate, algo string) []byte {
+	switch cert.Kind {
+	case git.CertificateHostkey:
+		if algo == "md5" && cert.Hostkey.Kind&git.HostkeyMD5 != 0 {
+			return cert.Hostkey.HashMD5[:]
+		}
+		if algo == "sha1" && cert.Hostkey.Kind&git.HostkeySHA1 != 0 {
+			return cert.Hostkey.HashSHA1[:]
+		}
+	case git.CertificateX509:
+		if cert.X509 == nil {
+			return nil
+		}
+
+		switch algo {
+		case "md5":
+			sum := md5.Sum(cert.X509.Raw)
+			return sum[:]
+		case "sha1":
+			sum := sha1.Sum(cert.X509.Raw)
+			return sum[:]
+		case "sha256":
+			sum := sha256.Sum256(cert.X509.Raw)
+			return sum[:]
+		}
+	}
+
+	return nil
+}
+
+// Describe what the host presented, with a fingerprint that could be pinned
+func describeCert(cert *git.Certificate) string {
+	if cert.Kind == git.CertificateHostkey {
+		if cert.Hostkey.Kind&git.HostkeySHA1 != 0 {
+			return "host key SHA1:" + base64.RawStdEncoding.EncodeToString(cert.Hostkey.HashSHA1[:])
+		}
+		return "host key MD5:" + hexColons(cert.Hostkey.HashMD5[:])
+	}
+
+	if cert.X509 == nil {
+		return "an empty certificate"
+	}
+	sum := sha256.Sum256(cert.X509.Raw)
+	return "certificate SHA256:" + hexColons(sum[:])
+}
+
+// Parse a fingerprint as printed by ssh-keygen -l -E <algo> (MD5:aa:bb:...,
+// SHA1:base64) or openssl x509 -fingerprint (SHA256 Fingerprint=AA:BB:...).
+// The algorithm is one of md5, sha1 or sha256, the value hex or base64.
+func ParseFingerprint(s string) (algo string, sum []byte, err error) {
+	s = strings.Replace(strings.TrimSpace(s), " Fingerprint=", ":", 1)
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("expected <algorithm>:<fingerprint>, got %s", s)
+	}
+
+	algo = strings.ToLower(parts[0])
+	sizes := map[string]int{"md5": md5.Size, "sha1": sha1.Size, "sha256": sha256.Size}
+	size, known := sizes[algo]
+	if known == false {
+		return "", nil, fmt.Errorf("unknown fingerprint algorithm %s", parts[0])
+	}
+
+	value := parts[1]
+	if sum, err = hex.DecodeString(strings.Replace(value, ":", "", -1)); err == nil && len(sum) == size {
+		return algo, sum, nil
+	}
+	if sum, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "=")); err == nil && len(sum) == size {
+		return algo, sum, nil
+	}
+
+	return "", nil, fmt.Errorf("%s is not a %s fingerprint", value, algo)
+}
+
+// Format bytes as colon separated hex, as in aa:bb:cc
+func hexColons(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+//==================================================
+// SSH known hosts
+//==================================================
+
+// One line of a known hosts file
+type knownHost struct {
+	Marker   string // @revoked, @cert-authority or empty
+	Patterns []string
+	KeyType  string
+	Key      []byte
+}
+
+// Parse a known hosts file, skipping comments and lines it cannot read
+func parseKnownHosts(data []byte) []knownHost {
+	hosts := make([]knownHost, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var entry knownHost
+		if strings.HasPrefix(fields[0], "@") {
+			entry.Marker = fields[0]
+			fields = fields[1:]
+		}
+		if len(fields) < 3 {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		entry.Patterns = strings.Split(fields[0], ",")
+		entry.KeyType = fields[1]
+		entry.Key = key
+		hosts = append(hosts, entry)
+	}
+
+	return hosts
+}
+
+// Truthy function on whether the entry is for the host on the port (empty for
+// the default). Covers hashed names, wildcards and negated patterns.
+func (k knownHost) matches(host, port string) bool {
+	name := strings.ToLower(host)
+	if len(port) > 0 && port != "22" {
+		name = fmt.Sprintf("[%s]:%s", name, port)
+	}
+
+	matched := false
+	for _, pattern := range k.Patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var hit bool
+		if strings.HasPrefix(pattern, "|1|") {
+			hit = hashedHostMatches(pattern, name)
+		} else {
+			hit = hostPatternMatches(strings.ToLower(pattern), name)
+		}
+
+		if hit && negated {
+			return false
+		}
+		matched = matched || hit
+	}
+
+	return matched
+}
+
+// Truthy function on whether the name fits the pattern, where * matches any
+// run of characters and ? any one. Anything else, brackets included, is literal.
+func hostPatternMatches(pattern, name string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(name); i += 1 {
+			if hostPatternMatches(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(name) > 0 && hostPatternMatches(pattern[1:], name[1:])
+	}
+
+	return len(name) > 0 && pattern[0] == name[0] && hostPatternMatches(pattern[1:], name[1:])
+}
+
+// Truthy function on whether a hashed host (|1|salt|hash) is the name
+func hashedHostMatches(hashed, name string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// Truthy function on whether the known key is the one the host presented
+func (k knownHost) is(key git.HostkeyCertificate) bool {
+	if key.Kind&git.HostkeySHA1 != 0 {
+		return sha1.Sum(k.Key) == key.HashSHA1
+	}
+	if key.Kind&git.HostkeyMD5 != 0 {
+		return md5.Sum(k.Key) == key.HashMD5
+	}
+	return false
+}
+
+// Require the host key to be listed for the host in a known hosts file
+func (h *HostVerifier) checkHostkey(key git.HostkeyCertificate, hostname string) error {
+	known, accepted := false, false
+	for _, file := range h.KnownHosts {
+		data, err := ioutil.ReadFile(pkg.ExpandHome(file))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not read %s: %s", file, err.Error())
+		}
+
+		for _, entry := range parseKnownHosts(data) {
+			if entry.Marker == "@cert-authority" || entry.matches(hostname, h.Port) == false {
+				continue
+			}
+
+			if entry.is(key) {
+				if entry.Marker == "@revoked" {
+					return fmt.Errorf("the host key of %s is revoked in %s", hostname, file)
+				}
+				accepted = true
+			} else if len(entry.Marker) == 0 {
+				known = true
+			}
+		}
+	}
+
+	if accepted {
+		return nil
+	}
+
+	cert := &git.Certificate{Kind: git.CertificateHostkey, Hostkey: key}
+	if known {
+		return fmt.Errorf("the host key of %s has changed, it presented %s, which is not in %s. someone could be intercepting the connection",
+			hostname, describeCert(cert), strings.Join(h.KnownHosts, ", "))
+	}
+	return fmt.Errorf("%s is not a known host, check that its %s is right and add it to %s (ssh-keyscan %s >> %s)",
+		hostname, describeCert(cert), h.KnownHosts[0], hostname, h.KnownHosts[0])
+}
+
+//==================================================
+// X.509 certificates
+//==================================================
+
+// Require the certificate to be for the host and to chain to a trusted root
+func (h *HostVerifier) checkX509(cert *x509.Certificate, valid bool, hostname string) error {
+	if cert == nil {
+		return fmt.Errorf("%s presented no certificate", hostname)
+	}
+
+	if err := cert.VerifyHostname(hostname); err != nil {
+		return err
+	}
+
+	// only the leaf is passed along, so the bundle has to hold any intermediates
+	if len(h.CABundle) > 0 {
+		pem, err := ioutil.ReadFile(pkg.ExpandHome(h.CABundle))
+		if err != nil {
+			return fmt.Errorf("could not read CA bundle: %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pem) == false {
+			return fmt.Errorf("no certificates in CA bundle %s", h.CABundle)
+		}
+
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: hostname, Roots: pool}); err != nil {
+			return fmt.Errorf("certificate of %s is not trusted by %s: %s", hostname, h.CABundle, err.Error())
+		}
+		return nil
+	}
+
+	// libgit2 checked the whole chain against the system's store
+	if valid {
+		return nil
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: hostname}); err != nil {
+		return fmt.Errorf("certificate of %s is not trusted: %s", hostname, err.Error())
+	}
+	return nil
+}
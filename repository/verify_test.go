@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	git "gopkg.in/libgit2/git2go.v23"
+)
+
+// A made up host key blob and what libgit2 would hand over for it
+func test_hostkey(seed string) (string, git.HostkeyCertificate) {
+	blob := []byte("ssh-ed25519 " + seed)
+	return base64.StdEncoding.EncodeToString(blob), git.HostkeyCertificate{
+		Kind:     git.HostkeyMD5 | git.HostkeySHA1,
+		HashMD5:  md5.Sum(blob),
+		HashSHA1: sha1.Sum(blob),
+	}
+}
+
+// Hash a host name the way ssh does with HashKnownHosts
+func hash_host(name string) string {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func known_hosts_verifier(t *testing.T, contents string) (*HostVerifier, string) {
+	dir := temp_dir()
+	check_fatal(t, os.Mkdir(dir, 0700))
+
+	file := path.Join(dir, "known_hosts")
+	check_fatal(t, ioutil.WriteFile(file, []byte(contents), 0600))
+
+	return &HostVerifier{Remote: "origin", KnownHosts: []string{file}}, dir
+}
+
+func TestCheckHostkey(t *testing.T) {
+	good, good_key := test_hostkey("good")
+	other, other_key := test_hostkey("other")
+	revoked, revoked_key := test_hostkey("revoked")
+
+	lines := []string{
+		"# comment",
+		"example.com,192.0.2.1 ssh-ed25519 " + good,
+		hash_host("hashed.example.com") + " ssh-ed25519 " + good,
+		"[ported.example.com]:2222 ssh-ed25519 " + good,
+		"*.wild.example.com,!bad.wild.example.com ssh-ed25519 " + good,
+		"@revoked * ssh-ed25519 " + revoked,
+		"changed.example.com ssh-ed25519 " + other,
+	}
+	h, dir := known_hosts_verifier(t, strings.Join(lines, "\n")+"\n")
+	defer os.RemoveAll(dir)
+
+	accept := []string{"example.com", "192.0.2.1", "EXAMPLE.com", "hashed.example.com", "a.wild.example.com"}
+	for _, host := range accept {
+		if err := h.checkHostkey(good_key, host); err != nil {
+			t.Errorf("expected %s to be accepted: %s", host, err)
+		}
+	}
+
+	refuse := map[string]git.HostkeyCertificate{
+		"unknown.example.com":  good_key,
+		"ported.example.com":   good_key, // only known on port 2222
+		"bad.wild.example.com": good_key,
+		"changed.example.com":  good_key,
+		"example.com":          revoked_key,
+	}
+	for host, key := range refuse {
+		if err := h.checkHostkey(key, host); err == nil {
+			t.Errorf("expected %s to be refused", host)
+		}
+	}
+
+	if err := h.checkHostkey(other_key, "changed.example.com"); err != nil {
+		t.Errorf("expected the listed key to be accepted: %s", err)
+	}
+
+	err := h.checkHostkey(good_key, "changed.example.com")
+	if err == nil || strings.Contains(err.Error(), "has changed") == false {
+		t.Errorf("expected a changed key to be reported as such, got: %v", err)
+	}
+
+	h.Port = "2222"
+	if err := h.checkHostkey(good_key, "ported.example.com"); err != nil {
+		t.Errorf("expected the host to be accepted on its port: %s", err)
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	_, key := test_hostkey("good")
+
+	md5_hex := hexColons(key.HashMD5[:])
+	sha1_b64 := base64.RawStdEncoding.EncodeToString(key.HashSHA1[:])
+
+	cases := map[string][]byte{
+		"MD5:" + md5_hex:         key.HashMD5[:],
+		"SHA1:" + sha1_b64:       key.HashSHA1[:],
+		"sha1:" + sha1_b64 + "=": key.HashSHA1[:],
+		"SHA1 Fingerprint=" + strings.ToUpper(hexColons(key.HashSHA1[:])): key.HashSHA1[:],
+	}
+	for pin, expect := range cases {
+		_, sum, err := ParseFingerprint(pin)
+		if err != nil {
+			t.Errorf("could not parse %s: %s", pin, err)
+		} else if string(sum) != string(expect) {
+			t.Errorf("wrong fingerprint from %s", pin)
+		}
+	}
+
+	for _, pin := range []string{"nothing", "SHA512:abcd", "MD5:not-hex"} {
+		if _, _, err := ParseFingerprint(pin); err == nil {
+			t.Errorf("expected %s to be refused", pin)
+		}
+	}
+}
+
+func TestCheckPins(t *testing.T) {
+	_, key := test_hostkey("good")
+	_, other := test_hostkey("other")
+
+	h := &HostVerifier{
+		Remote: "origin",
+		Pins:   []string{"SHA1:" + base64.RawStdEncoding.EncodeToString(key.HashSHA1[:])},
+	}
+
+	// pins stand in for known_hosts, which is not even looked at
+	if err := h.Check(&git.Certificate{Kind: git.CertificateHostkey, Hostkey: key}, false, "example.com"); err != nil {
+		t.Errorf("expected the pinned key to be accepted: %s", err)
+	}
+	if err := h.Check(&git.Certificate{Kind: git.CertificateHostkey, Hostkey: other}, false, "example.com"); err == nil {
+		t.Errorf("expected a key that is not pinned to be refused")
+	}
+}
+
+// Make a self signed certificate for the host, written to a PEM bundle
+func self_signed(t *testing.T, host, dir string) (*x509.Certificate, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check_fatal(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	check_fatal(t, err)
+	cert, err := x509.ParseCertificate(der)
+	check_fatal(t, err)
+
+	bundle := path.Join(dir, "ca.pem")
+	check_fatal(t, ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	return cert, bundle
+}
+
+func TestCheckX509(t *testing.T) {
+	dir := temp_dir()
+	check_fatal(t, os.Mkdir(dir, 0700))
+	defer os.RemoveAll(dir)
+
+	cert, bundle := self_signed(t, "git.example.com", dir)
+	presented := &git.Certificate{Kind: git.CertificateX509, X509: cert}
+
+	// not trusted by the system
+	h := &HostVerifier{Remote: "origin"}
+	if err := h.Check(presented, false, "git.example.com"); err == nil {
+		t.Errorf("expected a self signed certificate to be refused")
+	}
+
+	h.CABundle = bundle
+	if err := h.Check(presented, false, "git.example.com"); err != nil {
+		t.Errorf("expected the bundle to be trusted: %s", err)
+	}
+	if err := h.Check(presented, true, "other.example.com"); err == nil {
+		t.Errorf("expected a certificate for another host to be refused")
+	}
+
+	// a pin accepts it without the bundle
+	h = &HostVerifier{Remote: "origin", Pins: []string{strings.TrimPrefix(describeCert(presented), "certificate ")}}
+	if err := h.Check(presented, false, "git.example.com"); err != nil {
+		t.Errorf("expected the pinned certificate to be accepted: %s", err)
+	}
+}
@@ -0,0 +1,210 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Files ending in this hold a sealed secret, and are written without it
+const Suffix = ".secret"
+
+// First line of every sealed file, naming the format
+const header = "hearth-secret v1\n"
+
+const (
+	keySize   = 32
+	saltSize  = 16
+	nonceSize = 24
+)
+
+// Truthy function on whether the file holds a sealed secret (by its name)
+func IsSecret(p string) bool {
+	return strings.HasSuffix(p, Suffix)
+}
+
+// Truthy function on whether the contents are sealed (by the header they start
+// with)
+func IsSealed(contents []byte) bool {
+	return bytes.HasPrefix(contents, []byte(header))
+}
+
+// Convenience method for getting the default keyfile path (~/.hearth.key).
+// Kept out of the repository.
+func DefaultKeyfile() string {
+	return path.Join(os.Getenv("HOME"), ".hearth.key")
+}
+
+//==================================================
+// Keys
+//==================================================
+
+// What secrets are sealed with: the key in a keyfile, or one derived from a
+// passphrase with scrypt
+type Key struct {
+	raw        *[keySize]byte
+	passphrase []byte
+}
+
+// Use the passphrase as the key
+func KeyFromPassphrase(passphrase string) Key {
+	return Key{passphrase: []byte(passphrase)}
+}
+
+// Read the key from a keyfile, which holds it hex encoded
+func ReadKeyfile(p string) (Key, error) {
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		return Key{}, err
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(decoded) != keySize {
+		return Key{}, fmt.Errorf("%s does not hold a %d byte hex encoded key", p, keySize)
+	}
+
+	var raw [keySize]byte
+	copy(raw[:], decoded)
+	return Key{raw: &raw}, nil
+}
+
+// Create a keyfile holding a new random key, readable only by the user. An
+// existing file is not overwritten.
+func CreateKeyfile(p string) (Key, error) {
+	var raw [keySize]byte
+	if _, err := io.ReadFull(rand.Reader, raw[:]); err != nil {
+		return Key{}, fmt.Errorf("could not generate key: %s", err.Error())
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Key{}, fmt.Errorf("could not create keyfile: %s", err.Error())
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(raw[:])); err != nil {
+		return Key{}, fmt.Errorf("could not write keyfile: %s", err.Error())
+	}
+
+	return Key{raw: &raw}, nil
+}
+
+// Get the secretbox key for a secret with the given salt
+func (k Key) derive(salt []byte) (*[keySize]byte, error) {
+	if k.raw != nil {
+		return k.raw, nil
+	}
+
+	if len(k.passphrase) == 0 {
+		return nil, fmt.Errorf("no key or passphrase given")
+	}
+
+	derived, err := scrypt.Key(k.passphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [keySize]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+//==================================================
+// Sealing
+//==================================================
+
+// Encrypt and authenticate the plaintext with NaCl's secretbox. The result is
+// text: the header followed by the base64 of salt, nonce and box.
+func Seal(k Key, plaintext []byte) ([]byte, error) {
+	var salt [saltSize]byte
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	key, err := k.derive(salt[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append(salt[:], nonce[:]...)
+	sealed = secretbox.Seal(sealed, plaintext, &nonce, key)
+
+	encoded := base64.StdEncoding.EncodeToString(sealed)
+	var out bytes.Buffer
+	out.WriteString(header)
+	for len(encoded) > 76 {
+		out.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	out.WriteString(encoded + "\n")
+
+	return out.Bytes(), nil
+}
+
+// Decrypt what Seal gave, failing when the key is wrong or it was tampered with
+func Open(k Key, sealed []byte) ([]byte, error) {
+	if IsSealed(sealed) == false {
+		return nil, fmt.Errorf("not a hearth secret")
+	}
+
+	encoded := strings.Replace(string(sealed[len(header):]), "\n", "", -1)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt secret: %s", err.Error())
+	} else if len(decoded) < saltSize+nonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("corrupt secret: too short")
+	}
+
+	key, err := k.derive(decoded[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], decoded[saltSize:saltSize+nonceSize])
+
+	plaintext, ok := secretbox.Open(nil, decoded[saltSize+nonceSize:], &nonce, key)
+	if ok == false {
+		return nil, fmt.Errorf("could not decrypt secret: wrong key or passphrase")
+	}
+
+	return plaintext, nil
+}
+
+// Decrypt the sealed file
+func OpenFile(k Key, p string) ([]byte, error) {
+	sealed, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := Open(k, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p, err.Error())
+	}
+	return plaintext, nil
+}
+
+// Seal the plaintext into the file. The sealed form is safe to commit.
+func SealFile(k Key, p string, plaintext []byte) error {
+	sealed, err := Seal(k, plaintext)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, sealed, 0644)
+}
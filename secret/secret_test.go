@@ -0,0 +1,101 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+//==================================================
+// secret tests
+//==================================================
+
+func temp_keyfile(t *testing.T) (string, Key) {
+	dir, err := ioutil.TempDir("", "hearth-secret-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := CreateKeyfile(path.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, key
+}
+
+func TestSeal_Keyfile(t *testing.T) {
+	dir, key := temp_keyfile(t)
+	defer os.RemoveAll(dir)
+
+	sealed, err := Seal(key, []byte("token: abc123\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsSealed(sealed) == false || IsSealed([]byte("token: abc123\n")) {
+		t.Errorf("expected only the sealed form to be found sealed")
+	}
+
+	// the key read back opens what the created one sealed
+	read, err := ReadKeyfile(path.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Open(read, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "token: abc123\n" {
+		t.Errorf("wrong plaintext: %q", plaintext)
+	}
+
+	if s, err := os.Stat(path.Join(dir, "key")); err != nil || s.Mode().Perm() != 0600 {
+		t.Errorf("expected the keyfile to be readable by the user alone")
+	}
+	if _, err := CreateKeyfile(path.Join(dir, "key")); err == nil {
+		t.Errorf("expected an existing keyfile not to be overwritten")
+	}
+}
+
+func TestOpen_WrongKey(t *testing.T) {
+	dir, key := temp_keyfile(t)
+	defer os.RemoveAll(dir)
+
+	sealed, err := Seal(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := CreateKeyfile(path.Join(dir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(other, sealed); err == nil {
+		t.Errorf("expected the wrong key to fail")
+	}
+
+	// flip a byte of the box
+	sealed[len(sealed)-3] ^= 1
+	if _, err := Open(key, sealed); err == nil {
+		t.Errorf("expected a tampered secret to fail")
+	}
+}
+
+func TestSeal_Passphrase(t *testing.T) {
+	sealed, err := Seal(KeyFromPassphrase("correct horse"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := Open(KeyFromPassphrase("correct horse"), sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("wrong plaintext: %q", plaintext)
+	}
+
+	if _, err := Open(KeyFromPassphrase("battery staple"), sealed); err == nil {
+		t.Errorf("expected the wrong passphrase to fail")
+	}
+}
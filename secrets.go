@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zmarcantel/hearth/config"
+	"github.com/zmarcantel/hearth/repository"
+	"github.com/zmarcantel/hearth/secret"
+
+	"github.com/codegangsta/cli"
+)
+
+//==================================================
+// secret key helpers
+//==================================================
+
+// Environment variable holding the passphrase, for running without a terminal
+const PASSPHRASE_ENV = "HEARTH_PASSPHRASE"
+
+// the key once unlocked, so a passphrase is asked for once per run
+var unlocked *secret.Key
+
+// Get the key secrets are sealed with: from $HEARTH_PASSPHRASE, asked for when
+// the config uses a passphrase, or else read from the keyfile. With create, a
+// missing keyfile is created.
+func secret_key(conf config.Config, create bool) (secret.Key, error) {
+	if unlocked != nil {
+		return *unlocked, nil
+	}
+
+	var key secret.Key
+	if env := os.Getenv(PASSPHRASE_ENV); len(env) > 0 {
+		key = secret.KeyFromPassphrase(env)
+	} else if conf.Secrets.Passphrase {
+		passphrase, err := ask_passphrase("secrets passphrase: ", create)
+		if err != nil {
+			return key, err
+		}
+		key = secret.KeyFromPassphrase(passphrase)
+	} else {
+		var err error
+		if key, err = open_keyfile(conf.Secrets.KeyfilePath(), create); err != nil {
+			return key, err
+		}
+	}
+
+	unlocked = &key
+	return key, nil
+}
+
+// Read the keyfile, creating it when asked to and there is none
+func open_keyfile(keyfile string, create bool) (secret.Key, error) {
+	key, err := secret.ReadKeyfile(keyfile)
+	if err == nil || os.IsNotExist(err) == false {
+		return key, err
+	} else if create == false {
+		return key, fmt.Errorf("no keyfile at %s, copy it over from a machine that has one", keyfile)
+	}
+
+	if key, err = secret.CreateKeyfile(keyfile); err != nil {
+		return key, err
+	}
+	log.Printf("WARN: created keyfile %s, back it up: without it the secrets cannot be decrypted", keyfile)
+
+	return key, nil
+}
+
+// Ask for a passphrase, twice when it is new so a typo does not lock the
+// secrets away
+func ask_passphrase(msg string, confirm bool) (string, error) {
+	passphrase, err := repository.ReadPassphrase(msg)
+	if err != nil {
+		return "", err
+	} else if len(passphrase) == 0 {
+		return "", fmt.Errorf("empty passphrase")
+	}
+
+	if confirm {
+		again, err := repository.ReadPassphrase("again: ")
+		if err != nil {
+			return "", err
+		} else if again != passphrase {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+// Get the path of the file given on the command line, relative to the
+// repository it must be inside of
+func repo_relpath(repo repository.Repository, p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rel, err := filepath.Rel(repo.Path, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		log.Fatalf("%s is not in the repository (%s)", p, repo.Path)
+	}
+
+	return rel
+}
+
+//==================================================
+// secret actions
+//==================================================
+
+// Seal each file given into <file>.secret and remove the plaintext. A keyfile
+// is created when there is none.
+func action_secret_add(ctx *cli.Context) {
+	if len(ctx.Args()) == 0 {
+		log.Fatal("no files provided")
+	}
+
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	relpaths := make([]string, 0, len(ctx.Args()))
+	for _, p := range ctx.Args() {
+		rel := repo_relpath(repo, p)
+		if secret.IsSecret(rel) {
+			log.Fatalf("%s is sealed already, see 'hearth secret edit'", p)
+		} else if s, err := os.Stat(path.Join(repo.Path, rel)); err != nil {
+			log.Fatal(err)
+		} else if s.Mode().IsRegular() == false {
+			log.Fatalf("%s is not a file", p)
+		} else if _, err := os.Stat(path.Join(repo.Path, rel+secret.Suffix)); err == nil {
+			log.Fatalf("%s already exists", rel+secret.Suffix)
+		}
+		relpaths = append(relpaths, rel)
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		for _, rel := range relpaths {
+			fmt.Printf("[ plan ] seal %s -> %s\n", rel, rel+secret.Suffix)
+		}
+		return
+	}
+
+	key, err := secret_key(repo.Config, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, rel := range relpaths {
+		plain_path := path.Join(repo.Path, rel)
+		plaintext, err := ioutil.ReadFile(plain_path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := secret.SealFile(key, plain_path+secret.Suffix, plaintext); err != nil {
+			log.Fatalf("could not seal %s: %s", rel, err.Error())
+		}
+		if err := os.Remove(plain_path); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("sealed %s\n", rel+secret.Suffix)
+
+		if repo.InHead(rel) {
+			log.Printf("WARN: %s was committed in plaintext and stays in the history, change the secret itself", rel)
+		}
+		if name := repository.PackageOf(rel); repo.PackageExists(name) {
+			fmt.Printf("run 'hearth update %s' to decrypt it into place\n", name)
+		}
+	}
+}
+
+// Decrypt a secret to a private temporary file, open it in $EDITOR and seal
+// what was saved. A secret that does not exist yet starts out empty.
+func action_secret_edit(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		log.Fatal("exactly one secret must be given")
+	}
+
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	rel := repo_relpath(repo, ctx.Args()[0])
+	if secret.IsSecret(rel) == false {
+		rel += secret.Suffix
+	}
+	sealed_path := path.Join(repo.Path, rel)
+
+	_, err = os.Stat(sealed_path)
+	exists := err == nil
+	if err != nil && os.IsNotExist(err) == false {
+		log.Fatal(err)
+	} else if _, err := os.Stat(strings.TrimSuffix(sealed_path, secret.Suffix)); exists == false && err == nil {
+		log.Fatalf("%s is in plaintext, seal it with 'hearth secret add' first", strings.TrimSuffix(rel, secret.Suffix))
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		fmt.Printf("[ plan ] edit %s\n", rel)
+		return
+	}
+
+	key, err := secret_key(repo.Config, exists == false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var plaintext []byte
+	if exists {
+		if plaintext, err = secret.OpenFile(key, sealed_path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the directory is only readable by the user, and keeps the name for the editor
+	dir, err := ioutil.TempDir("", "hearth-secret-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	temp_path := path.Join(dir, strings.TrimSuffix(path.Base(rel), secret.Suffix))
+	if err := ioutil.WriteFile(temp_path, plaintext, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := run_editor(temp_path); err != nil {
+		os.RemoveAll(dir) // log.Fatal skips the deferred removal
+		log.Fatal(err)
+	}
+
+	edited, err := ioutil.ReadFile(temp_path)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Fatal(err)
+	}
+
+	if exists && bytes.Equal(edited, plaintext) {
+		fmt.Printf("%s unchanged\n", rel)
+		return
+	}
+
+	if err := secret.SealFile(key, sealed_path, edited); err != nil {
+		os.RemoveAll(dir)
+		log.Fatalf("could not seal %s: %s", rel, err.Error())
+	}
+	fmt.Printf("sealed %s\n", rel)
+}
+
+// Reseal every secret in the repository with a new key: a new passphrase when
+// the config uses one, otherwise a new keyfile. The old keyfile is kept next to
+// the new one, for machines that have yet to pull the resealed secrets.
+func action_secret_rekey(ctx *cli.Context) {
+	repo, err := repository.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Free()
+
+	relpaths, err := repo.SealedFiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if ctx.GlobalBool("dry-run") {
+		for _, rel := range relpaths {
+			fmt.Printf("[ plan ] reseal %s\n", rel)
+		}
+		return
+	}
+
+	old_key, err := secret_key(repo.Config, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// decrypt everything first, so a secret the old key cannot open stops
+	// the rekey before anything is written
+	plaintexts := make([][]byte, len(relpaths))
+	for i, rel := range relpaths {
+		if plaintexts[i], err = secret.OpenFile(old_key, path.Join(repo.Path, rel)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var new_key secret.Key
+	keyfile := repo.Config.Secrets.KeyfilePath()
+	if repo.Config.Secrets.Passphrase {
+		passphrase, err := ask_passphrase("new secrets passphrase: ", true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		new_key = secret.KeyFromPassphrase(passphrase)
+	} else if new_key, err = secret.CreateKeyfile(keyfile + ".new"); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, rel := range relpaths {
+		if err := secret.SealFile(new_key, path.Join(repo.Path, rel), plaintexts[i]); err != nil {
+			log.Fatalf("could not reseal %s: %s", rel, err.Error())
+		}
+		fmt.Printf("resealed %s\n", rel)
+	}
+
+	if repo.Config.Secrets.Passphrase == false {
+		if err := os.Rename(keyfile, keyfile+".old"); err != nil && os.IsNotExist(err) == false {
+			log.Fatal(err)
+		}
+		if err := os.Rename(keyfile+".new", keyfile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("WARN: new key in %s, back it up and copy it to your other machines (the old one is in %s.old)", keyfile, keyfile)
+	}
+
+	if repo.Config.Secrets.Passphrase && len(os.Getenv(PASSPHRASE_ENV)) > 0 {
+		log.Printf("WARN: $%s holds the old passphrase", PASSPHRASE_ENV)
+	}
+	fmt.Println("commit the resealed secrets with 'hearth save'")
+}
@@ -0,0 +1,187 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const Name string = "state.yml"
+
+// Maximum number of commands remembered per package. Oldest are dropped first.
+const MaxCommands int = 256
+
+// Get the path of the install ledger. Lives in $XDG_STATE_HOME/hearth, which
+// defaults to ~/.local/state/hearth, as the ledger is specific to this machine
+// and must never be committed into the repository.
+func Path() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if len(dir) == 0 {
+		dir = path.Join(os.Getenv("HOME"), ".local", "state")
+	}
+
+	return path.Join(dir, "hearth", Name)
+}
+
+// Get a fresh, timestamped directory for files moved aside during an install.
+// The directory itself is only created once something is backed up.
+func BackupDir(t time.Time) string {
+	return path.Join(path.Dir(Path()), "backup", t.Format("20060102-150405"))
+}
+
+//==================================================
+// Package state
+//==================================================
+
+// Everything hearth has done on this machine for a single package
+type Package struct {
+	Commit    string        `yaml:"commit,omitempty"`
+	Installed time.Time     `yaml:"installed"`
+	Updated   time.Time     `yaml:"updated"`
+	Links     []pkg.Link    `yaml:"links,omitempty"`
+	Commands  []pkg.Command `yaml:"commands,omitempty"`
+}
+
+// Add the commands in the record, dropping the oldest when over MaxCommands
+func (p *Package) addCommands(cmds []pkg.Command) {
+	p.Commands = append(p.Commands, cmds...)
+	if over := len(p.Commands) - MaxCommands; over > 0 {
+		p.Commands = p.Commands[over:]
+	}
+}
+
+// Add links in the record, replacing those already known at the same target
+// (a file rendered again has a new checksum)
+func (p *Package) addLinks(links []pkg.Link) {
+	for _, l := range links {
+		known := false
+		for n, existing := range p.Links {
+			if existing.Target == l.Target {
+				p.Links[n] = l
+				known = true
+				break
+			}
+		}
+
+		if known == false {
+			p.Links = append(p.Links, l)
+		}
+	}
+}
+
+//==================================================
+// Ledger
+//==================================================
+
+// The install ledger. Records the links and commands of every package installed
+// on this machine along with the commit they came from.
+type State struct {
+	path     string
+	Packages map[string]Package
+}
+
+// Opens the ledger at the default Path()
+func Open() (*State, error) {
+	return OpenFile(Path())
+}
+
+// Opens the ledger at the given path. A missing file is an empty ledger.
+func OpenFile(p string) (*State, error) {
+	s := &State{path: p, Packages: make(map[string]Package)}
+
+	state_bytes, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read install state: %s", err.Error())
+	}
+
+	if err := yaml.Unmarshal(state_bytes, s); err != nil {
+		return nil, fmt.Errorf("failed to parse install state: %s", err.Error())
+	}
+
+	if s.Packages == nil {
+		s.Packages = make(map[string]Package)
+	}
+
+	return s, nil
+}
+
+// Write the ledger back to the path it was opened from
+func (s *State) Write() error {
+	state_bytes, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not marshal install state: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(path.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("could not create state directory: %s", err.Error())
+	}
+
+	if err := ioutil.WriteFile(s.path, state_bytes, 0644); err != nil {
+		return fmt.Errorf("could not save install state: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Get the state of the package with the given name.
+// Boolean in return is existence check.
+func (s *State) Get(name string) (Package, bool) {
+	p, exists := s.Packages[name]
+	return p, exists
+}
+
+// Get the names of the installed packages that rendered templates, sorted
+func (s *State) Rendered() []string {
+	names := make([]string, 0)
+	for name, p := range s.Packages {
+		for _, l := range p.Links {
+			if l.Mode == pkg.ModeTemplate {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Record a fresh install of a package from the given commit, replacing
+// anything previously known about it
+func (s *State) Installed(name, commit string, rec pkg.Record) {
+	now := time.Now()
+	p := Package{Commit: commit, Installed: now, Updated: now}
+	p.addLinks(rec.Links)
+	p.addCommands(rec.Commands)
+
+	s.Packages[name] = p
+}
+
+// Record an update of a package to the given commit
+func (s *State) Updated(name, commit string, rec pkg.Record) {
+	p, exists := s.Packages[name]
+	if exists == false {
+		p.Installed = time.Now()
+	}
+
+	p.Commit = commit
+	p.Updated = time.Now()
+	p.addLinks(rec.Links)
+	p.addCommands(rec.Commands)
+
+	s.Packages[name] = p
+}
+
+// Forget a package after it has been uninstalled
+func (s *State) Uninstalled(name string) {
+	delete(s.Packages, name)
+}
@@ -0,0 +1,139 @@
+package state
+
+import (
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zmarcantel/hearth/repository/pkg"
+)
+
+func temp_dir() string {
+	rand.Seed(time.Now().UnixNano())
+	return path.Join(os.TempDir(), strconv.FormatUint(uint64(rand.Int63()), 10))
+}
+
+func TestOpenFile_Missing(t *testing.T) {
+	dir := temp_dir()
+	defer os.RemoveAll(dir)
+
+	s, err := OpenFile(path.Join(dir, Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Packages) != 0 {
+		t.Errorf("expected empty state, found %d packages", len(s.Packages))
+	}
+}
+
+func TestWrite_RoundTrip(t *testing.T) {
+	dir := temp_dir()
+	defer os.RemoveAll(dir)
+
+	s, err := OpenFile(path.Join(dir, Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Installed("vim", "abc123", pkg.Record{
+		Links:    []pkg.Link{{Source: "/repo/vim", Target: "/home/vim"}},
+		Commands: []pkg.Command{{Cmd: "touch x", Dir: "/repo/vim", Ran: time.Now()}},
+	})
+	if err := s.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFile(path.Join(dir, Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, exists := reopened.Get("vim")
+	if exists == false {
+		t.Fatalf("expected vim to be in the state")
+	}
+
+	if p.Commit != "abc123" {
+		t.Errorf("wrong commit: '%s'", p.Commit)
+	}
+	if len(p.Links) != 1 || p.Links[0].Target != "/home/vim" {
+		t.Errorf("wrong links: %v", p.Links)
+	}
+	if len(p.Commands) != 1 || p.Commands[0].Cmd != "touch x" {
+		t.Errorf("wrong commands: %v", p.Commands)
+	}
+}
+
+func TestUpdated_MergesLinks(t *testing.T) {
+	s := &State{Packages: make(map[string]Package)}
+	link := pkg.Link{Source: "/repo/a/.rc", Target: "/home/.rc"}
+
+	s.Installed("a", "1", pkg.Record{Links: []pkg.Link{link}})
+	s.Updated("a", "2", pkg.Record{Links: []pkg.Link{link, {Source: "/repo/a/.new", Target: "/home/.new"}}})
+
+	p, _ := s.Get("a")
+	if p.Commit != "2" {
+		t.Errorf("expected commit to be updated, got '%s'", p.Commit)
+	}
+	if len(p.Links) != 2 {
+		t.Errorf("expected 2 links, got %d", len(p.Links))
+	}
+}
+
+func TestRendered(t *testing.T) {
+	s := &State{Packages: make(map[string]Package)}
+	s.Installed("vim", "1", pkg.Record{Links: []pkg.Link{{Source: "/repo/vim/.vimrc", Target: "/home/.vimrc"}}})
+	s.Installed("git", "1", pkg.Record{Links: []pkg.Link{
+		{Source: "/repo/git/.gitignore", Target: "/home/.gitignore"},
+		{Source: "/repo/git/.gitconfig.tmpl", Target: "/home/.gitconfig", Mode: pkg.ModeTemplate},
+	}})
+	s.Installed("ssh", "1", pkg.Record{Links: []pkg.Link{{Source: "/repo/ssh/config.tmpl", Target: "/home/.ssh/config", Mode: pkg.ModeTemplate}}})
+
+	rendered := s.Rendered()
+	if len(rendered) != 2 || rendered[0] != "git" || rendered[1] != "ssh" {
+		t.Errorf("expected git and ssh, got: %v", rendered)
+	}
+}
+
+func TestUpdated_CapsCommands(t *testing.T) {
+	s := &State{Packages: make(map[string]Package)}
+
+	cmds := make([]pkg.Command, MaxCommands+10)
+	for i := range cmds {
+		cmds[i].Cmd = strconv.Itoa(i)
+	}
+	s.Updated("a", "1", pkg.Record{Commands: cmds})
+
+	p, _ := s.Get("a")
+	if len(p.Commands) != MaxCommands {
+		t.Fatalf("expected %d commands, got %d", MaxCommands, len(p.Commands))
+	}
+	if p.Commands[0].Cmd != "10" {
+		t.Errorf("expected oldest commands to be dropped, first is '%s'", p.Commands[0].Cmd)
+	}
+}
+
+func TestUninstalled(t *testing.T) {
+	s := &State{Packages: make(map[string]Package)}
+	s.Installed("a", "1", pkg.Record{})
+	s.Uninstalled("a")
+
+	if _, exists := s.Get("a"); exists {
+		t.Fatalf("package still in state after uninstall")
+	}
+}
+
+func TestBackupDir(t *testing.T) {
+	old := os.Getenv("XDG_STATE_HOME")
+	defer os.Setenv("XDG_STATE_HOME", old)
+	os.Setenv("XDG_STATE_HOME", "/tmp/state")
+
+	when := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+	if dir := BackupDir(when); dir != "/tmp/state/hearth/backup/20160304-050607" {
+		t.Fatalf("wrong backup directory: %s", dir)
+	}
+}